@@ -0,0 +1,160 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "fmt"
+import "io"
+import "net"
+import "sync"
+import "time"
+
+// AccessEvent classifies AccessRecords.
+type AccessEvent int
+
+const (
+	EventHandshakeFailed AccessEvent = iota // Client failed to negotiate an auth method
+	EventDenied                             // Request was denied by policy
+	EventFailed                             // Connecting to the destination failed
+	EventConnected                          // Connected to the destination
+	EventClosed                             // Session ended, after relaying
+)
+
+func (self AccessEvent) String() string {
+	switch self {
+	case EventHandshakeFailed:
+		return "handshake failure"
+	case EventDenied:
+		return "denied"
+	case EventFailed:
+		return "failed"
+	case EventConnected:
+		return "connected"
+	case EventClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Reasons sessions closed, as reported via AccessRecord.Reason.
+const (
+	CloseDone        = "done"         // Both peers closed their side
+	CloseIdle        = "idle"         // An idle timeout expired, with peers not probed, see SessionOptions.Liveness
+	ClosePeerDead    = "peer-dead"    // A peer reset the connection, or stopped answering keepalive probes
+	CloseHalfOpen    = "half-open"    // Half-open for longer than the half-open timeout
+	CloseCapped      = "capped"       // Transfer cap reached, see SessionOptions.MaxBytes
+	CloseMaxDuration = "max-duration" // See SessionOptions.MaxDuration
+	CloseMemory      = "memory"       // Idle longest while over the memory budget, see MemoryBudget
+	CloseError       = "error"        // Relaying failed otherwise
+)
+
+// AccessRecord describes the outcome of a single client request.
+type AccessRecord struct {
+	Time   time.Time
+	Event  AccessEvent
+	Client *ClientInfo
+	Host   string // Requested domain, if any
+	Dest   net.IP // Destination IP, if already known
+	Port   int    // Destination port, if already known
+	Err    error  // Cause of failures and denials
+	Reason string // Policy that caused a denial, e.g. ReasonDomainRule, or why a session closed, e.g. ClosePeerDead
+
+	// Destination as requested by the client, host:port, if a Rewriter
+	// rewrote it to Host, or Dest, and Port.
+	// See: Server.SetRewriter()
+	Original string
+
+	// How the client performed the handshake, as far as it got.
+	Fingerprint *Fingerprint
+
+	// Of EventClosed records of sessions speaking TLS, if observed.
+	// See: SessionOptions.ObserveTLS
+	TLS *TLSInfo
+
+	// Reverse DNS names of client and destination, if enabled.
+	// See: Server.SetReverseDNS()
+	ClientName string
+	DestName   string
+
+	// Verbosity and tag of the session, see SessionOptions.LogLevel.
+	Level LogLevel
+	Tag   string
+	Tags  map[string]string // See SessionOptions.Tags
+
+	// Of EventClosed records: when the session connected, and the bytes sent
+	// by the client and the destination.
+	Start     time.Time
+	BytesUp   uint64
+	BytesDown uint64
+}
+
+// Returns the destination as requested, i.e. host:port or ip:port.
+func (self *AccessRecord) Destination() string {
+	host := self.Host
+	if len(host) == 0 && self.Dest != nil {
+		host = self.Dest.String()
+	}
+	if len(host) == 0 {
+		return "-"
+	}
+	return joinHostPort(host, self.Port)
+}
+
+// AccessLogger receives AccessRecords for all client requests.
+// Implementations must be safe for concurrent use.
+type AccessLogger interface {
+	LogAccess(record *AccessRecord)
+}
+
+type fail2banLogger struct {
+	sync.Mutex
+	w io.Writer
+}
+
+// Creates an AccessLogger writing one line per handshake failure and denied
+// request to w, suitable for fail2ban, e.g.:
+//
+//	2013-10-01 12:34:56 gosocksv5d: denied client=192.0.2.1 dest=example.com:25 reason="Destination not allowed"
+//
+// A matching fail2ban filter would be:
+//
+//	[Definition]
+//	failregex = ^\s*gosocksv5d: (handshake failure|denied) client=<HOST>
+func NewFail2banLogger(w io.Writer) AccessLogger {
+	return &fail2banLogger{w: w}
+}
+
+func (self *fail2banLogger) LogAccess(record *AccessRecord) {
+	if record.Event != EventHandshakeFailed && record.Event != EventDenied {
+		return
+	}
+	reason := "-"
+	if record.Err != nil {
+		reason = record.Err.Error()
+	}
+	self.Lock()
+	defer self.Unlock()
+	fmt.Fprintf(self.w, "%s gosocksv5d: %v client=%v dest=%s reason=%q\n",
+		record.Time.Format("2006-01-02 15:04:05"), record.Event, record.Client.IP,
+		record.Destination(), reason)
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,191 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "net"
+import "sort"
+
+// AddressOrder selects how the IPs a domain resolved to are ordered, i.e.
+// which ones get connected to first.
+type AddressOrder int
+
+const (
+	OrderAsResolved AddressOrder = iota // Keep the order of the DNSResolver
+	OrderRFC6724                        // Sort per RFC 6724 destination address selection
+)
+
+type policyEntry struct {
+	prefix     *net.IPNet
+	precedence int
+	label      int
+}
+
+// RFC 6724, section 2.1; longest prefixes first.
+var policyTable = []policyEntry{
+	{mustCIDR("::1/128"), 50, 0},
+	{mustCIDR("::ffff:0:0/96"), 35, 4},
+	{mustCIDR("::/96"), 1, 3},
+	{mustCIDR("2001::/32"), 5, 5},
+	{mustCIDR("2002::/16"), 30, 2},
+	{mustCIDR("3ffe::/16"), 1, 12},
+	{mustCIDR("fec0::/10"), 1, 11},
+	{mustCIDR("fc00::/7"), 3, 13},
+	{mustCIDR("::/0"), 40, 1},
+}
+
+func mustCIDR(cidr string) *net.IPNet {
+	_, network, err := net.ParseCIDR(cidr)
+	if err != nil {
+		panic(err)
+	}
+	return network
+}
+
+func classify(ip net.IP) policyEntry {
+	ip = ip.To16()
+	for _, entry := range policyTable {
+		if entry.prefix.Contains(ip) {
+			return entry
+		}
+	}
+	return policyTable[len(policyTable)-1]
+}
+
+const (
+	scopeLinkLocal = 0x2
+	scopeSiteLocal = 0x5
+	scopeGlobal    = 0xe
+)
+
+// RFC 6724, section 3.
+func addressScope(ip net.IP) int {
+	if ip4 := ip.To4(); ip4 != nil {
+		if ip4.IsLoopback() || ip4.IsLinkLocalUnicast() {
+			return scopeLinkLocal
+		}
+		return scopeGlobal
+	}
+	switch {
+	case ip.IsMulticast():
+		return int(ip[1] & 0xf)
+	case ip.IsLoopback(), ip.IsLinkLocalUnicast():
+		return scopeLinkLocal
+	case ip[0] == 0xfe && ip[1]&0xc0 == 0xc0:
+		return scopeSiteLocal
+	}
+	return scopeGlobal
+}
+
+func commonPrefixLen(a, b net.IP) int {
+	if a4, b4 := a.To4(), b.To4(); a4 != nil && b4 != nil {
+		a, b = a4, b4
+	} else {
+		a, b = a.To16(), b.To16()
+	}
+	n := 0
+	for i := range a {
+		x := a[i] ^ b[i]
+		if x == 0 {
+			n += 8
+			continue
+		}
+		for x&0x80 == 0 {
+			n++
+			x <<= 1
+		}
+		break
+	}
+	return n
+}
+
+// Finds the source address the system would use to reach dst, preferring
+// local, the address outgoing connections get bound to, if specified.
+// Returns nil if dst is not reachable.
+func sourceAddress(local, dst net.IP) net.IP {
+	if local != nil && !local.IsUnspecified() {
+		if (local.To4() != nil) != (dst.To4() != nil) {
+			return nil
+		}
+		return local
+	}
+	conn, err := net.DialUDP("udp", nil, &net.UDPAddr{IP: dst, Port: 9})
+	if err != nil {
+		return nil
+	}
+	defer conn.Close()
+	return conn.LocalAddr().(*net.UDPAddr).IP
+}
+
+type candidate struct {
+	dst, src  net.IP
+	dstScope  int
+	srcScope  int
+	dstPolicy policyEntry
+	srcPolicy policyEntry
+}
+
+// Sorts addrs per RFC 6724, section 6, skipping the rules concerning
+// deprecated, home and care-of addresses and native transports.
+func sortRFC6724(addrs []net.IP, local net.IP) {
+	candidates := make([]candidate, len(addrs))
+	for i, dst := range addrs {
+		c := candidate{dst: dst, dstScope: addressScope(dst), dstPolicy: classify(dst)}
+		if c.src = sourceAddress(local, dst); c.src != nil {
+			c.srcScope, c.srcPolicy = addressScope(c.src), classify(c.src)
+		}
+		candidates[i] = c
+	}
+	sort.SliceStable(candidates, func(i, j int) bool {
+		a, b := &candidates[i], &candidates[j]
+		// Rule 1: Avoid unusable destinations
+		if (a.src == nil) != (b.src == nil) {
+			return a.src != nil
+		}
+		// Rule 2: Prefer matching scope
+		if ma, mb := a.dstScope == a.srcScope, b.dstScope == b.srcScope; ma != mb {
+			return ma
+		}
+		// Rule 5: Prefer matching label
+		if ma, mb := a.dstPolicy.label == a.srcPolicy.label, b.dstPolicy.label == b.srcPolicy.label; ma != mb {
+			return ma
+		}
+		// Rule 6: Prefer higher precedence
+		if a.dstPolicy.precedence != b.dstPolicy.precedence {
+			return a.dstPolicy.precedence > b.dstPolicy.precedence
+		}
+		// Rule 8: Prefer smaller scope
+		if a.dstScope != b.dstScope {
+			return a.dstScope < b.dstScope
+		}
+		// Rule 9: Use longest matching prefix, within the same family
+		if a.src != nil && b.src != nil && (a.dst.To4() != nil) == (b.dst.To4() != nil) {
+			return commonPrefixLen(a.dst, a.src) > commonPrefixLen(b.dst, b.src)
+		}
+		// Rule 10: Otherwise, leave the order unchanged
+		return false
+	})
+	for i := range candidates {
+		addrs[i] = candidates[i].dst
+	}
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,311 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package admin implements an HTTP API for inspecting and managing a running
+// gosocksv5d server:
+//
+//	GET  /stats                  Server counters, see gosocksv5d.Stats
+//	GET  /destinations?n=&window= Top destinations, see Server.TopDestinations
+//	GET  /sessions               Sessions relaying, see Server.Sessions
+//	GET  /config                 Running config, redacted, see config.Config.Redacted
+//	POST /config/diff            Changes of the posted config to the running one
+//	POST /config/apply           Applies the posted config, returning the changes
+//
+// With Debug and a Token, for diagnosing hangs and leaks:
+//
+//	GET  /debug/runtime          Goroutines, heap, GC and open file descriptors
+//	GET  /debug/pprof/           Profiles, see net/http/pprof
+//
+// Posted configs are parsed strictly and validated, errors being reported as
+// {"errors": [...]}. Applied configs serve new connections only, existing
+// ones continuing with the previous config. Posted configs may only reference
+// the files the running config references (rules files, ASN database), so
+// that the API cannot be used to read other files. Diffs are of the redacted
+// configs, so changed credentials do not show.
+//
+// Serve the API on a separate, non-public listener, e.g.:
+//
+//	api := &admin.API{Token: token, Server: func() gosocksv5d.Server { return srv }}
+//	go http.ListenAndServe("127.0.0.1:9090", api)
+package admin
+
+import "crypto/subtle"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "net/http"
+import "net/http/pprof"
+import "os"
+import "runtime"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+import "github.com/nmaier/gosocksv5d"
+import "github.com/nmaier/gosocksv5d/config"
+
+const (
+	maxConfigSize       = 4 << 20
+	defaultDestinations = 10
+	defaultWindow       = time.Hour
+)
+
+var (
+	ErrorNotManaged = errors.New("Config not managed")
+	ErrorFile       = errors.New("File not referenced by the running config")
+)
+
+// API serves the admin endpoints.
+type API struct {
+	// Required as "Authorization: Bearer <token>", if not empty.
+	Token string
+
+	// Returns the running server.
+	Server func() gosocksv5d.Server
+
+	// Return the running config, and apply a validated one to new
+	// connections. The config endpoints fail with ErrorNotManaged if nil.
+	Config func() *config.Config
+	Apply  func(cfg *config.Config) error
+
+	// Applies the overrides the running config got, e.g. of environment
+	// variables, to posted configs before validating, diffing and applying
+	// them, if not nil.
+	Prepare func(cfg *config.Config) error
+
+	// Serve the debug endpoints, exposing internals such as stacks and the
+	// command line. Ignored without a Token.
+	Debug bool
+
+	applying sync.Mutex
+}
+
+func (self *API) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	if len(self.Token) != 0 {
+		token, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if subtle.ConstantTimeCompare([]byte(token), []byte(self.Token)) != 1 {
+			w.Header().Set("WWW-Authenticate", "Bearer")
+			http.Error(w, "Unauthorized", http.StatusUnauthorized)
+			return
+		}
+	}
+	if self.Debug && len(self.Token) != 0 && strings.HasPrefix(r.URL.Path, "/debug/") {
+		self.debug(w, r)
+		return
+	}
+	route := r.Method + " " + r.URL.Path
+	switch route {
+	case "GET /stats":
+		writeJSON(w, http.StatusOK, self.Server().Stats())
+
+	case "GET /destinations":
+		self.destinations(w, r)
+
+	case "GET /sessions":
+		writeJSON(w, http.StatusOK, self.Server().Sessions())
+
+	case "GET /config":
+		if self.Config == nil {
+			writeErrors(w, http.StatusNotImplemented, ErrorNotManaged)
+			return
+		}
+		writeJSON(w, http.StatusOK, self.Config().Redacted())
+
+	case "POST /config/diff", "POST /config/apply":
+		self.changeConfig(w, r, route == "POST /config/apply")
+
+	default:
+		http.NotFound(w, r)
+	}
+}
+
+// Runtime metrics, see GET /debug/runtime.
+type Runtime struct {
+	Goroutines int
+	HeapAlloc  uint64 // Bytes of allocated heap objects
+	HeapInuse  uint64 // Bytes of in-use heap spans
+	Sys        uint64 // Bytes obtained from the OS
+	NumGC      uint32
+	PauseTotal time.Duration
+	OpenFiles  int // Open file descriptors, -1 where unknown
+	GOMAXPROCS int
+	CgoCalls   int64
+	GoVersion  string
+}
+
+func (self *API) debug(w http.ResponseWriter, r *http.Request) {
+	switch r.URL.Path {
+	case "/debug/runtime":
+		var mem runtime.MemStats
+		runtime.ReadMemStats(&mem)
+		writeJSON(w, http.StatusOK, Runtime{
+			Goroutines: runtime.NumGoroutine(),
+			HeapAlloc:  mem.HeapAlloc,
+			HeapInuse:  mem.HeapInuse,
+			Sys:        mem.Sys,
+			NumGC:      mem.NumGC,
+			PauseTotal: time.Duration(mem.PauseTotalNs),
+			OpenFiles:  openFiles(),
+			GOMAXPROCS: runtime.GOMAXPROCS(0),
+			CgoCalls:   runtime.NumCgoCall(),
+			GoVersion:  runtime.Version(),
+		})
+	case "/debug/pprof/cmdline":
+		pprof.Cmdline(w, r)
+	case "/debug/pprof/profile":
+		pprof.Profile(w, r)
+	case "/debug/pprof/symbol":
+		pprof.Symbol(w, r)
+	case "/debug/pprof/trace":
+		pprof.Trace(w, r)
+	default:
+		if strings.HasPrefix(r.URL.Path, "/debug/pprof/") {
+			pprof.Index(w, r)
+			return
+		}
+		http.NotFound(w, r)
+	}
+}
+
+// Returns the number of open file descriptors, where /proc tells.
+func openFiles() int {
+	fds, err := os.ReadDir("/proc/self/fd")
+	if err != nil {
+		return -1
+	}
+	return len(fds)
+}
+
+func (self *API) destinations(w http.ResponseWriter, r *http.Request) {
+	n, window := defaultDestinations, defaultWindow
+	var errs []error
+	if s := r.FormValue("n"); len(s) != 0 {
+		var err error
+		if n, err = strconv.Atoi(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if s := r.FormValue("window"); len(s) != 0 {
+		var err error
+		if window, err = time.ParseDuration(s); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(errs) != 0 {
+		writeErrors(w, http.StatusBadRequest, errs...)
+		return
+	}
+	writeJSON(w, http.StatusOK, self.Server().TopDestinations(n, window))
+}
+
+// Diffs the posted config against the running one, applying it if apply.
+func (self *API) changeConfig(w http.ResponseWriter, r *http.Request, apply bool) {
+	if self.Config == nil || (apply && self.Apply == nil) {
+		writeErrors(w, http.StatusNotImplemented, ErrorNotManaged)
+		return
+	}
+	data, err := io.ReadAll(io.LimitReader(r.Body, maxConfigSize))
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, err)
+		return
+	}
+	cfg, err := config.ParseStrict(data)
+	if err == nil {
+		err = checkFiles(self.Config(), cfg)
+	}
+	if err == nil && self.Prepare != nil {
+		err = self.Prepare(cfg)
+	}
+	if err == nil {
+		err = cfg.Validate()
+	}
+	if err != nil {
+		writeErrors(w, http.StatusBadRequest, err)
+		return
+	}
+	if apply {
+		// Diff against what gets replaced
+		self.applying.Lock()
+		defer self.applying.Unlock()
+	}
+	changes, err := config.Diff(self.Config().Redacted(), cfg.Redacted())
+	if err != nil {
+		writeErrors(w, http.StatusInternalServerError, err)
+		return
+	}
+	if changes == nil {
+		changes = []config.Change{}
+	}
+	result := struct {
+		Changes []config.Change `json:"changes"`
+		Applied bool            `json:"applied"`
+	}{changes, false}
+	if apply {
+		if err := self.Apply(cfg); err != nil {
+			writeErrors(w, http.StatusInternalServerError, err)
+			return
+		}
+		result.Applied = true
+	}
+	writeJSON(w, http.StatusOK, result)
+}
+
+// Fails if posted references files the running config does not.
+func checkFiles(running, posted *config.Config) error {
+	allowed := make(map[string]bool)
+	for _, path := range running.Files() {
+		allowed[path] = true
+	}
+	var errs []error
+	for _, path := range posted.Files() {
+		if !allowed[path] {
+			errs = append(errs, fmt.Errorf("%s: %w", path, ErrorFile))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+func writeJSON(w http.ResponseWriter, status int, v interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	enc := json.NewEncoder(w)
+	enc.SetIndent("", "  ")
+	enc.Encode(v)
+}
+
+// Writes errors, including the ones joined by errors.Join, as
+// {"errors": [...]}.
+func writeErrors(w http.ResponseWriter, status int, errs ...error) {
+	var messages []string
+	for _, err := range errs {
+		if joined, ok := err.(interface{ Unwrap() []error }); ok {
+			for _, err := range joined.Unwrap() {
+				messages = append(messages, err.Error())
+			}
+		} else {
+			messages = append(messages, err.Error())
+		}
+	}
+	writeJSON(w, status, map[string][]string{"errors": messages})
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,282 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "bytes"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "io"
+import "math"
+import "net/http"
+import "net/url"
+import "strconv"
+import "sync"
+import "sync/atomic"
+import "time"
+
+const (
+	alertInterval = 10 * time.Second
+	alertQueue    = 64
+	alertTimeout  = 10 * time.Second
+)
+
+// Metrics alerts watch, as reported via Alert.Metric.
+const (
+	AlertConnections = "connections" // Connections open
+	AlertBandwidth   = "bandwidth"   // Bytes relayed per second
+	AlertDenialRate  = "denial_rate" // Policy denials per second
+	AlertBanRate     = "ban_rate"    // Clients banned per second
+)
+
+var (
+	ErrorWebhookURL = errors.New("Invalid webhook URL")
+)
+
+// Alerts watch server metrics against thresholds, notifying the Alerters
+// once a metric crosses its threshold, and again once it recovered, i.e.
+// fell back below it.
+// Zero thresholds are not watched.
+// See: Server.SetAlerts()
+type Alerts struct {
+	Connections int     // Connections open, including those still handshaking
+	Bandwidth   int64   // Bytes per second relayed, both directions combined
+	DenialRate  float64 // Policy denials per second
+	BanRate     float64 // Clients banned per second
+
+	// Between checks, over which rates get averaged. Defaults to 10 seconds.
+	Interval time.Duration
+
+	Alerters []Alerter
+}
+
+// Alert describes a metric crossing its threshold, or recovering.
+type Alert struct {
+	Time      time.Time
+	Metric    string // e.g. AlertConnections
+	Value     float64
+	Threshold float64
+	Recovered bool // Whether Value fell back below Threshold
+}
+
+// Formats v with up to two decimals.
+func formatMetric(v float64) string {
+	return strconv.FormatFloat(math.Round(v*100)/100, 'f', -1, 64)
+}
+
+func (self *Alert) String() string {
+	if self.Recovered {
+		return fmt.Sprintf("%s recovered, %s below %s", self.Metric, formatMetric(self.Value), formatMetric(self.Threshold))
+	}
+	return fmt.Sprintf("%s at %s, crossing %s", self.Metric, formatMetric(self.Value), formatMetric(self.Threshold))
+}
+
+// Alerter gets notified of alerts, e.g. to page an operator.
+// Alerters are called one at a time, and should not block.
+// Alerters implementing io.Closer get closed once the server shuts down.
+type Alerter interface {
+	Alert(alert *Alert)
+}
+
+// Adapter to use ordinary functions as Alerter.
+type AlerterFunc func(alert *Alert)
+
+func (self AlerterFunc) Alert(alert *Alert) {
+	self(alert)
+}
+
+type alertSample struct {
+	relayed uint64
+	denials uint64
+	bans    uint64
+}
+
+type alertWatch struct {
+	*Alerts
+	srv    *server
+	firing map[string]bool
+	last   alertSample
+	once   sync.Once
+}
+
+func newAlertWatch(config *Alerts, srv *server) *alertWatch {
+	return &alertWatch{Alerts: config, srv: srv, firing: make(map[string]bool)}
+}
+
+// Starts watching, once.
+func (self *alertWatch) start() {
+	self.once.Do(func() {
+		go self.watch()
+	})
+}
+
+func (self *alertWatch) sample() alertSample {
+	stats := &self.srv.stats
+	rv := alertSample{
+		relayed: atomic.LoadUint64(&stats.relayed),
+		bans:    atomic.LoadUint64(&stats.bans),
+	}
+	for _, count := range stats.denials.snapshot() {
+		rv.denials += count
+	}
+	return rv
+}
+
+// Checks the metrics every Interval, until the server closes.
+func (self *alertWatch) watch() {
+	interval := self.Interval
+	if interval <= 0 {
+		interval = alertInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	self.last = self.sample()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.srv.closing:
+			return
+		}
+		cur := self.sample()
+		secs := interval.Seconds()
+		self.check(AlertConnections, float64(self.srv.sessions.count()), float64(self.Connections))
+		self.check(AlertBandwidth, float64(cur.relayed-self.last.relayed)/secs, float64(self.Bandwidth))
+		self.check(AlertDenialRate, float64(cur.denials-self.last.denials)/secs, self.DenialRate)
+		self.check(AlertBanRate, float64(cur.bans-self.last.bans)/secs, self.BanRate)
+		self.last = cur
+	}
+}
+
+func (self *alertWatch) check(metric string, value, threshold float64) {
+	if threshold <= 0 {
+		return
+	}
+	firing := value >= threshold
+	if firing == self.firing[metric] {
+		return
+	}
+	self.firing[metric] = firing
+	alert := &Alert{time.Now(), metric, value, threshold, !firing}
+	self.srv.Printf("Alert: %v", alert)
+	for _, alerter := range self.Alerters {
+		alerter.Alert(alert)
+	}
+}
+
+// Closes the Alerters implementing io.Closer.
+func (self *alertWatch) close() {
+	for _, alerter := range self.Alerters {
+		if closer, ok := alerter.(io.Closer); ok {
+			closer.Close()
+		}
+	}
+}
+
+// WebhookAlerter posts alerts as JSON to a URL, e.g. of a chat or paging
+// service:
+//
+//	{"time": "2006-01-02T15:04:05Z", "metric": "connections", "value": 1200,
+//	 "threshold": 1000, "recovered": false, "message": "connections at ..."}
+//
+// Alerts are queued and sent asynchronously, starting with the first alert;
+// alerts not fitting into the queue are dropped, as are alerts after Close().
+type WebhookAlerter struct {
+	url       string
+	client    *http.Client
+	queue     chan []byte
+	dropped   uint64
+	sending   sync.Once
+	closing   chan struct{}
+	closeOnce sync.Once
+}
+
+// Creates a new WebhookAlerter posting to an http(s) URL.
+func NewWebhookAlerter(hook string) (*WebhookAlerter, error) {
+	u, err := url.Parse(hook)
+	if err != nil || (u.Scheme != "http" && u.Scheme != "https") || len(u.Host) == 0 {
+		return nil, ErrorWebhookURL
+	}
+	rv := &WebhookAlerter{
+		url:     hook,
+		client:  &http.Client{Timeout: alertTimeout},
+		queue:   make(chan []byte, alertQueue),
+		closing: make(chan struct{}),
+	}
+	return rv, nil
+}
+
+func (self *WebhookAlerter) Alert(alert *Alert) {
+	body, err := json.Marshal(map[string]interface{}{
+		"time":      alert.Time.UTC().Format(time.RFC3339),
+		"metric":    alert.Metric,
+		"value":     alert.Value,
+		"threshold": alert.Threshold,
+		"recovered": alert.Recovered,
+		"message":   alert.String(),
+	})
+	if err != nil {
+		return
+	}
+	select {
+	case <-self.closing:
+		return
+	default:
+	}
+	self.sending.Do(func() {
+		go self.send()
+	})
+	select {
+	case self.queue <- body:
+	default:
+		atomic.AddUint64(&self.dropped, 1)
+	}
+}
+
+// Returns the number of alerts dropped, due to a full queue.
+func (self *WebhookAlerter) Dropped() uint64 {
+	return atomic.LoadUint64(&self.dropped)
+}
+
+// Stops sending, dropping alerts still queued.
+func (self *WebhookAlerter) Close() error {
+	self.closeOnce.Do(func() {
+		close(self.closing)
+	})
+	return nil
+}
+
+func (self *WebhookAlerter) send() {
+	defer self.client.CloseIdleConnections()
+	for {
+		select {
+		case body := <-self.queue:
+			resp, err := self.client.Post(self.url, "application/json", bytes.NewReader(body))
+			if err == nil {
+				resp.Body.Close()
+			}
+		case <-self.closing:
+			return
+		}
+	}
+}
+
+// vim: set noet ts=2 sw=2:
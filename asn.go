@@ -0,0 +1,322 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "bufio"
+import "encoding/csv"
+import "errors"
+import "io"
+import "net"
+import "net/netip"
+import "os"
+import "sort"
+import "strconv"
+import "strings"
+
+var (
+	ErrorASNDatabase = errors.New("Invalid ASN database")
+	ErrorASN         = errors.New("Invalid ASN")
+)
+
+// Autonomous system, as found in an ASNDatabase.
+type AS struct {
+	Number       uint32
+	Organization string
+}
+
+type asnRange struct {
+	start, end netip.Addr
+	as         *AS
+}
+
+// ASNDatabase maps IPs to the autonomous systems announcing them.
+type ASNDatabase struct {
+	ranges []asnRange // Sorted by start
+}
+
+// Loads an ASNDatabase from a file, see ParseASNDatabase.
+func LoadASNDatabase(path string) (*ASNDatabase, error) {
+	f, err := os.Open(path)
+	if err != nil {
+		return nil, err
+	}
+	defer f.Close()
+	return ParseASNDatabase(f)
+}
+
+// Parses an ASNDatabase, either in the tab separated format of iptoasn.com
+// (ip2asn-combined.tsv), or in the CSV format of MaxMind
+// (GeoLite2-ASN-Blocks-IPv4.csv, -IPv6.csv), as told by the header of the
+// latter. Only a single file is parsed; concatenate IPv4 and IPv6 files
+// without the second header if needed.
+func ParseASNDatabase(r io.Reader) (*ASNDatabase, error) {
+	br := bufio.NewReader(r)
+	header, err := br.Peek(len("network,"))
+	if err != nil && err != io.EOF {
+		return nil, err
+	}
+	rv := &ASNDatabase{}
+	if string(header) == "network," {
+		err = rv.parseMaxMind(br)
+	} else {
+		err = rv.parseIP2ASN(br)
+	}
+	if err != nil {
+		return nil, err
+	}
+	sort.Slice(rv.ranges, func(i, j int) bool {
+		return rv.ranges[i].start.Less(rv.ranges[j].start)
+	})
+	return rv, nil
+}
+
+// Lines of: range_start range_end AS_number country_code AS_description
+func (self *ASNDatabase) parseIP2ASN(r io.Reader) error {
+	systems := make(map[uint32]*AS)
+	scanner := bufio.NewScanner(r)
+	for scanner.Scan() {
+		fields := strings.Split(scanner.Text(), "\t")
+		if len(fields) == 1 && len(fields[0]) == 0 {
+			continue
+		}
+		if len(fields) < 3 {
+			return ErrorASNDatabase
+		}
+		start, err := netip.ParseAddr(fields[0])
+		if err != nil {
+			return ErrorASNDatabase
+		}
+		end, err := netip.ParseAddr(fields[1])
+		if err != nil || start.Is4() != end.Is4() {
+			return ErrorASNDatabase
+		}
+		number, err := strconv.ParseUint(fields[2], 10, 32)
+		if err != nil {
+			return ErrorASNDatabase
+		}
+		if number == 0 {
+			// Not routed
+			continue
+		}
+		as, ok := systems[uint32(number)]
+		if !ok {
+			as = &AS{Number: uint32(number)}
+			if len(fields) > 4 {
+				as.Organization = fields[4]
+			}
+			systems[as.Number] = as
+		}
+		self.ranges = append(self.ranges, asnRange{start.Unmap(), end.Unmap(), as})
+	}
+	return scanner.Err()
+}
+
+// Header, then lines of: network,autonomous_system_number,autonomous_system_organization
+func (self *ASNDatabase) parseMaxMind(r io.Reader) error {
+	systems := make(map[uint32]*AS)
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	if _, err := cr.Read(); err != nil {
+		return err
+	}
+	for {
+		record, err := cr.Read()
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		if len(record) < 2 {
+			return ErrorASNDatabase
+		}
+		prefix, err := netip.ParsePrefix(record[0])
+		if err != nil {
+			return ErrorASNDatabase
+		}
+		number, err := strconv.ParseUint(record[1], 10, 32)
+		if err != nil {
+			return ErrorASNDatabase
+		}
+		as, ok := systems[uint32(number)]
+		if !ok {
+			as = &AS{Number: uint32(number)}
+			if len(record) > 2 {
+				as.Organization = record[2]
+			}
+			systems[as.Number] = as
+		}
+		prefix = prefix.Masked()
+		self.ranges = append(self.ranges, asnRange{prefix.Addr().Unmap(), lastAddr(prefix), as})
+	}
+}
+
+// Returns the last address of prefix.
+func lastAddr(prefix netip.Prefix) netip.Addr {
+	addr := prefix.Addr().Unmap()
+	bytes := addr.AsSlice()
+	bits := prefix.Bits()
+	if prefix.Addr().Is4In6() {
+		bits -= 96
+	}
+	for i := range bytes {
+		switch {
+		case bits >= 8:
+			bits -= 8
+		case bits > 0:
+			bytes[i] |= 0xff >> bits
+			bits = 0
+		default:
+			bytes[i] = 0xff
+		}
+	}
+	rv, _ := netip.AddrFromSlice(bytes)
+	return rv
+}
+
+// Returns the autonomous system announcing ip, if known.
+func (self *ASNDatabase) Lookup(ip net.IP) (*AS, bool) {
+	addr, ok := netip.AddrFromSlice(ip)
+	if !ok {
+		return nil, false
+	}
+	addr = addr.Unmap()
+	i := sort.Search(len(self.ranges), func(i int) bool {
+		return addr.Less(self.ranges[i].start)
+	})
+	if i == 0 {
+		return nil, false
+	}
+	r := self.ranges[i-1]
+	if addr.Is4() != r.start.Is4() || r.end.Less(addr) {
+		return nil, false
+	}
+	return r.as, true
+}
+
+// Parses an ASN, e.g. "AS12345" or "12345".
+func ParseASN(s string) (uint32, error) {
+	if len(s) > 2 && strings.EqualFold(s[:2], "AS") {
+		s = s[2:]
+	}
+	number, err := strconv.ParseUint(s, 10, 32)
+	if err != nil {
+		return 0, ErrorASN
+	}
+	return uint32(number), nil
+}
+
+// ASNRuler implements a Ruler matching destination IPs by the autonomous
+// system announcing them, e.g. to deny AS12345, or to only allow the ASNs of
+// a cloud provider.
+// IPs of autonomous systems without a rule, or not found in the database,
+// are checked by the fallback Ruler, or denied if there is none.
+//
+// Add all rules before passing the ASNRuler to a server.
+type ASNRuler struct {
+	fallback Ruler
+	db       *ASNDatabase
+	rules    map[uint32]*asnRule
+}
+
+type asnRule struct {
+	ruleHits
+	result RulerResult
+}
+
+// Creates a new ASNRuler without any rules.
+// See: gosocksv5d.DefaultRuler
+func NewASNRuler(db *ASNDatabase, fallback Ruler) *ASNRuler {
+	return &ASNRuler{fallback, db, make(map[uint32]*asnRule)}
+}
+
+// Adds a rule for an autonomous system, replacing any existing one.
+// DeferConnection leaves its IPs to the fallback Ruler.
+func (self *ASNRuler) Add(asn uint32, result RulerResult) {
+	self.rules[asn] = &asnRule{result: result}
+}
+
+// Returns the matches of all rules, ordered by ASN, followed by the ones of
+// the fallback Ruler, if a RuleCounter.
+func (self *ASNRuler) Hits() []RuleHits {
+	asns := make([]uint32, 0, len(self.rules))
+	for asn := range self.rules {
+		asns = append(asns, asn)
+	}
+	sort.Slice(asns, func(i, j int) bool {
+		return asns[i] < asns[j]
+	})
+	rv := make([]RuleHits, 0, len(asns))
+	for _, asn := range asns {
+		rule := self.rules[asn]
+		rv = append(rv, rule.snapshot("AS"+strconv.FormatUint(uint64(asn), 10), rule.result))
+	}
+	if rc, ok := self.fallback.(RuleCounter); ok {
+		rv = append(rv, rc.Hits()...)
+	}
+	return rv
+}
+
+// Returns the rule matching requested, if any.
+func (self *ASNRuler) match(requested net.IP) *asnRule {
+	if as, ok := self.db.Lookup(requested); ok {
+		return self.rules[as.Number]
+	}
+	return nil
+}
+
+func (self *ASNRuler) ConnectionAllowed(client *ClientInfo, requested net.IP) RulerResult {
+	if rule := self.match(requested); rule != nil && rule.result != DeferConnection {
+		rule.hit()
+		return rule.result
+	}
+	if self.fallback == nil {
+		return DenyConnection
+	}
+	return self.fallback.ConnectionAllowed(client, requested)
+}
+
+func (self *ASNRuler) DomainAllowed(client *ClientInfo, domain string) RulerResult {
+	if dr, ok := self.fallback.(DomainRuler); ok {
+		return dr.DomainAllowed(client, domain)
+	}
+	return DeferConnection
+}
+
+func (self *ASNRuler) SessionOptions(client *ClientInfo, host string, ips []net.IP, port int) *SessionOptions {
+	if sr, ok := self.fallback.(SessionRuler); ok {
+		return sr.SessionOptions(client, host, ips, port)
+	}
+	return nil
+}
+
+func (self *ASNRuler) DenialReason(client *ClientInfo, domain string, requested net.IP) string {
+	if self.fallback == nil {
+		return ReasonASN
+	}
+	if rule := self.match(requested); rule != nil && rule.result == DenyConnection {
+		return ReasonASN
+	}
+	return denialReason(self.fallback, client, domain, requested)
+}
+
+// vim: set noet ts=2 sw=2:
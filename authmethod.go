@@ -0,0 +1,84 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "fmt"
+import "net"
+
+const (
+	MethodPrivateFirst = 0x80 // First method number reserved for private methods
+	MethodPrivateLast  = 0xfe // Last method number reserved for private methods
+)
+
+var (
+	ErrorAuthMethod = errors.New("Not a private method number")
+)
+
+// AuthMethod implements a private authentication method, for bespoke clients.
+// See: Server.SetAuthMethod()
+type AuthMethod interface {
+	// Performs the subnegotiation of the method, after the server selected it.
+	// Returns the identity the client authenticated as, if any, and the
+	// connection to continue the session on, which may be conn itself, or wrap
+	// it, e.g. for encapsulation.
+	// Returning an error fails the handshake.
+	Authenticate(client *ClientInfo, conn net.Conn) (net.Conn, string, error)
+}
+
+// Function adapter for AuthMethod
+type AuthMethodFunc func(client *ClientInfo, conn net.Conn) (net.Conn, string, error)
+
+func (self AuthMethodFunc) Authenticate(client *ClientInfo, conn net.Conn) (net.Conn, string, error) {
+	return self(client, conn)
+}
+
+// Picks the first registered private method the client offered, if any.
+func (self *server) selectAuthMethod(methods []byte) (byte, AuthMethod) {
+	for _, method := range methods {
+		if auth, ok := self.authMethods[method]; ok {
+			return method, auth
+		}
+	}
+	return 0, nil
+}
+
+// Runs the subnegotiation of a private method, continuing on the connection
+// returned by it.
+func (sock *sockConn) authenticate(auth AuthMethod) {
+	sock.conn.SetDeadline(timeout())
+	conn, identity, err := auth.Authenticate(sock.info, sock.conn)
+	if err != nil {
+		err = &HandshakeError{err}
+		sock.logAccess(EventHandshakeFailed, "", nil, 0, err, "")
+		panic(err)
+	}
+	if conn != nil {
+		sock.conn = conn
+	}
+	if len(identity) != 0 {
+		sock.info.Identity = identity
+		sock.prefix = fmt.Sprintf("[%v -> %v]", sock.conn.LocalAddr(), sock.info)
+	}
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,85 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "hash/fnv"
+
+// How the upstream of SessionOptions.UpstreamPool gets picked per session.
+type Balance int
+
+const (
+	BalanceRoundRobin Balance = iota // Each in turn
+	BalanceClient                    // Sticky per client IP
+	BalanceIdentity                  // Sticky per authenticated identity, or client IP if none
+)
+
+// Returns the key sessions stick to upstreams by, or an empty string if not
+// sticky.
+func (self Balance) key(client *ClientInfo) string {
+	switch self {
+	case BalanceClient:
+		return client.IP.String()
+	case BalanceIdentity:
+		return clientKey(client)
+	}
+	return ""
+}
+
+// Appends an upstream of opts.UpstreamPool to opts.Upstreams, as the hop
+// exiting to the destination. Skips upstreams found down by the health checks,
+// unless all are.
+// Sticky modes use rendezvous hashing, so that clients keep exiting from the
+// same upstream, unless that one goes away, when only its clients move.
+func (sock *sockConn) pickUpstream(opts *SessionOptions) {
+	pool := opts.UpstreamPool
+	if health := sock.srv.health; health != nil {
+		up := make([]Upstream, 0, len(pool))
+		for _, upstream := range pool {
+			// Checked via the chain leading to the pool
+			if health.up(append(opts.Upstreams[:len(opts.Upstreams):len(opts.Upstreams)], upstream)...) {
+				up = append(up, upstream)
+			}
+		}
+		if len(up) != 0 {
+			pool = up
+		}
+	}
+	var picked Upstream
+	if key := opts.Balance.key(sock.info); len(key) != 0 {
+		var best uint64
+		for i, upstream := range pool {
+			h := fnv.New64a()
+			h.Write([]byte(key))
+			h.Write([]byte{0})
+			h.Write([]byte(upstream.Address))
+			if score := h.Sum64(); i == 0 || score > best {
+				picked, best = upstream, score
+			}
+		}
+	} else {
+		picked = pool[sock.srv.poolNext.Add(1)%uint64(len(pool))]
+	}
+	opts.Upstreams = append(opts.Upstreams[:len(opts.Upstreams):len(opts.Upstreams)], picked)
+	opts.Tags = mergeTags(opts.Tags, map[string]string{"upstream": picked.String()})
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,241 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "net"
+import "os/exec"
+import "sync"
+import "sync/atomic"
+import "time"
+
+var (
+	ErrorBanned = errors.New("Client is banned")
+)
+
+// AutoBan configures banning clients for a while, after too many handshake
+// failures or denied requests within a time window.
+// Connections from banned clients get closed right after being accepted.
+type AutoBan struct {
+	Threshold int           // Failures within Window triggering a ban
+	Window    time.Duration // Time window failures are counted in
+	Duration  time.Duration // How long bans last
+	Hook      BanHook       // Notified about bans, if not nil
+}
+
+// BanHook gets notified about bans and their expiry, e.g. to block banned
+// clients at the firewall level. Calls happen asynchronously.
+type BanHook interface {
+	Ban(ip net.IP, duration time.Duration) error
+	Unban(ip net.IP) error
+}
+
+type banEntry struct {
+	since    time.Time
+	failures int
+	until    time.Time
+}
+
+type banList struct {
+	sync.Mutex
+	*AutoBan
+	srv     *server
+	entries map[string]*banEntry
+	swept   time.Time
+}
+
+func newBanList(ban *AutoBan, srv *server) *banList {
+	return &banList{AutoBan: ban, srv: srv, entries: make(map[string]*banEntry), swept: time.Now()}
+}
+
+func (self *banList) banned(ip net.IP) bool {
+	self.Lock()
+	entry, ok := self.entries[ip.String()]
+	banned := ok && time.Now().Before(entry.until)
+	self.Unlock()
+	if banned || self.srv.store == nil {
+		return banned
+	}
+	_, banned, err := self.srv.store.Get("ban:" + ip.String())
+	if err != nil {
+		self.srv.Printf("Failed to check the shared ban of %v: %v", ip, err)
+	}
+	return banned
+}
+
+// Records a failure of a client, banning it if it reached the threshold.
+// Failures and bans are shared via the SharedStore of the server, if any.
+func (self *banList) fail(ip net.IP) {
+	now := time.Now()
+	key := ip.String()
+	shared := false
+	if store := self.srv.store; store != nil {
+		failures, err := store.Incr("failures:"+key, 1, self.Window)
+		if err == nil {
+			if failures < int64(self.Threshold) {
+				return
+			}
+			// Failing on after a ban expired, within the window, bans again
+			var active bool
+			if _, active, err = store.Get("ban:" + key); err == nil && active {
+				return
+			}
+			if err == nil {
+				if err = store.Set("ban:"+key, "1", self.Duration); err == nil {
+					shared = true
+				}
+			}
+		}
+		if err != nil {
+			self.srv.Printf("Failed to share the failure of %v: %v", ip, err)
+		}
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.sweep(now)
+	entry, ok := self.entries[key]
+	if !ok {
+		entry = &banEntry{since: now}
+		self.entries[key] = entry
+	}
+	if !shared {
+		if now.Sub(entry.since) > self.Window {
+			entry.since, entry.failures = now, 0
+		}
+		entry.failures++
+		if entry.failures < self.Threshold || now.Before(entry.until) {
+			return
+		}
+	}
+	entry.failures, entry.until = 0, now.Add(self.Duration)
+	atomic.AddUint64(&self.srv.stats.bans, 1)
+	self.srv.Printf("Banning %v for %v", ip, self.Duration)
+	if self.Hook != nil {
+		go func() {
+			if err := self.Hook.Ban(ip, self.Duration); err != nil {
+				self.srv.Printf("Failed to ban %v: %v", ip, err)
+			}
+		}()
+		time.AfterFunc(self.Duration, func() {
+			if err := self.Hook.Unban(ip); err != nil {
+				self.srv.Printf("Failed to unban %v: %v", ip, err)
+			}
+		})
+	}
+}
+
+// Forgets about expired entries, every once in a while.
+// Must be called with the list locked.
+func (self *banList) sweep(now time.Time) {
+	if now.Sub(self.swept) < self.Window {
+		return
+	}
+	for key, entry := range self.entries {
+		if now.Sub(entry.since) > self.Window && now.After(entry.until) {
+			delete(self.entries, key)
+		}
+	}
+	self.swept = now
+}
+
+type commandHook struct {
+	ban   func(ip net.IP, duration time.Duration) []string
+	unban func(ip net.IP) []string
+}
+
+func (self *commandHook) run(args []string) error {
+	out, err := exec.Command(args[0], args[1:]...).CombinedOutput()
+	if err != nil && len(out) != 0 {
+		return &commandError{err, string(out)}
+	}
+	return err
+}
+
+func (self *commandHook) Ban(ip net.IP, duration time.Duration) error {
+	return self.run(self.ban(ip, duration))
+}
+
+func (self *commandHook) Unban(ip net.IP) error {
+	return self.run(self.unban(ip))
+}
+
+type commandError struct {
+	err    error
+	output string
+}
+
+func (self *commandError) Error() string {
+	return self.err.Error() + ": " + self.output
+}
+
+func (self *commandError) Unwrap() error {
+	return self.err
+}
+
+func pickSet(ip net.IP, set4, set6 string) string {
+	if ip.To4() != nil {
+		return set4
+	}
+	return set6
+}
+
+// Creates a BanHook adding banned IPs to an ipset, using the ipset command.
+// IPv4 and IPv6 addresses go to different sets, as ipset requires.
+//
+// Examples:
+//
+//	ipset create socks-banned hash:ip
+//	ipset create socks-banned6 hash:ip family inet6
+//	iptables -I INPUT -m set --match-set socks-banned src -j DROP
+func NewIPSetHook(set4, set6 string) BanHook {
+	return &commandHook{
+		func(ip net.IP, duration time.Duration) []string {
+			return []string{"ipset", "add", pickSet(ip, set4, set6), ip.String(), "-exist"}
+		},
+		func(ip net.IP) []string {
+			return []string{"ipset", "del", pickSet(ip, set4, set6), ip.String(), "-exist"}
+		},
+	}
+}
+
+// Creates a BanHook adding banned IPs to nftables sets, using the nft command.
+//
+// Examples:
+//
+//	nft add set inet filter socks-banned { type ipv4_addr\; }
+//	nft add set inet filter socks-banned6 { type ipv6_addr\; }
+//	nft add rule inet filter input ip saddr @socks-banned drop
+func NewNftHook(family, table, set4, set6 string) BanHook {
+	element := func(ip net.IP) string {
+		return "{ " + ip.String() + " }"
+	}
+	return &commandHook{
+		func(ip net.IP, duration time.Duration) []string {
+			return []string{"nft", "add", "element", family, table, pickSet(ip, set4, set6), element(ip)}
+		},
+		func(ip net.IP) []string {
+			return []string{"nft", "delete", "element", family, table, pickSet(ip, set4, set6), element(ip)}
+		},
+	}
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,247 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "bufio"
+import "encoding/json"
+import "io"
+import "net"
+import "sort"
+import "strings"
+import "sync"
+import "sync/atomic"
+
+const maxFeedLine = 64 * 1024
+
+// FeedList holds the IPs, networks and domains of a threat feed, e.g. as
+// fetched by a FeedFetcher.
+type FeedList struct {
+	ips      map[string]bool
+	networks []*net.IPNet
+	domains  map[string]bool
+	invalid  int
+}
+
+// Parses a threat feed, one entry per line, ignoring comments starting with
+// "#" or ";". Supported entries:
+//   - IPs and networks in CIDR notation, e.g. "192.0.2.0/24 ; SBL123"
+//   - domains, which also match their subdomains
+//   - hosts file lines, e.g. "0.0.0.0 malware.example.com"
+//   - JSON objects having a "cidr", e.g. of the Spamhaus DROP JSON lists
+//
+// Lines that cannot be parsed are skipped, see Invalid().
+func ParseFeedList(r io.Reader) (*FeedList, error) {
+	rv := &FeedList{ips: make(map[string]bool), domains: make(map[string]bool)}
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, maxFeedLine)
+	for scanner.Scan() {
+		line := scanner.Text()
+		if strings.HasPrefix(line, "{") {
+			var entry struct {
+				CIDR string `json:"cidr"`
+			}
+			if err := json.Unmarshal([]byte(line), &entry); err != nil {
+				rv.invalid++
+			} else if len(entry.CIDR) != 0 {
+				rv.add(entry.CIDR)
+			}
+			continue
+		}
+		if i := strings.IndexAny(line, "#;"); i >= 0 {
+			line = line[:i]
+		}
+		fields := strings.Fields(line)
+		switch {
+		case len(fields) == 0:
+		case len(fields) > 1 && isSinkhole(fields[0]):
+			if fields[1] != "localhost" {
+				rv.add(fields[1])
+			}
+		default:
+			rv.add(fields[0])
+		}
+	}
+	return rv, scanner.Err()
+}
+
+func isSinkhole(addr string) bool {
+	ip := net.ParseIP(addr)
+	return ip != nil && (ip.IsUnspecified() || ip.IsLoopback())
+}
+
+func (self *FeedList) add(entry string) {
+	if ip, network, err := net.ParseCIDR(entry); err == nil {
+		if ones, bits := network.Mask.Size(); ones == bits {
+			self.ips[string(ip.To16())] = true
+		} else {
+			self.networks = append(self.networks, network)
+		}
+	} else if ip := net.ParseIP(entry); ip != nil {
+		self.ips[string(ip.To16())] = true
+	} else if domain, err := NormalizeDomain(entry); err == nil {
+		self.domains[domain] = true
+	} else {
+		self.invalid++
+	}
+}
+
+// Returns the number of entries.
+func (self *FeedList) Len() int {
+	return len(self.ips) + len(self.networks) + len(self.domains)
+}
+
+// Returns the number of lines that could not be parsed.
+func (self *FeedList) Invalid() int {
+	return self.invalid
+}
+
+func (self *FeedList) containsIP(ip net.IP) bool {
+	if self.ips[string(ip.To16())] {
+		return true
+	}
+	for _, network := range self.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Domains match when listed themselves, or when any parent domain is.
+func (self *FeedList) containsDomain(domain string) bool {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	for {
+		if self.domains[domain] {
+			return true
+		}
+		i := strings.IndexByte(domain, '.')
+		if i < 0 {
+			return false
+		}
+		domain = domain[i+1:]
+	}
+}
+
+type blocklists struct {
+	sync.Mutex
+	lists atomic.Pointer[map[string]*FeedList]
+}
+
+// Blocklist implements a Ruler denying requests for IPs and domains listed in
+// any of its threat feeds, leaving all other requests to the fallback Ruler.
+//
+// Feeds may be replaced at any time, atomically, e.g. by a FeedFetcher.
+type Blocklist struct {
+	fallback Ruler
+	shared   *blocklists
+}
+
+// Creates a new Blocklist without any feeds.
+// See: gosocksv5d.DefaultRuler
+func NewBlocklist(fallback Ruler) *Blocklist {
+	rv := &Blocklist{fallback, &blocklists{}}
+	rv.shared.lists.Store(&map[string]*FeedList{})
+	return rv
+}
+
+// Returns a Blocklist sharing the feeds of this one, but using another
+// fallback Ruler, e.g. for a server built from a reloaded config.
+func (self *Blocklist) WithFallback(fallback Ruler) *Blocklist {
+	return &Blocklist{fallback, self.shared}
+}
+
+// Replaces the list of the named feed. A nil list removes the feed.
+func (self *Blocklist) Set(feed string, list *FeedList) {
+	self.shared.Lock()
+	defer self.shared.Unlock()
+	lists := make(map[string]*FeedList)
+	for name, l := range *self.shared.lists.Load() {
+		lists[name] = l
+	}
+	if list == nil {
+		delete(lists, feed)
+	} else {
+		lists[feed] = list
+	}
+	self.shared.lists.Store(&lists)
+}
+
+// Returns the names of the feeds.
+func (self *Blocklist) Feeds() []string {
+	lists := *self.shared.lists.Load()
+	rv := make([]string, 0, len(lists))
+	for name := range lists {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Returns the name of a feed listing requested, or domain if requested is nil.
+func (self *Blocklist) Listed(domain string, requested net.IP) (feed string, ok bool) {
+	for name, list := range *self.shared.lists.Load() {
+		if requested == nil && list.containsDomain(domain) || requested != nil && list.containsIP(requested) {
+			return name, true
+		}
+	}
+	return "", false
+}
+
+func (self *Blocklist) ConnectionAllowed(client *ClientInfo, requested net.IP) RulerResult {
+	if _, ok := self.Listed("", requested); ok {
+		return DenyConnection
+	}
+	return self.fallback.ConnectionAllowed(client, requested)
+}
+
+func (self *Blocklist) DomainAllowed(client *ClientInfo, domain string) RulerResult {
+	if _, ok := self.Listed(domain, nil); ok {
+		return DenyConnection
+	}
+	if dr, ok := self.fallback.(DomainRuler); ok {
+		return dr.DomainAllowed(client, domain)
+	}
+	return DeferConnection
+}
+
+func (self *Blocklist) SessionOptions(client *ClientInfo, host string, ips []net.IP, port int) *SessionOptions {
+	if sr, ok := self.fallback.(SessionRuler); ok {
+		return sr.SessionOptions(client, host, ips, port)
+	}
+	return nil
+}
+
+func (self *Blocklist) Hits() []RuleHits {
+	if rc, ok := self.fallback.(RuleCounter); ok {
+		return rc.Hits()
+	}
+	return nil
+}
+
+func (self *Blocklist) DenialReason(client *ClientInfo, domain string, requested net.IP) string {
+	if _, ok := self.Listed(domain, requested); ok {
+		return ReasonBlocklist
+	}
+	return denialReason(self.fallback, client, domain, requested)
+}
+
+// vim: set noet ts=2 sw=2:
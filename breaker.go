@@ -0,0 +1,144 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "sort"
+import "sync"
+import "sync/atomic"
+import "time"
+
+var ErrorCircuitOpen = errors.New("Destination failing, circuit open")
+
+// CircuitBreaker fails requests to destinations fast, after dialing them
+// failed repeatedly, instead of waiting for the dial to time out each time.
+// Once the Cooldown passed, a single request gets to probe the destination
+// again, closing the circuit on success.
+type CircuitBreaker struct {
+	Threshold int           // Consecutive dial failures opening the circuit
+	Cooldown  time.Duration // Time the circuit stays open
+}
+
+// OpenCircuit is a destination requests currently fail fast for.
+type OpenCircuit struct {
+	Destination string // Requested host, or IP if requested by address
+	Failures    int    // Consecutive dial failures
+	Until       time.Time
+}
+
+// CircuitStats holds the counters and state of the CircuitBreaker of a
+// server.
+type CircuitStats struct {
+	Trips     uint64 // Times a circuit opened
+	FastFails uint64 // Requests failed due to an open circuit
+	Open      []OpenCircuit
+}
+
+type circuit struct {
+	failures int
+	last     time.Time // Last failure
+	until    time.Time // Open until, if failures reached the threshold
+}
+
+type circuits struct {
+	sync.Mutex
+	*CircuitBreaker
+	entries   map[string]*circuit
+	swept     time.Time
+	trips     uint64
+	fastFails uint64
+}
+
+func newCircuits(config *CircuitBreaker) *circuits {
+	return &circuits{CircuitBreaker: config, entries: make(map[string]*circuit), swept: time.Now()}
+}
+
+// Returns whether a request to dest may be dialed. Holds the circuit for
+// the Cooldown when letting a request probe an open circuit.
+func (self *circuits) allow(dest string) bool {
+	now := time.Now()
+	self.Lock()
+	defer self.Unlock()
+	entry, ok := self.entries[dest]
+	if !ok || entry.failures < self.Threshold {
+		return true
+	}
+	if now.Before(entry.until) {
+		atomic.AddUint64(&self.fastFails, 1)
+		return false
+	}
+	entry.until = now.Add(self.Cooldown)
+	return true
+}
+
+// Records the result of dialing dest.
+func (self *circuits) done(dest string, err error) {
+	now := time.Now()
+	self.Lock()
+	defer self.Unlock()
+	if err == nil {
+		delete(self.entries, dest)
+		return
+	}
+	if now.Sub(self.swept) >= self.Cooldown {
+		for k, entry := range self.entries {
+			if now.Sub(entry.last) > self.Cooldown && now.After(entry.until) {
+				delete(self.entries, k)
+			}
+		}
+		self.swept = now
+	}
+	entry, ok := self.entries[dest]
+	if !ok || (entry.failures < self.Threshold && now.Sub(entry.last) > self.Cooldown) {
+		entry = &circuit{}
+		self.entries[dest] = entry
+	}
+	entry.failures++
+	entry.last = now
+	if entry.failures >= self.Threshold {
+		if entry.failures == self.Threshold {
+			atomic.AddUint64(&self.trips, 1)
+		}
+		entry.until = now.Add(self.Cooldown)
+	}
+}
+
+func (self *circuits) snapshot() CircuitStats {
+	now := time.Now()
+	self.Lock()
+	defer self.Unlock()
+	rv := CircuitStats{
+		Trips:     atomic.LoadUint64(&self.trips),
+		FastFails: atomic.LoadUint64(&self.fastFails),
+	}
+	for dest, entry := range self.entries {
+		if entry.failures >= self.Threshold && now.Before(entry.until) {
+			rv.Open = append(rv.Open, OpenCircuit{dest, entry.failures, entry.until})
+		}
+	}
+	sort.Slice(rv.Open, func(i, j int) bool {
+		return rv.Open[i].Destination < rv.Open[j].Destination
+	})
+	return rv
+}
+
+// vim: set noet ts=2 sw=2:
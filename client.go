@@ -27,6 +27,7 @@ import "errors"
 import "fmt"
 import "io"
 import "net"
+import "sync/atomic"
 import "time"
 
 const (
@@ -36,57 +37,83 @@ const (
 
 var (
 	ErrorHandshake  = errors.New("Handshake failed!")
+	ErrorNoAuth     = errors.New("Authentication required!")
 	ErrorCommand    = errors.New("Invalid command!")
 	ErrorAddress    = errors.New("Not addressable!")
 	ErrorNotAllowed = errors.New("Destination not allowed")
 )
 
-const (
-	protoVersion = 0x5
-
-	atypeIPV4   = 0x1
-	atypeIPV6   = 0x4
-	atypeDomain = 0x3
-
-	cmdConnect = 0x1
-	cmdBind    = 0x2
-	cmdAssoc   = 0x3
-
-	repSuccess         = 0x0
-	repFailure         = 0x1
-	repNotAllowed      = 0x2
-	repNetUnreachable  = 0x3
-	repHostUnreachable = 0x4
-	repRefused         = 0x5
-	repTTL             = 0x6
-	repNotSupported    = 0x7
-	repNotAddressable  = 0x8
-)
-
 func timeout() time.Time {
 	return time.Now().Add(timeoutDiff)
 }
 
 type sockConn struct {
-	conn *net.TCPConn
-	DNSResolver
+	transferred uint64 // Bytes read while relaying
+	lastRead    int64  // Time of the last read, if readIdle
+	conn        net.Conn
 	*prefixLogger
-	Ruler
+	srv      *server
+	info     *ClientInfo     // Of client connections only
+	opts     *SessionOptions // Of client connections only
+	idle     time.Duration   // Idle timeout, if any
+	readIdle time.Duration   // Idle timeout of reading, i.e. of this direction, if any
+	maxBytes uint64          // Transfer cap of both directions, if any
+	activity *int64          // Time of last traffic, shared by both directions, once relaying
+	throttle *throttle       // Limits reading, if set
+	fair     *fairClient     // Shares the fair bandwidth of the direction, if set
+	mirror   *Mirror         // Receives a copy of everything read, if set
+	fp       *Fingerprint    // Of client connections only
+	host     string          // Requested domain, if any, of client connections
+	port     int             // Requested port, of client connections
+	ip       net.IP          // Requested IP, if not requested by domain
+	original string          // Requested destination, host:port, if rewritten, of client connections
+	peeked   []byte          // Sent by the client, inspected but not relayed yet
+	release  func()          // Releases the concurrency limit slot, if taken
+	reserved uint64          // Memory reserved from the MemoryBudget, if any
+	id       uint64          // Of connected client connections, see Session
+	since    time.Time       // Connected, likewise
+	probing  bool            // Both peers get probed, see SessionOptions.Liveness
+	engine   RelayEngine     // Relays reading from this side, if not CopyEngine
+	tls      *tlsObserver    // Shared by both sides, if observing TLS
+
+	closeReason atomic.Pointer[string] // Why relaying ended, if known, see closing()
+}
+
+func newSockConn(conn net.Conn, srv *server) *sockConn {
+	plog := &prefixLogger{fmt.Sprintf("[%v -> %v]", conn.LocalAddr(), conn.RemoteAddr()), srv.Logger}
+	return &sockConn{conn: conn, prefixLogger: plog, srv: srv}
 }
 
-func newSockConn(conn *net.TCPConn, resolver DNSResolver, logger Logger, ruler Ruler) *sockConn {
-	plog := &prefixLogger{fmt.Sprintf("[%v -> %v]", conn.LocalAddr(), conn.RemoteAddr()), logger}
-	return &sockConn{conn, resolver, plog, ruler}
+func (sock *sockConn) deadline() time.Time {
+	idle := sock.idle
+	if sock.readIdle > 0 && (idle <= 0 || sock.readIdle < idle) {
+		idle = sock.readIdle
+	}
+	if idle > 0 && idle < timeoutDiff {
+		return time.Now().Add(idle)
+	}
+	return timeout()
 }
 
 func (sock *sockConn) Read(b []byte) (int, error) {
-	sock.conn.SetReadDeadline(timeout())
-	return sock.conn.Read(b)
+	sock.conn.SetReadDeadline(sock.deadline())
+	n, err := sock.conn.Read(b)
+	if n > 0 {
+		sock.touch()
+		if sock.readIdle > 0 {
+			atomic.StoreInt64(&sock.lastRead, time.Now().UnixNano())
+		}
+	}
+	return n, err
 }
 
 func (sock *sockConn) Write(b []byte) (int, error) {
-	sock.conn.SetWriteDeadline(timeout())
-	return sock.conn.Write(b)
+	sock.conn.SetWriteDeadline(sock.deadline())
+	n, err := sock.conn.Write(b)
+	if n > 0 {
+		sock.touch()
+	}
+	return n, err
 }
 
 func (sock *sockConn) String() string {
@@ -112,124 +139,337 @@ func (sock *sockConn) writeAll(bytes []byte) {
 	}
 }
 
-func (sock *sockConn) writeError(rsp byte, err error) {
-	sock.writeAll([]byte{protoVersion, rsp, 0x0, atypeIPV4, 0x0, 0x0, 0x0, 0x0, 0x0, 0x0})
+func (sock *sockConn) writeError(rsp ReplyCode, err error) {
+	sock.writeAll([]byte{Version, byte(rsp), 0x0, byte(AddrIPv4), 0x0, 0x0, 0x0, 0x0, 0x0, 0x0})
 	panic(err)
 }
 
-func (sock *sockConn) copyFrom(dst *sockConn, quit chan int) {
+// Relays from sock to dst, until either fails or sock hits EOF, sending the
+// error ending it, if any, to quit.
+func (sock *sockConn) copyFrom(dst *sockConn, quit chan error) {
+	var rerr error
 	defer func() {
 		if err := recover(); err != nil && err != io.EOF {
 			sock.Printf("Panic while copying streams, %v", err)
+			sock.reportPanic("relay", err)
+			if rerr, _ = err.(error); rerr == nil {
+				rerr = fmt.Errorf("%v", err)
+			}
+			sock.closing(CloseError)
 		}
 		sock.Print("Closed one direction")
-		sock.conn.CloseRead()
-		dst.conn.CloseWrite()
-		quit <- 1
+		if c, ok := sock.conn.(interface{ CloseRead() error }); ok {
+			c.CloseRead()
+		}
+		if c, ok := dst.conn.(interface{ CloseWrite() error }); ok {
+			c.CloseWrite()
+		} else {
+			dst.conn.Close()
+		}
+		quit <- rerr
 	}()
 
-	buf := make([]byte, bufSize)
-	for {
-		nr, err := sock.Read(buf)
-		wbuf := buf
-		for nr > 0 {
-			nw, werr := dst.Write(wbuf[0:nr])
-			nr -= nw
-			wbuf = wbuf[nr:]
-			if werr != nil {
-				if ne, ok := werr.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
-					continue
-				}
-				panic(werr)
-			}
+	dir := sock.direction()
+	engine := sock.engine
+	if engine == nil {
+		engine = CopyEngine
+	}
+	if rerr = engine.Relay(&relayConn{dst, sock, false}, &relayConn{sock, dst, false}, dir); rerr != nil {
+		sock.Printf("Relaying failed, %v", rerr)
+		if isDeadPeer(rerr) {
+			sock.closing(ClosePeerDead)
+		} else {
+			sock.closing(CloseError)
 		}
-		if err != nil {
-			if ne, ok := err.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
-				continue
-			}
-			panic(err)
+	}
+}
+
+func (sock *sockConn) logAccess(event AccessEvent, host string, ip net.IP, port int, err error, reason string) {
+	if sock.srv.bans != nil && (event == EventHandshakeFailed || event == EventDenied) {
+		sock.srv.bans.fail(sock.info.IP)
+	}
+	if sock.opts.LogLevel == LogAlert && (event == EventDenied || event == EventConnected) {
+		dest := host
+		if len(dest) == 0 && ip != nil {
+			dest = ip.String()
+		}
+		sock.Printf("%v %v", event, joinHostPort(dest, port))
+	}
+	if sock.srv.AccessLogger == nil || sock.opts.LogLevel == LogQuiet && event == EventConnected {
+		return
+	}
+	sock.emitAccess(&AccessRecord{
+		Time:        time.Now(),
+		Event:       event,
+		Client:      sock.info,
+		Host:        host,
+		Dest:        ip,
+		Port:        port,
+		Err:         err,
+		Reason:      reason,
+		Original:    sock.original,
+		Fingerprint: sock.fp,
+		Level:       sock.opts.LogLevel,
+		Tag:         sock.opts.LogTag,
+		Tags:        sock.opts.Tags,
+	})
+}
+
+// Logs the end of a session, relayed with rsock since connected.
+func (sock *sockConn) logClosed(rsock *sockConn, connected time.Time) {
+	if sock.srv.AccessLogger == nil || sock.opts.LogLevel == LogQuiet {
+		return
+	}
+	sock.emitAccess(&AccessRecord{
+		Time:        time.Now(),
+		Event:       EventClosed,
+		Client:      sock.info,
+		Host:        sock.host,
+		Dest:        remoteIP(rsock.conn),
+		Port:        sock.port,
+		Original:    sock.original,
+		Fingerprint: sock.fp,
+		Level:       sock.opts.LogLevel,
+		Tag:         sock.opts.LogTag,
+		Tags:        sock.opts.Tags,
+		Reason:      sock.closeReasonWith(rsock),
+		TLS:         sock.tls.snapshot(),
+		Start:       connected,
+		BytesUp:     atomic.LoadUint64(&sock.transferred),
+		BytesDown:   atomic.LoadUint64(&rsock.transferred),
+	})
+}
+
+func (sock *sockConn) emitAccess(record *AccessRecord) {
+	if sock.srv.rdns == nil {
+		sock.srv.LogAccess(record)
+		return
+	}
+	go func() {
+		sock.srv.rdns.enrich(record)
+		sock.srv.LogAccess(record)
+	}()
+}
+
+// Rejects a request, as not allowed by the policy named by reason.
+func (sock *sockConn) deny(host string, ip net.IP, port int, err error, reason string) {
+	sock.srv.stats.denials.add(reason)
+	opts := sock.opts.Merge(&SessionOptions{Tags: sock.info.Tags})
+	if sr, ok := sock.srv.Ruler.(SessionRuler); ok {
+		var ips []net.IP
+		if ip != nil {
+			ips = []net.IP{ip}
 		}
+		if ropts := sr.SessionOptions(sock.info, host, ips, port); ropts != nil {
+			opts = opts.Merge(&SessionOptions{LogLevel: ropts.LogLevel, LogTag: ropts.LogTag, Tags: ropts.Tags})
+		}
+	}
+	sock.opts = &opts
+	sock.applyLogging(&opts)
+	dest := host
+	if len(dest) == 0 {
+		dest = ip.String()
 	}
+	err = &PolicyDeniedError{reason, joinHostPort(dest, port), err}
+	sock.logAccess(EventDenied, host, ip, port, err, reason)
+	if sock.srv.honeypot != nil {
+		sock.capture(host, ip, port, reason)
+		panic(err)
+	}
+	sock.writeError(ReplyNotAllowed, err)
 }
 
 func (sock *sockConn) handshake() {
+	start := time.Now()
 	handshake := sock.readAll(2)
-	if handshake[0] != protoVersion {
-		panic(ErrorHandshake)
+	if handshake[0] != Version {
+		err := &HandshakeError{ErrorHandshake}
+		sock.logAccess(EventHandshakeFailed, "", nil, 0, err, "")
+		panic(err)
 	}
 	methods := sock.readAll(uint32(handshake[1]))
+	sock.fp.greeting(methods, start)
+	method, auth := sock.srv.selectAuthMethod(methods)
 	switch {
-	case bytes.IndexByte(methods, 0x0) >= 0:
+	case auth != nil:
+		sock.writeAll([]byte{Version, method})
+		sock.fp.selected = time.Now()
+		sock.authenticate(auth)
+		if len(sock.info.Identity) == 0 && sock.srv.requiresAuth() {
+			err := &HandshakeError{ErrorNoAuth}
+			sock.logAccess(EventHandshakeFailed, "", nil, 0, err, "")
+			panic(err)
+		}
+		sock.Printf("Method %#x OK", method)
+
+	case bytes.IndexByte(methods, MethodNoAuth) >= 0 && !sock.srv.requiresAuth():
 		// No auth
-		sock.writeAll([]byte{0x5, 0x0})
+		sock.writeAll([]byte{Version, MethodNoAuth})
 		sock.Printf("No auth OK")
+		sock.fp.selected = time.Now()
 
 	default:
-		sock.writeAll([]byte{0x5, 0xff})
-		panic(ErrorHandshake)
-	}
-}
-
-func (sock *sockConn) IP() net.IP {
-	raddr := sock.conn.RemoteAddr()
-	switch addr := raddr.(type) {
-	case *net.IPAddr:
-		return addr.IP
+		err := &HandshakeError{ErrorHandshake}
+		if bytes.IndexByte(methods, MethodNoAuth) >= 0 {
+			err = &HandshakeError{ErrorNoAuth}
+		}
+		sock.logAccess(EventHandshakeFailed, "", nil, 0, err, "")
+		sock.protocolError(err)
+		sock.writeAll([]byte{Version, MethodNoAcceptable})
+		panic(err)
 	}
-	return nil
 }
 
 func (sock *sockConn) connect(lip net.IP) *sockConn {
 	command := sock.readAll(4)
-	if command[0] != protoVersion {
-		panic(ErrorHandshake)
+	if command[0] != Version {
+		panic(&HandshakeError{ErrorHandshake})
 	}
-	switch command[1] {
-	case cmdConnect:
+	sock.fp.Request = time.Since(sock.fp.selected)
+	if command[2] != 0 {
+		sock.fp.quirk(QuirkReservedSet)
+	}
+	switch Command(command[1]) {
+	case CmdConnect:
 		break
 
 	default:
-		sock.writeError(repNotSupported, ErrorCommand)
+		sock.protocolError(ErrorCommand)
+		sock.writeError(ReplyNotSupported, ErrorCommand)
 	}
 
+	var host string
 	var rips []net.IP
-	switch command[3] {
-	case atypeIPV4:
-		rawip := sock.readAll(4)
-		rips = []net.IP{net.IPv4(rawip[0], rawip[1], rawip[2], rawip[3])}
-
-	case atypeIPV6:
-		rips = []net.IP{sock.readAll(net.IPv6len)}
-
-	case atypeDomain:
-		domain := string(sock.readAll(uint32(sock.readAll(1)[0])))
-		var err error
-		rips, err = sock.LookupIP(domain)
+	var err error
+	switch AddrType(command[3]) {
+	case AddrIPv4:
+		rips = []net.IP{NormalizeIP(sock.readAll(net.IPv4len))}
+
+	case AddrIPv6:
+		rips = []net.IP{NormalizeIP(sock.readAll(net.IPv6len))}
+
+	case AddrDomain:
+		host = string(sock.readAll(uint32(sock.readAll(1)[0])))
+		sock.fp.domain(host)
+		host, err = NormalizeDomain(host)
 		if err != nil {
-			sock.writeError(repNotAddressable, err)
+			sock.writeError(ReplyNotAddressable, err)
 		}
 
 	default:
-		sock.writeError(repNotAddressable, ErrorAddress)
+		sock.protocolError(ErrorAddress)
+		sock.writeError(ReplyNotAddressable, ErrorAddress)
 	}
 
 	port := int(binary.BigEndian.Uint16(sock.readAll(2)))
-	rconn, err := func() (rconn *net.TCPConn, err error) {
-		for _, rip := range rips {
-			switch sock.ConnectionAllowed(sock.IP(), rip) {
+	sock.Printf("Fingerprint: %v", sock.fp)
+
+	if sock.srv.Rewriter != nil {
+		from := host
+		if len(from) == 0 {
+			from = rips[0].String()
+		}
+		to, toport := sock.srv.Rewrite(sock.info, from, port)
+		if to != from || toport != port {
+			sock.original = joinHostPort(from, port)
+			sock.Printf("Rewrote %v to %v", sock.original, joinHostPort(to, toport))
+			host, rips, port = to, nil, toport
+			if ip := net.ParseIP(to); ip != nil {
+				host, rips = "", []net.IP{NormalizeIP(ip)}
+			} else if host, err = NormalizeDomain(to); err != nil {
+				sock.writeError(ReplyNotAddressable, err)
+			}
+		}
+	}
+
+	var rip net.IP
+	if len(host) == 0 {
+		rip = rips[0]
+	}
+	if sock.srv.memory != nil {
+		sock.reserveMemory(host, rip, port)
+	}
+	if sock.quotaExceeded() {
+		sock.Printf("Quota of %v exceeded", sock.info)
+		sock.deny(host, rip, port, ErrorQuota, ReasonQuota)
+	}
+	if sock.srv.limits != nil {
+		sock.enforceLimits(host, rip, port)
+	}
+
+	// Checks the resolved IPs; domains allowed explicitly only get checked for
+	// local IPs, as the Ruler might deny any IP not allowed explicitly
+	ipRuler := sock.srv.Ruler
+	if len(host) != 0 {
+		if dr, ok := sock.srv.Ruler.(DomainRuler); ok {
+			switch dr.DomainAllowed(sock.info, host) {
 			case AllowConnection:
-				sock.Printf("Connecting: %v", rip)
+				ipRuler = DefaultRuler
+			case DeferConnection:
+				break
 			default:
-				sock.Printf("Not allowed: %v", rip)
-				sock.writeError(repNotAllowed, ErrorNotAllowed)
+				sock.Printf("Not allowed: %v", host)
+				sock.dryRun(host, nil, port, false)
+				sock.deny(host, nil, port, ErrorNotAllowed, denialReason(sock.srv.Ruler, sock.info, host, nil))
 			}
+		}
+	}
+	// Domains of sessions via upstreams get resolved by the last hop, not
+	// leaking to local DNS, and names resolving behind it only working
+	viaUpstreams := len(host) != 0 && sock.routesUpstream(host, port)
+	if !viaUpstreams {
+		rips = sock.resolve(lip, host, rips, port, ipRuler)
+	}
+
+	opts := sock.opts.Merge(&SessionOptions{Tags: sock.info.Tags})
+	if sr, ok := sock.srv.Ruler.(SessionRuler); ok {
+		opts = opts.Merge(sr.SessionOptions(sock.info, host, rips, port))
+	}
+	if len(opts.UpstreamPool) != 0 {
+		sock.pickUpstream(&opts)
+	}
+	if len(opts.Upstreams) != 0 && sock.srv.health != nil {
+		sock.failover(&opts, host, rips, port)
+	}
+	if len(opts.Upstreams) == 0 && len(rips) == 0 {
+		// Failed over to connecting directly
+		rips = sock.resolve(lip, host, rips, port, ipRuler)
+	}
+	sock.opts = &opts
+	sock.applyLogging(&opts)
+
+	dest := host
+	if len(dest) == 0 {
+		dest = rips[len(rips)-1].String()
+	}
+	circuits := sock.srv.circuits
+	if len(opts.Upstreams) != 0 {
+		circuits = nil
+	}
+	if limits := sock.srv.limits; limits != nil && limits.DestinationRate > 0 {
+		sock.limitDestination(dest, host, port)
+	}
+	if sock.srv.dials != nil {
+		defer sock.acquireDial(dest, host, port)()
+	}
+	if circuits != nil && !circuits.allow(dest) {
+		sock.Printf("Circuit open: %v", dest)
+		err = &DialError{ReplyHostUnreachable, joinHostPort(dest, port), ErrorCircuitOpen}
+		sock.logAccess(EventFailed, host, nil, port, err, "")
+		sock.writeError(ReplyHostUnreachable, err)
+	}
+
+	rconn, err := func() (rconn net.Conn, err error) {
+		if len(opts.Upstreams) != 0 {
+			return sock.dialUpstreams(lip, &opts, host, rips, port)
+		}
+		for _, rip := range rips {
+			sock.Printf("Connecting: %v", rip)
 			proto := "tcp"
 			if rip.To4() == nil {
 				proto = "tcp6"
 			}
-			laddr := &net.TCPAddr{lip, 0}
-			raddr := &net.TCPAddr{rip, port}
-			rconn, err = net.DialTCP(proto, laddr, raddr)
+			rconn, err = sock.dial(lip, &opts, proto, joinHostPort(rip.String(), port))
 			if err == nil {
 				return
 			}
@@ -237,22 +477,33 @@ func (sock *sockConn) connect(lip net.IP) *sockConn {
 		return
 	}()
 
+	if err == nil && len(host) != 0 && sock.srv.pins != nil && len(opts.Upstreams) == 0 {
+		sock.srv.pins.pin(sock.info.IP, host, remoteIP(rconn))
+	}
+
+	if circuits != nil {
+		circuits.done(dest, err)
+	}
 	if err != nil {
-		switch err.(type) {
-		case net.InvalidAddrError:
-			sock.writeError(repNotAddressable, err)
-		default:
-			sock.writeError(repFailure, err)
-		}
+		code := ReplyCodeFromError(err)
+		err = &DialError{code, joinHostPort(dest, port), err}
+		sock.logAccess(EventFailed, host, nil, port, err, "")
+		sock.writeError(code, err)
+	}
+	rsock := newSockConn(rconn, sock.srv)
+	rsock.applyLogging(&opts)
+	sock.host, sock.port = host, port
+	if len(host) == 0 {
+		sock.ip = rips[0]
 	}
-	rsock := newSockConn(rconn, sock, sock.prefixLogger.Logger, sock)
+	sock.logAccess(EventConnected, host, remoteIP(rconn), port, nil, "")
 
-	sock.writeAll([]byte{protoVersion, repSuccess, 0x0})
+	sock.writeAll([]byte{Version, byte(ReplySuccess), 0x0})
 	if lip.To4() != nil {
-		sock.writeAll([]byte{atypeIPV4})
+		sock.writeAll([]byte{byte(AddrIPv4)})
 		sock.writeAll(lip.To4())
 	} else {
-		sock.writeAll([]byte{atypeIPV6})
+		sock.writeAll([]byte{byte(AddrIPv6)})
 		sock.writeAll(lip.To16())
 	}
 	bport := []byte{0x0, 0x0}
@@ -262,30 +513,150 @@ func (sock *sockConn) connect(lip net.IP) *sockConn {
 	return rsock
 }
 
-func (sock *sockConn) handle(lip net.IP) {
+// Returns whether requests for host route via upstreams, as far as known
+// before resolving it.
+func (sock *sockConn) routesUpstream(host string, port int) bool {
+	opts := *sock.opts
+	if sr, ok := sock.srv.Ruler.(SessionRuler); ok {
+		opts = opts.Merge(sr.SessionOptions(sock.info, host, nil, port))
+	}
+	return len(opts.Upstreams) != 0 || len(opts.UpstreamPool) != 0
+}
+
+// Resolves host, if given, and checks the IPs against ipRuler, returning the
+// ones allowed, or fails the request if none is.
+func (sock *sockConn) resolve(lip net.IP, host string, rips []net.IP, port int, ipRuler Ruler) []net.IP {
+	if len(host) != 0 {
+		var err error
+		rips, err = sock.srv.lookup(sock.info, host)
+		if err != nil {
+			sock.writeError(ReplyNotAddressable, &DialError{ReplyNotAddressable, joinHostPort(host, port), err})
+		}
+		if sock.srv.rebind != nil {
+			if ip := sock.srv.rebind.check(host, rips); ip != nil {
+				sock.Printf("Not allowed: %v resolved to %v", host, ip)
+				sock.deny(host, ip, port, ErrorRebinding, ReasonRebinding)
+			}
+		}
+		if sock.srv.addressOrder == OrderRFC6724 {
+			sortRFC6724(rips, lip)
+		}
+		if sock.srv.pins != nil {
+			sock.srv.pins.apply(sock.info.IP, host, rips)
+		}
+	}
+
+	if len(rips) == 0 {
+		sock.writeError(ReplyHostUnreachable, ErrorAddress)
+	}
+	allowed := make([]net.IP, 0, len(rips))
+	var denied net.IP
+	for _, rip := range rips {
+		switch ipRuler.ConnectionAllowed(sock.info, rip) {
+		case AllowConnection:
+			allowed = append(allowed, rip)
+		default:
+			sock.Printf("Not allowed: %v", rip)
+			if denied == nil {
+				denied = rip
+			}
+		}
+	}
+	if len(allowed) == 0 || (sock.srv.rulerMode == RulerDenyAny && len(allowed) != len(rips)) {
+		sock.dryRun(host, rips, port, false)
+		sock.deny(host, denied, port, ErrorNotAllowed, denialReason(ipRuler, sock.info, host, denied))
+	}
+	sock.dryRun(host, rips, port, true)
+	return allowed
+}
+
+// Serves a client connection, returning the error ending it, if any.
+func (sock *sockConn) handle(l *listener) (err error) {
+	start := time.Now()
+	lip := l.ip
+	opts := sock.srv.sessionDefaults.Merge(&l.opts)
+	sock.opts = &opts
+	negotiating := true
 	defer func() {
+		sock.srv.sessions.remove(sock)
+		if sock.release != nil {
+			sock.release()
+		}
+		if sock.reserved != 0 {
+			sock.srv.memory.release(sock.reserved)
+		}
+		if negotiating {
+			sock.srv.releaseHandshake()
+		}
 		sock.conn.Close()
-		if err := recover(); err != nil {
-			sock.Printf("Panic while serving, %v", err)
+		if r := recover(); r != nil {
+			sock.Printf("Panic while serving, %v", r)
+			sock.reportPanic("session", r)
+			if err, _ = r.(error); err == nil {
+				err = fmt.Errorf("%v", r)
+			}
 			return
 		}
 		sock.Print("Done serving")
 	}()
-	sock.conn.SetNoDelay(true)
+	sock.configureClient()
+
+	sock.info = newClientInfo(sock.conn)
+	if sock.srv.isTrustedProxy(sock.info.IP) {
+		if client := sock.readProxyHeader(); client != nil {
+			sock.info.IP, sock.info.Port = NormalizeIP(client.IP), client.Port
+			sock.info.Proxy = sock.conn.RemoteAddr()
+			sock.prefix = fmt.Sprintf("[%v -> %v]", sock.conn.LocalAddr(), sock.info)
+		}
+	}
+	if sock.srv.bans != nil && sock.srv.bans.banned(sock.info.IP) {
+		atomic.AddUint64(&sock.srv.stats.banned, 1)
+		sock.srv.stats.denials.add(ReasonBanned)
+		panic(&PolicyDeniedError{Reason: ReasonBanned, Err: ErrorBanned})
+	}
 
+	sock.fp = &Fingerprint{}
 	sock.handshake()
 	sock.Print("Handshake OK")
 
 	rsock := sock.connect(lip)
 	defer rsock.conn.Close()
+	sock.srv.sessions.connected(sock, rsock)
+	defer sock.applyOptions(rsock)()
 	rsock.Print("Connected")
+	negotiating = false
+	sock.srv.releaseHandshake()
+	connected := time.Now()
+	sock.srv.stats.handshakeLatency.observe(connected.Sub(start).Seconds())
+
+	if sock.srv.protocols != nil {
+		sock.enforceProtocol()
+	}
+	if sock.srv.sniffPorts[sock.port] {
+		sock.sniffHTTP()
+	}
+	sock.forwardPeeked(rsock)
 
-	quit := make(chan int)
+	quit := make(chan error)
 	go sock.copyFrom(rsock, quit)
 	go rsock.copyFrom(sock, quit)
-	for i := 0; i < 2; i++ {
-		<-quit
+	sock.awaitRelay(rsock, quit)
+	sock.Printf("Relaying ended, %s", sock.closeReasonWith(rsock))
+	if info := sock.tls.snapshot(); info != nil {
+		sock.Printf("TLS %v", info)
 	}
+	sock.srv.stats.sessionDuration.observe(time.Since(connected).Seconds())
+	sock.srv.stats.bytesUp.observe(float64(atomic.LoadUint64(&sock.transferred)))
+	sock.srv.stats.bytesDown.observe(float64(atomic.LoadUint64(&rsock.transferred)))
+	sock.srv.stats.traffic.add(sock.destination(), atomic.LoadUint64(&sock.transferred), atomic.LoadUint64(&rsock.transferred))
+	if sock.srv.tagged != nil {
+		sock.srv.tagged.add(sock.opts.Tags, atomic.LoadUint64(&sock.transferred), atomic.LoadUint64(&rsock.transferred))
+	}
+	if sock.srv.quota != nil {
+		sock.srv.useQuota(sock.info, atomic.LoadUint64(&sock.transferred)+atomic.LoadUint64(&rsock.transferred))
+	}
+	sock.logClosed(rsock, connected)
+	return nil
 }
 
 // vim: set noet ts=2 sw=2:
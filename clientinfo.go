@@ -0,0 +1,74 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "fmt"
+import "net"
+
+// ClientInfo describes the client of a connection, as passed to Rulers, hooks
+// and loggers.
+type ClientInfo struct {
+	IP        net.IP
+	Port      int
+	Listener  net.Addr // Local address the client connected to
+	Transport string   // Network of the client connection, e.g. "tcp" or "mptcp"
+	Proxy     net.Addr // Trusted proxy the client connected through, if any
+	Identity  string   // Identity the client authenticated as, if any
+
+	// Key/value metadata of the connection, e.g. a customer ID, as set by an
+	// AuthMethod or hooks, before Rulers add theirs, see SessionOptions.Tags.
+	Tags map[string]string
+}
+
+func newClientInfo(conn net.Conn) *ClientInfo {
+	info := &ClientInfo{Listener: conn.LocalAddr(), Transport: conn.RemoteAddr().Network()}
+	if tc, ok := conn.(*net.TCPConn); ok {
+		if mptcp, err := tc.MultipathTCP(); err == nil && mptcp {
+			info.Transport = "mptcp"
+		}
+	}
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		info.IP, info.Port = NormalizeIP(addr.IP), addr.Port
+	case *net.IPAddr:
+		info.IP = NormalizeIP(addr.IP)
+	}
+	return info
+}
+
+// Returns the client address, i.e. ip:port.
+func (self *ClientInfo) Addr() string {
+	return joinHostPort(self.IP.String(), self.Port)
+}
+
+func (self *ClientInfo) String() string {
+	rv := self.Addr()
+	if len(self.Identity) != 0 {
+		rv = self.Identity + "@" + rv
+	}
+	if self.Proxy != nil {
+		rv = fmt.Sprintf("%s via %v", rv, self.Proxy)
+	}
+	return rv
+}
+
+// vim: set noet ts=2 sw=2:
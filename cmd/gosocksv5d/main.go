@@ -0,0 +1,406 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Command gosocksv5d runs a SOCKS v5 server, configured by a JSON config file
+// (see package github.com/nmaier/gosocksv5d/config), environment variables
+// and flags.
+//
+// Precedence, from highest to lowest: flags, environment variables
+// (GOSOCKS_CONFIG for the config file, see config.EnvKeys for the others),
+// config file, built-in defaults.
+//
+// -audit-db records completed sessions in a database, given as driver:dsn,
+// e.g. sqlite:/var/lib/gosocksv5d/audit.db. Build with -tags sqlite to bundle
+// a SQLite driver; other drivers need to be linked in the same way.
+//
+// -pac serves a proxy auto-config file advertising the server, sending
+// requests the rules deny, and local networks, direct.
+//
+// -dns answers DNS queries, via UDP and TCP, resolving names as for requests,
+// e.g. for LAN clients to resolve names consistently with the rules.
+//
+// Threat feeds of the config deny the destinations they list. The lists are
+// kept across reloads, for feeds still configured.
+//
+// -admin serves the HTTP API of package github.com/nmaier/gosocksv5d/admin,
+// requiring the bearer token given by GOSOCKS_ADMIN_TOKEN. Without a token,
+// -admin must listen on loopback addresses only. Posted configs get the same
+// environment variables and flags applied as the config file. Configs applied
+// via the API replace the config file until the next SIGHUP.
+// -admin-debug adds the pprof and runtime metrics endpoints, and requires
+// the token.
+//
+// -redis shares bans, quota usage and limits with the other instances using
+// the same Redis server, e.g. behind a load balancer.
+//
+// "gosocksv5d top" shows the sessions, throughput and top destinations of a
+// server running with -admin, polling the API given by -admin.
+//
+// -check-config checks the config, including the files it references, and
+// the flags, reporting all problems found, and exits.
+//
+// SIGHUP reloads the config file, serving new connections with the new
+// config. SIGINT and SIGTERM shut down, waiting for connections to finish
+// for up to -drain.
+package main
+
+import "context"
+import "database/sql"
+import "errors"
+import "flag"
+import "fmt"
+import "net"
+import "net/http"
+import "os"
+import "slices"
+import "strings"
+import "sync/atomic"
+import "time"
+import "github.com/nmaier/gosocksv5d"
+import "github.com/nmaier/gosocksv5d/admin"
+import "github.com/nmaier/gosocksv5d/config"
+
+const (
+	defaultListen = "0.0.0.0:1080"
+	applyTimeout  = 30 * time.Second
+)
+
+var (
+	errorAdminToken = errors.New("-admin: set " + config.EnvPrefix + "ADMIN_TOKEN, or listen on loopback only")
+	errorDebugToken = errors.New("-admin-debug: requires " + config.EnvPrefix + "ADMIN_TOKEN")
+)
+
+// Server and config serving new connections, along with the state switched
+// to once the server listens.
+type running struct {
+	srv   gosocksv5d.Server
+	cfg   *config.Config
+	feeds []gosocksv5d.Feed
+	pac   *gosocksv5d.PAC // If serving one
+}
+
+func main() {
+	if len(os.Args) > 1 && os.Args[1] == "top" {
+		if err := top(os.Args[2:]); err != nil {
+			fail(err)
+		}
+		return
+	}
+	configPath := flag.String("config", os.Getenv(config.EnvPrefix+"CONFIG"), "JSON config file")
+	listen := flag.String("listen", "", "Comma separated addresses to listen on, overriding the config (default "+defaultListen+")")
+	rulesFile := flag.String("rules-file", "", "JSON rules file, overriding the config")
+	dryRunRules := flag.String("dry-run-rules", "", "JSON rules file of a candidate policy, logging requests it would decide differently")
+	drain := flag.Duration("drain", 30*time.Second, "Time to wait for connections to finish when shutting down")
+	auditDB := flag.String("audit-db", "", "Database to record completed sessions in, as driver:dsn")
+	pacListen := flag.String("pac", "", "Address to serve a proxy auto-config file on, e.g. :8080")
+	pacProxy := flag.String("pac-proxy", "", "Server address the PAC file advertises (default: the host it got requested from)")
+	adminDebug := flag.Bool("admin-debug", false, "Serve pprof and runtime metrics on the admin API")
+	dnsListen := flag.String("dns", "", "Address to answer DNS queries on, via UDP and TCP, e.g. :53")
+	adminListen := flag.String("admin", "", "Address to serve the admin API on, e.g. 127.0.0.1:9090")
+	redisURL := flag.String("redis", os.Getenv(config.EnvPrefix+"REDIS"), "Redis URL to share state with other instances, e.g. redis://:password@host:6379/0")
+	checkConfig := flag.Bool("check-config", false, "Check the config, reporting all problems found, and exit")
+	flag.Parse()
+	adminToken := os.Getenv(config.EnvPrefix + "ADMIN_TOKEN")
+
+	// Being applied via the admin API, overrides applied already
+	var posted atomic.Pointer[config.Config]
+
+	// Applies the flags overriding the config, and defaults
+	flags := map[string]string{"LISTEN": *listen, "RULES_FILE": *rulesFile, "DRY_RUN_RULES_FILE": *dryRunRules}
+	override := func(cfg *config.Config) error {
+		if err := cfg.ApplyEnv(func(key string) (string, bool) {
+			value := flags[strings.TrimPrefix(key, config.EnvPrefix)]
+			return value, len(value) != 0
+		}); err != nil {
+			return err
+		}
+		if len(cfg.Listeners) == 0 {
+			cfg.Listeners = []config.Listener{{Listen: defaultListen}}
+		}
+		return nil
+	}
+	load := func() (*config.Config, error) {
+		if cfg := posted.Load(); cfg != nil {
+			return cfg, nil
+		}
+		cfg, err := config.LoadEnv(*configPath)
+		if err != nil {
+			return nil, err
+		}
+		if err := override(cfg); err != nil {
+			return nil, err
+		}
+		return cfg, nil
+	}
+
+	if *checkConfig {
+		if err := check(*configPath, load, *auditDB, *pacListen, *dnsListen, *redisURL, *adminListen, adminToken, *adminDebug); err != nil {
+			fail(err)
+		}
+		fmt.Println("Config OK")
+		return
+	}
+
+	var audit *gosocksv5d.SQLAuditLogger
+	if len(*auditDB) != 0 {
+		var err error
+		if audit, err = openAudit(*auditDB); err != nil {
+			fail(err)
+		}
+		defer audit.Close()
+	}
+
+	var store gosocksv5d.SharedStore
+	if len(*redisURL) != 0 {
+		redis, err := gosocksv5d.ParseRedisURL(*redisURL)
+		if err != nil {
+			fail(err)
+		}
+		store = gosocksv5d.NewRedisStore(redis)
+	}
+
+	// Replaced on reloads, once the new server listens
+	var pac atomic.Pointer[gosocksv5d.PAC]
+	var current atomic.Pointer[running]
+	stopFeeds := func() {}
+
+	// Built, but not listening yet; only touched by build() and the reloader,
+	// running one at a time
+	var pending *running
+
+	// Shared by all servers, so that lists survive reloads
+	blocklist := gosocksv5d.NewBlocklist(gosocksv5d.DefaultRuler)
+
+	switchTo := func(next *running) {
+		stopFeeds()
+		stopFeeds = startFeeds(blocklist, next.feeds)
+		if next.pac != nil {
+			pac.Store(next.pac)
+		}
+		current.Store(next)
+	}
+	reloader := gosocksv5d.NewReloader()
+	reloader.OnReload = func(srv gosocksv5d.Server, err error) {
+		if err == nil && pending != nil && pending.srv == srv {
+			switchTo(pending)
+		}
+		pending = nil
+	}
+
+	build := func() (gosocksv5d.Server, []gosocksv5d.Endpoint, error) {
+		cfg, err := load()
+		if err != nil {
+			return nil, nil, err
+		}
+		srv, endpoints, err := cfg.Build()
+		if err != nil {
+			return nil, nil, err
+		}
+		if audit != nil {
+			srv.SetAccessLogger(audit)
+		}
+		if store != nil {
+			srv.SetSharedStore(store)
+		}
+		feeds := cfg.ThreatFeeds()
+		if len(feeds) != 0 {
+			var ruler gosocksv5d.Ruler = gosocksv5d.DefaultRuler
+			if rules := cfg.RuleSet(); rules != nil {
+				ruler = rules
+			}
+			srv.SetRuler(blocklist.WithFallback(ruler))
+		}
+		next := &running{srv: srv, cfg: cfg, feeds: feeds}
+		if len(*pacListen) != 0 {
+			rules := cfg.RuleSet()
+			if rules == nil {
+				rules = gosocksv5d.NewRuleSet(gosocksv5d.DefaultRuler)
+			}
+			next.pac = &gosocksv5d.PAC{Proxy: *pacProxy, Port: endpoints[0].Port}
+			next.pac.AddDenied(rules)
+		}
+		pending = next
+		return srv, endpoints, nil
+	}
+
+	srv, endpoints, err := build()
+	if err != nil {
+		fail(err)
+	}
+	switchTo(pending)
+	pending = nil
+	if len(*pacListen) != 0 {
+		go func() {
+			fail(http.ListenAndServe(*pacListen, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+				pac.Load().ServeHTTP(w, r)
+			})))
+		}()
+	}
+	if len(*dnsListen) != 0 {
+		dns := &gosocksv5d.DNSForwarder{
+			Server: func() gosocksv5d.Server { return current.Load().srv },
+			Logger: gosocksv5d.DefaultLogger,
+		}
+		go func() {
+			fail(dns.ListenAndServe(context.Background(), *dnsListen))
+		}()
+	}
+	if len(*adminListen) != 0 {
+		if err := checkAdmin(*adminListen, adminToken, *adminDebug); err != nil {
+			fail(err)
+		}
+		api := &admin.API{
+			Token:  adminToken,
+			Server: func() gosocksv5d.Server { return current.Load().srv },
+			Config: func() *config.Config { return current.Load().cfg },
+			Debug:  *adminDebug,
+			Prepare: func(cfg *config.Config) error {
+				if err := cfg.ApplyEnv(os.LookupEnv); err != nil {
+					return err
+				}
+				return override(cfg)
+			},
+			Apply: func(cfg *config.Config) error {
+				posted.Store(cfg)
+				defer posted.Store(nil)
+				ctx, cancel := context.WithTimeout(context.Background(), applyTimeout)
+				defer cancel()
+				return reloader.Reload(ctx)
+			},
+		}
+		go func() {
+			fail(http.ListenAndServe(*adminListen, api))
+		}()
+	}
+	if err := gosocksv5d.RunWithReloader(srv, endpoints, *drain, build, reloader); err != nil {
+		if audit != nil {
+			audit.Close()
+		}
+		fail(err)
+	}
+}
+
+// Fetches feeds into blocklist, dropping the lists of any other feeds, until
+// the returned func gets called.
+func startFeeds(blocklist *gosocksv5d.Blocklist, feeds []gosocksv5d.Feed) func() {
+	names := make(map[string]bool)
+	for _, feed := range feeds {
+		names[feed.Name] = true
+	}
+	for _, name := range blocklist.Feeds() {
+		if !names[name] {
+			blocklist.Set(name, nil)
+		}
+	}
+	ctx, cancel := context.WithCancel(context.Background())
+	fetcher := gosocksv5d.NewFeedFetcher(blocklist, feeds...)
+	fetcher.Logger = gosocksv5d.DefaultLogger
+	go fetcher.Run(ctx)
+	return cancel
+}
+
+// Checks the config as loaded, its file strictly, and the flags not covered
+// by the config, returning all problems found.
+func check(path string, load func() (*config.Config, error), auditDB, pacListen, dnsListen, redisURL, adminListen, adminToken string, adminDebug bool) error {
+	var errs []error
+	cfg, err := load()
+	if err != nil {
+		errs = append(errs, err)
+	} else {
+		if len(path) != 0 {
+			if _, err := config.LoadStrict(path); err != nil {
+				errs = append(errs, fmt.Errorf("%s: %v", path, err))
+			}
+		}
+		if err := cfg.Validate(); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	if len(auditDB) != 0 {
+		driver, _, ok := strings.Cut(auditDB, ":")
+		if !ok || !slices.Contains(sql.Drivers(), driver) {
+			errs = append(errs, fmt.Errorf("-audit-db: unknown driver %q, available: %v", driver, sql.Drivers()))
+		}
+	}
+	if len(redisURL) != 0 {
+		if _, err := gosocksv5d.ParseRedisURL(redisURL); err != nil {
+			errs = append(errs, fmt.Errorf("-redis: %v", err))
+		}
+	}
+	if len(pacListen) != 0 {
+		if _, err := net.ResolveTCPAddr("tcp", pacListen); err != nil {
+			errs = append(errs, fmt.Errorf("-pac: %v", err))
+		}
+	}
+	if len(dnsListen) != 0 {
+		if _, err := net.ResolveUDPAddr("udp", dnsListen); err != nil {
+			errs = append(errs, fmt.Errorf("-dns: %v", err))
+		}
+	}
+	if len(adminListen) != 0 {
+		if err := checkAdmin(adminListen, adminToken, adminDebug); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Checks the admin API may be served on listen: anyone reaching it could
+// replace the config, so without a token on loopback addresses only, and
+// never with the debug endpoints.
+func checkAdmin(listen, token string, debug bool) error {
+	if len(token) != 0 {
+		return nil
+	}
+	if debug {
+		return errorDebugToken
+	}
+	host, _, err := net.SplitHostPort(listen)
+	if err != nil {
+		return fmt.Errorf("-admin: %v", err)
+	}
+	if host == "localhost" {
+		return nil
+	}
+	if ip := net.ParseIP(host); ip != nil && ip.IsLoopback() {
+		return nil
+	}
+	return errorAdminToken
+}
+
+func openAudit(spec string) (*gosocksv5d.SQLAuditLogger, error) {
+	driver, dsn, ok := strings.Cut(spec, ":")
+	if !ok {
+		return nil, fmt.Errorf("invalid -audit-db %q, expected driver:dsn", spec)
+	}
+	db, err := sql.Open(driver, dsn)
+	if err != nil {
+		return nil, err
+	}
+	return gosocksv5d.NewSQLAuditLogger(db, gosocksv5d.SQLAudit{Numbered: driver == "postgres" || driver == "pgx"})
+}
+
+func fail(err error) {
+	fmt.Fprintln(os.Stderr, err)
+	os.Exit(1)
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,254 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package main
+
+import "bufio"
+import "encoding/json"
+import "flag"
+import "fmt"
+import "net/http"
+import "os"
+import "os/exec"
+import "sort"
+import "strings"
+import "time"
+import "github.com/nmaier/gosocksv5d"
+import "github.com/nmaier/gosocksv5d/config"
+
+const (
+	topTimeout      = 5 * time.Second
+	topDestinations = 5
+	topWindow       = 5 * time.Minute
+)
+
+// Sort orders of the session view, by key to press.
+var topOrders = map[byte]string{
+	'b': "bytes",
+	'r': "rate",
+	'a': "age",
+	'c': "client",
+	'd': "destination",
+}
+
+// A session, as last seen by top.
+type topSession struct {
+	gosocksv5d.Session
+	Rate float64 // Bytes per second since the previous poll
+}
+
+// Runs "gosocksv5d top", showing the sessions, throughput and top destinations
+// of a running server, as polled from its admin API, until q gets pressed.
+func top(args []string) error {
+	flags := flag.NewFlagSet("top", flag.ExitOnError)
+	api := flags.String("admin", "http://127.0.0.1:9090", "Admin API URL of the server, see -admin")
+	interval := flags.Duration("interval", 2*time.Second, "Time between updates")
+	order := flags.String("sort", "bytes", "Session order: bytes, rate, age, client or destination")
+	rows := flags.Int("n", 20, "Sessions to show")
+	flags.Parse(args)
+
+	client := &topClient{
+		base:  strings.TrimSuffix(*api, "/"),
+		token: os.Getenv(config.EnvPrefix + "ADMIN_TOKEN"),
+		http:  &http.Client{Timeout: topTimeout},
+	}
+	if restore := cbreak(); restore != nil {
+		defer restore()
+	}
+	keys := make(chan byte)
+	go func() {
+		r := bufio.NewReader(os.Stdin)
+		for {
+			b, err := r.ReadByte()
+			if err != nil {
+				close(keys)
+				return
+			}
+			keys <- b
+		}
+	}()
+
+	ticker := time.NewTicker(*interval)
+	defer ticker.Stop()
+	previous := make(map[uint64]uint64)
+	var polled time.Time
+	var sessions []topSession
+	var status string
+	refresh := func() {
+		var current []gosocksv5d.Session
+		if err := client.get("/sessions", &current); err != nil {
+			status = err.Error()
+			return
+		}
+		now := time.Now()
+		elapsed := now.Sub(polled).Seconds()
+		bytes := make(map[uint64]uint64, len(current))
+		sessions = sessions[:0]
+		for _, session := range current {
+			total := session.BytesUp + session.BytesDown
+			bytes[session.ID] = total
+			rate := 0.0
+			if last, ok := previous[session.ID]; ok && elapsed > 0 {
+				rate = float64(total-last) / elapsed
+			}
+			sessions = append(sessions, topSession{session, rate})
+		}
+		previous, polled, status = bytes, now, ""
+	}
+	refresh()
+	for {
+		var stats gosocksv5d.Stats
+		var dests []gosocksv5d.DestinationTraffic
+		if err := client.get("/stats", &stats); err != nil {
+			status = err.Error()
+		}
+		client.get(fmt.Sprintf("/destinations?n=%d&window=%v", topDestinations, topWindow), &dests)
+		sortSessions(sessions, *order)
+		render(os.Stdout, *api, *order, sessions, *rows, &stats, dests, status)
+
+		select {
+		case <-ticker.C:
+			refresh()
+		case key, ok := <-keys:
+			if !ok || key == 'q' {
+				return nil
+			}
+			if name, ok := topOrders[key]; ok {
+				*order = name
+			}
+		}
+	}
+}
+
+type topClient struct {
+	base  string
+	token string
+	http  *http.Client
+}
+
+// Fetches path of the admin API, decoding the JSON response into v.
+func (self *topClient) get(path string, v interface{}) error {
+	req, err := http.NewRequest("GET", self.base+path, nil)
+	if err != nil {
+		return err
+	}
+	if len(self.token) != 0 {
+		req.Header.Set("Authorization", "Bearer "+self.token)
+	}
+	resp, err := self.http.Do(req)
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode != http.StatusOK {
+		return fmt.Errorf("%s: %s", path, resp.Status)
+	}
+	return json.NewDecoder(resp.Body).Decode(v)
+}
+
+func sortSessions(sessions []topSession, order string) {
+	sort.SliceStable(sessions, func(i, j int) bool {
+		a, b := &sessions[i], &sessions[j]
+		switch order {
+		case "rate":
+			return a.Rate > b.Rate
+		case "age":
+			return a.Since.Before(b.Since)
+		case "client":
+			return a.Client < b.Client
+		case "destination":
+			return a.Destination < b.Destination
+		}
+		return a.BytesUp+a.BytesDown > b.BytesUp+b.BytesDown
+	})
+}
+
+func render(w *os.File, api, order string, sessions []topSession, rows int, stats *gosocksv5d.Stats, dests []gosocksv5d.DestinationTraffic, status string) {
+	var b strings.Builder
+	b.WriteString("\x1b[H\x1b[2J") // Home, clear
+	var rate float64
+	for _, session := range sessions {
+		rate += session.Rate
+	}
+	fmt.Fprintf(&b, "%s  %s  sessions %d  accepted %d  rejected %d  throughput %s/s\n",
+		time.Now().Format("15:04:05"), api, len(sessions), stats.Accepted, stats.Rejected, formatBytes(rate))
+	if len(status) != 0 {
+		fmt.Fprintf(&b, "error: %s\n", status)
+	}
+	fmt.Fprintf(&b, "\n%-6s %-28s %-36s %8s %9s %9s %10s\n", "ID", "CLIENT", "DESTINATION", "AGE", "UP", "DOWN", "RATE")
+	now := time.Now()
+	for i, session := range sessions {
+		if i == rows {
+			fmt.Fprintf(&b, "... %d more\n", len(sessions)-rows)
+			break
+		}
+		fmt.Fprintf(&b, "%-6d %-28.28s %-36.36s %8s %9s %9s %8s/s\n",
+			session.ID, session.Client, session.Destination,
+			now.Sub(session.Since).Truncate(time.Second), formatBytes(float64(session.BytesUp)),
+			formatBytes(float64(session.BytesDown)), formatBytes(session.Rate))
+	}
+	fmt.Fprintf(&b, "\nTop destinations, last %v\n", topWindow)
+	for _, dest := range dests {
+		fmt.Fprintf(&b, "  %-36.36s %6d sessions %9s\n", dest.Destination, dest.Sessions, formatBytes(float64(dest.Bytes())))
+	}
+	fmt.Fprintf(&b, "\nSorted by %s. Sort by [b]ytes, [r]ate, [a]ge, [c]lient, [d]estination; [q]uit\n", order)
+	w.WriteString(b.String())
+}
+
+func formatBytes(n float64) string {
+	const units = "KMGTP"
+	if n < 1024 {
+		return fmt.Sprintf("%.0fB", n)
+	}
+	i := -1
+	for n >= 1024 && i < len(units)-1 {
+		n /= 1024
+		i++
+	}
+	return fmt.Sprintf("%.1f%c", n, units[i])
+}
+
+// Switches the terminal to reading keys without waiting for a newline, nor
+// echoing them, returning the func restoring the previous mode, or nil if
+// stdin is not a terminal.
+func cbreak() func() {
+	if fi, err := os.Stdin.Stat(); err != nil || fi.Mode()&os.ModeCharDevice == 0 {
+		return nil
+	}
+	stty := func(args ...string) (string, error) {
+		cmd := exec.Command("stty", args...)
+		cmd.Stdin = os.Stdin
+		out, err := cmd.Output()
+		return strings.TrimSpace(string(out)), err
+	}
+	saved, err := stty("-g")
+	if err != nil {
+		return nil
+	}
+	if _, err := stty("cbreak", "-echo"); err != nil {
+		return nil
+	}
+	return func() {
+		stty(saved)
+	}
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,125 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "compress/flate"
+import "io"
+import "net"
+import "sync"
+import "time"
+
+// Private method number of DeflateMethod.
+const MethodDeflate = 0xfd
+
+// DeflateMethod compresses sessions with DEFLATE, to save bandwidth on slow
+// links between proxies under the same control, e.g. when chaining to a
+// parent proxy via an Upstream with Compress set.
+// It does not authenticate clients; offering it is enough. Registering it
+// alone hence needs Server.SetAllowNoAuth(true).
+// See: Server.SetAuthMethod()
+var DeflateMethod AuthMethod = AuthMethodFunc(func(client *ClientInfo, conn net.Conn) (net.Conn, string, error) {
+	return newDeflateConn(conn), "", nil
+})
+
+// deflateConn compresses writes and decompresses reads of a connection,
+// flushing every write, so as to not delay interactive traffic.
+// Decompression runs in a goroutine feeding a pipe, so that read deadlines
+// expiring do not corrupt the stream.
+type deflateConn struct {
+	net.Conn
+	pipe net.Conn // Reading end
+	mu   sync.Mutex
+	w    *flate.Writer
+	err  error // Ending decompression, if any
+}
+
+func newDeflateConn(conn net.Conn) *deflateConn {
+	w, _ := flate.NewWriter(conn, flate.BestSpeed)
+	pr, pw := net.Pipe()
+	rv := &deflateConn{Conn: conn, pipe: pr, w: w}
+	conn.SetReadDeadline(time.Time{})
+	go func() {
+		_, err := io.Copy(pw, flate.NewReader(conn))
+		rv.mu.Lock()
+		rv.err = err
+		rv.mu.Unlock()
+		pw.Close()
+	}()
+	return rv
+}
+
+func (self *deflateConn) Read(b []byte) (int, error) {
+	n, err := self.pipe.Read(b)
+	if err == io.EOF {
+		self.mu.Lock()
+		if self.err != nil {
+			err = self.err
+		}
+		self.mu.Unlock()
+	}
+	return n, err
+}
+
+func (self *deflateConn) Write(b []byte) (int, error) {
+	self.mu.Lock()
+	defer self.mu.Unlock()
+	n, err := self.w.Write(b)
+	if err == nil {
+		err = self.w.Flush()
+	}
+	return n, err
+}
+
+// Ends the compressed stream, then half-closes the connection.
+func (self *deflateConn) CloseWrite() error {
+	self.mu.Lock()
+	err := self.w.Close()
+	self.mu.Unlock()
+	if c, ok := self.Conn.(interface{ CloseWrite() error }); ok {
+		return c.CloseWrite()
+	}
+	return err
+}
+
+func (self *deflateConn) CloseRead() error {
+	self.pipe.Close()
+	if c, ok := self.Conn.(interface{ CloseRead() error }); ok {
+		return c.CloseRead()
+	}
+	return nil
+}
+
+func (self *deflateConn) Close() error {
+	self.pipe.Close()
+	return self.Conn.Close()
+}
+
+func (self *deflateConn) SetDeadline(t time.Time) error {
+	self.pipe.SetReadDeadline(t)
+	return self.Conn.SetWriteDeadline(t)
+}
+
+func (self *deflateConn) SetReadDeadline(t time.Time) error {
+	return self.pipe.SetReadDeadline(t)
+}
+
+// vim: set noet ts=2 sw=2:
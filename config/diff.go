@@ -0,0 +1,119 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import "encoding/json"
+import "fmt"
+import "reflect"
+import "sort"
+
+// Change between two configs, see Diff.
+type Change struct {
+	Path string      `json:"path"`          // e.g. "listeners[0].settings.idle_timeout"
+	Old  interface{} `json:"old,omitempty"` // JSON value, nil if added
+	New  interface{} `json:"new,omitempty"` // JSON value, nil if removed
+}
+
+// Returns whether the Change adds a key or element.
+func (self Change) Added() bool {
+	return self.Old == nil
+}
+
+// Returns whether the Change removes a key or element.
+func (self Change) Removed() bool {
+	return self.New == nil
+}
+
+// Returns the changes turning old into new, by comparing their JSON forms,
+// keys sorted and array elements by index. Referenced files, such as the
+// rules file, are not compared.
+func Diff(old, new *Config) ([]Change, error) {
+	ov, err := jsonValue(old)
+	if err != nil {
+		return nil, err
+	}
+	nv, err := jsonValue(new)
+	if err != nil {
+		return nil, err
+	}
+	var rv []Change
+	diffValues("", ov, nv, &rv)
+	return rv, nil
+}
+
+func jsonValue(cfg *Config) (interface{}, error) {
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		return nil, err
+	}
+	var rv interface{}
+	err = json.Unmarshal(data, &rv)
+	return rv, err
+}
+
+func diffValues(path string, old, new interface{}, changes *[]Change) {
+	switch o := old.(type) {
+	case map[string]interface{}:
+		if n, ok := new.(map[string]interface{}); ok {
+			keys := make(map[string]bool)
+			for key := range o {
+				keys[key] = true
+			}
+			for key := range n {
+				keys[key] = true
+			}
+			sorted := make([]string, 0, len(keys))
+			for key := range keys {
+				sorted = append(sorted, key)
+			}
+			sort.Strings(sorted)
+			for _, key := range sorted {
+				sub := key
+				if len(path) != 0 {
+					sub = path + "." + key
+				}
+				diffValues(sub, o[key], n[key], changes)
+			}
+			return
+		}
+
+	case []interface{}:
+		if n, ok := new.([]interface{}); ok {
+			for i := 0; i < len(o) || i < len(n); i++ {
+				var ov, nv interface{}
+				if i < len(o) {
+					ov = o[i]
+				}
+				if i < len(n) {
+					nv = n[i]
+				}
+				diffValues(fmt.Sprintf("%s[%d]", path, i), ov, nv, changes)
+			}
+			return
+		}
+	}
+	if !reflect.DeepEqual(old, new) {
+		*changes = append(*changes, Change{path, old, new})
+	}
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,233 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import "encoding/json"
+import "fmt"
+import "os"
+import "reflect"
+import "strconv"
+import "strings"
+import "time"
+
+// Prefix of environment variables overriding config keys.
+const EnvPrefix = "GOSOCKS_"
+
+// Environment variables overriding config keys, without EnvPrefix, derived
+// from the JSON keys of Config: the key, upper-cased, prefixed by the keys of
+// the objects holding it, e.g. GOSOCKS_LIMITS_RATE for limits.rate, except
+// for the keys of defaults, which go without prefix, e.g.
+// GOSOCKS_IDLE_TIMEOUT for defaults.idle_timeout. Values are given as:
+//
+//	durations, numbers and booleans  as in Go, e.g. "1m30s", "0x10", "true"
+//	lists                            comma separated, e.g. "a,b"
+//	maps                             comma separated key=value pairs, e.g. "standard=1048576,guest=65536"
+//	rules, feeds                     JSON, as in the config file
+//
+// Additionally, GOSOCKS_LISTEN replaces the listeners, given comma separated,
+// e.g. "0.0.0.0:1080,[::]:1080", which lose their per-listener settings then.
+//
+// Map entries given are added to, or replace, the ones of the config.
+// Variables set to an empty value reset keys to their zero value, i.e.
+// unset them, e.g. GOSOCKS_MARK= unsets defaults.mark.
+var EnvKeys []string
+
+// Field of Config overridden by an environment variable.
+type envField struct {
+	key   string
+	index []int // Path of field indexes, from Config
+}
+
+var envFields = make(map[string]envField)
+
+func init() {
+	addEnvFields(reflect.TypeOf(Config{}), "", nil)
+	EnvKeys = append([]string{"LISTEN"}, EnvKeys...)
+}
+
+func addEnvFields(t reflect.Type, prefix string, index []int) {
+	for i := 0; i < t.NumField(); i++ {
+		field := t.Field(i)
+		name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+		if !field.IsExported() || len(name) == 0 || name == "-" {
+			continue
+		}
+		key := prefix + strings.ToUpper(name)
+		path := append(index[:len(index):len(index)], i)
+		ft := field.Type
+		switch {
+		case ft == reflect.TypeOf(Settings{}) && len(prefix) == 0:
+			// Defaults, without prefix
+			addEnvFields(ft, "", path)
+			continue
+		case ft == reflect.TypeOf([]Listener{}):
+			continue // See LISTEN
+		case ft.Kind() == reflect.Pointer && ft.Elem().Kind() == reflect.Struct:
+			addEnvFields(ft.Elem(), key+"_", path)
+			continue
+		}
+		EnvKeys = append(EnvKeys, key)
+		envFields[key] = envField{key, path}
+	}
+}
+
+// Overrides config keys by environment variables, as looked up by lookup,
+// e.g. os.LookupEnv.
+// See: EnvKeys
+func (self *Config) ApplyEnv(lookup func(key string) (string, bool)) error {
+	for _, key := range EnvKeys {
+		value, ok := lookup(EnvPrefix + key)
+		if !ok {
+			continue
+		}
+		if err := self.set(key, value); err != nil {
+			return fmt.Errorf("%s%s: %v", EnvPrefix, key, err)
+		}
+	}
+	return nil
+}
+
+func (self *Config) set(key, value string) error {
+	if key == "LISTEN" {
+		self.Listeners = nil
+		for _, listen := range strings.Split(value, ",") {
+			if listen = strings.TrimSpace(listen); len(listen) != 0 {
+				self.Listeners = append(self.Listeners, Listener{Listen: listen})
+			}
+		}
+		return nil
+	}
+	field, ok := envFields[key]
+	if !ok {
+		return fmt.Errorf("unknown key")
+	}
+	v := reflect.ValueOf(self).Elem()
+	for i, index := range field.index {
+		v = v.Field(index)
+		if v.Kind() == reflect.Pointer && i+1 < len(field.index) {
+			if v.IsNil() {
+				if len(value) == 0 {
+					return nil // Nothing to unset
+				}
+				v.Set(reflect.New(v.Type().Elem()))
+			}
+			v = v.Elem()
+		}
+	}
+	if len(value) == 0 {
+		v.SetZero()
+		return nil
+	}
+	return setValue(v, value)
+}
+
+// Parses value into v, as documented for EnvKeys.
+func setValue(v reflect.Value, value string) error {
+	switch v.Kind() {
+	case reflect.String:
+		v.SetString(value)
+	case reflect.Bool:
+		b, err := strconv.ParseBool(value)
+		if err != nil {
+			return err
+		}
+		v.SetBool(b)
+	case reflect.Int, reflect.Int8, reflect.Int16, reflect.Int32, reflect.Int64:
+		if v.Type() == reflect.TypeOf(Duration(0)) {
+			d, err := time.ParseDuration(value)
+			if err != nil {
+				return err
+			}
+			v.SetInt(int64(d))
+			return nil
+		}
+		n, err := strconv.ParseInt(value, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetInt(n)
+	case reflect.Uint, reflect.Uint8, reflect.Uint16, reflect.Uint32, reflect.Uint64:
+		n, err := strconv.ParseUint(value, 0, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetUint(n)
+	case reflect.Float32, reflect.Float64:
+		f, err := strconv.ParseFloat(value, v.Type().Bits())
+		if err != nil {
+			return err
+		}
+		v.SetFloat(f)
+	case reflect.Slice:
+		if v.Type().Elem().Kind() != reflect.String {
+			return json.Unmarshal([]byte(value), v.Addr().Interface())
+		}
+		var list []string
+		for _, item := range strings.Split(value, ",") {
+			if item = strings.TrimSpace(item); len(item) != 0 {
+				list = append(list, item)
+			}
+		}
+		v.Set(reflect.ValueOf(list))
+	case reflect.Map:
+		if v.IsNil() {
+			v.Set(reflect.MakeMap(v.Type()))
+		}
+		for _, pair := range strings.Split(value, ",") {
+			if pair = strings.TrimSpace(pair); len(pair) == 0 {
+				continue
+			}
+			name, item, ok := strings.Cut(pair, "=")
+			if !ok {
+				return fmt.Errorf("invalid entry %q, expected key=value", pair)
+			}
+			elem := reflect.New(v.Type().Elem()).Elem()
+			if err := setValue(elem, item); err != nil {
+				return err
+			}
+			v.SetMapIndex(reflect.ValueOf(name), elem)
+		}
+	default:
+		return fmt.Errorf("unsupported type %v", v.Type())
+	}
+	return nil
+}
+
+// Loads the config from path, if not empty, and applies the overrides of
+// the process environment.
+// Precedence, from highest to lowest: environment, config file, built-in
+// defaults.
+func LoadEnv(path string) (*Config, error) {
+	rv := &Config{}
+	if len(path) != 0 {
+		var err error
+		if rv, err = Load(path); err != nil {
+			return nil, err
+		}
+	}
+	if err := rv.ApplyEnv(os.LookupEnv); err != nil {
+		return nil, err
+	}
+	return rv, nil
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,159 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import "reflect"
+import "strings"
+import "testing"
+import "time"
+
+// Sample values, by type, each setting a field to a non-zero value.
+var envSamples = map[reflect.Type]string{
+	reflect.TypeOf(""):                  "x",
+	reflect.TypeOf(false):               "true",
+	reflect.TypeOf(0):                   "1",
+	reflect.TypeOf(int64(0)):            "1",
+	reflect.TypeOf(uint64(0)):           "1",
+	reflect.TypeOf(0.0):                 "0.5",
+	reflect.TypeOf(Duration(0)):         "1s",
+	reflect.TypeOf([]string{}):          "a,b",
+	reflect.TypeOf(map[string]string{}): "a=b",
+	reflect.TypeOf(map[string]int64{}):  "a=1",
+	reflect.TypeOf([]Rule{}):            `[{"pattern":"example.com"}]`,
+	reflect.TypeOf([]Feed{}):            `[{"name":"a","url":"https://example.com"}]`,
+}
+
+// Every config key, except the listeners (see LISTEN), must have an
+// environment variable, which must be able to set it.
+func TestEnvKeys(t *testing.T) {
+	seen := make(map[string]bool)
+	for _, key := range EnvKeys {
+		if seen[key] {
+			t.Errorf("%s: duplicate", key)
+		}
+		seen[key] = true
+	}
+
+	var walk func(t reflect.Type, path []string, index []int)
+	walk = func(typ reflect.Type, path []string, index []int) {
+		for i := 0; i < typ.NumField(); i++ {
+			field := typ.Field(i)
+			name, _, _ := strings.Cut(field.Tag.Get("json"), ",")
+			if !field.IsExported() || len(name) == 0 {
+				continue
+			}
+			path := append(path[:len(path):len(path)], name)
+			index := append(index[:len(index):len(index)], i)
+			ft := field.Type
+			if ft.Kind() == reflect.Pointer {
+				ft = ft.Elem()
+			}
+			switch {
+			case name == "listeners":
+				continue
+			case ft.Kind() == reflect.Struct:
+				walk(ft, path, index)
+				continue
+			}
+			key := strings.ToUpper(strings.Join(path, "_"))
+			key = strings.TrimPrefix(key, "DEFAULTS_")
+			if !seen[key] {
+				t.Errorf("%s: no environment variable", strings.Join(path, "."))
+				continue
+			}
+			sample, ok := envSamples[field.Type]
+			if !ok {
+				t.Errorf("%s: no sample for %v", key, field.Type)
+				continue
+			}
+			cfg := &Config{}
+			env := map[string]string{EnvPrefix + key: sample}
+			if err := cfg.ApplyEnv(func(k string) (string, bool) {
+				v, ok := env[k]
+				return v, ok
+			}); err != nil {
+				t.Errorf("%s: %v", key, err)
+				continue
+			}
+			v := reflect.ValueOf(cfg).Elem()
+			for _, i := range index {
+				v = reflect.Indirect(v).Field(i)
+			}
+			if v.IsZero() {
+				t.Errorf("%s: not set by %q", key, sample)
+			}
+		}
+	}
+	walk(reflect.TypeOf(Config{}), nil, nil)
+}
+
+func TestEnvEmpty(t *testing.T) {
+	cfg := &Config{
+		Defaults:         Settings{Mark: 1, IdleTimeout: Duration(1)},
+		BandwidthClasses: map[string]int64{"a": 1},
+	}
+	env := map[string]string{
+		EnvPrefix + "MARK":              "",
+		EnvPrefix + "IDLE_TIMEOUT":      "",
+		EnvPrefix + "BANDWIDTH_CLASSES": "",
+		EnvPrefix + "LIMITS_RATE":       "",
+	}
+	if err := cfg.ApplyEnv(func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if cfg.Defaults.Mark != 0 || cfg.Defaults.IdleTimeout != 0 || cfg.BandwidthClasses != nil {
+		t.Errorf("not unset: %+v", cfg)
+	}
+	if cfg.Limits != nil {
+		t.Errorf("limits allocated to unset a key")
+	}
+}
+
+func TestEnvLegacy(t *testing.T) {
+	env := map[string]string{
+		EnvPrefix + "LISTEN":            "127.0.0.1:1080, [::1]:1080",
+		EnvPrefix + "IDLE_TIMEOUT":      "1m",
+		EnvPrefix + "BANDWIDTH_CLASSES": "standard=1048576,guest=65536",
+	}
+	cfg := &Config{BandwidthClasses: map[string]int64{"guest": 1, "other": 2}}
+	if err := cfg.ApplyEnv(func(k string) (string, bool) {
+		v, ok := env[k]
+		return v, ok
+	}); err != nil {
+		t.Fatal(err)
+	}
+	if len(cfg.Listeners) != 2 || cfg.Listeners[1].Listen != "[::1]:1080" {
+		t.Errorf("listeners: %+v", cfg.Listeners)
+	}
+	if time.Duration(cfg.Defaults.IdleTimeout) != time.Minute {
+		t.Errorf("idle_timeout: %v", cfg.Defaults.IdleTimeout)
+	}
+	want := map[string]int64{"standard": 1048576, "guest": 65536, "other": 2}
+	if !reflect.DeepEqual(cfg.BandwidthClasses, want) {
+		t.Errorf("bandwidth_classes: %v", cfg.BandwidthClasses)
+	}
+}
+
+// vim: set noet ts=2 sw=2:
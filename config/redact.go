@@ -0,0 +1,98 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package config
+
+import "encoding/json"
+import "net/url"
+
+// Replaces URL credentials, such as upstream passwords, that must not be
+// shown, or are secrets themselves, as webhook URLs are.
+const redacted = "redacted"
+
+// Returns a copy of the config, fit for showing: the passwords of upstream
+// and feed URLs are replaced, as are the paths and queries of webhook URLs,
+// which usually hold tokens.
+func (self *Config) Redacted() *Config {
+	data, err := json.Marshal(self)
+	if err != nil {
+		return &Config{}
+	}
+	rv := &Config{}
+	if err := json.Unmarshal(data, rv); err != nil {
+		return &Config{}
+	}
+	rv.Defaults.redact()
+	for i := range rv.Listeners {
+		rv.Listeners[i].Settings.redact()
+	}
+	for i := range rv.Rules {
+		rv.Rules[i].Settings.redact()
+	}
+	for i := range rv.Feeds {
+		rv.Feeds[i].URL = redactURL(rv.Feeds[i].URL)
+	}
+	if alerts := rv.Alerts; alerts != nil {
+		for i, hook := range alerts.Webhooks {
+			u, err := url.Parse(hook)
+			if err != nil {
+				alerts.Webhooks[i] = redacted
+				continue
+			}
+			u.User, u.Path, u.RawPath, u.RawQuery = nil, "/"+redacted, "", ""
+			alerts.Webhooks[i] = u.String()
+		}
+	}
+	return rv
+}
+
+func (self *Settings) redact() {
+	for _, urls := range [][]string{self.Upstreams, self.UpstreamPool, self.AlternateUpstreams} {
+		for i, s := range urls {
+			urls[i] = redactURL(s)
+		}
+	}
+}
+
+// Returns s with the password replaced, if any.
+func redactURL(s string) string {
+	u, err := url.Parse(s)
+	if err != nil {
+		return redacted
+	}
+	if _, ok := u.User.Password(); ok {
+		u.User = url.UserPassword(u.User.Username(), redacted)
+	}
+	return u.String()
+}
+
+// Returns the files the config reads: rules files and the ASN database.
+func (self *Config) Files() []string {
+	var rv []string
+	for _, path := range []string{self.RulesFile, self.DryRunRulesFile, self.ASNDatabase} {
+		if len(path) != 0 {
+			rv = append(rv, path)
+		}
+	}
+	return rv
+}
+
+// vim: set noet ts=2 sw=2:
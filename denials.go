@@ -0,0 +1,85 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "net"
+import "sync"
+
+// Reasons for policy denials, as counted in Stats.Denials and reported via
+// AccessRecord.Reason.
+const (
+	ReasonRuler        = "ruler"         // Ruler denied, without giving a reason
+	ReasonDefaultLocal = "default-local" // DefaultRuler denied a local destination
+	ReasonDomainRule   = "domain-rule"   // A RuleSet domain rule denied
+	ReasonRebinding    = "rebinding"     // DNS rebinding protection denied
+	ReasonBanned       = "ban"           // Client is banned
+	ReasonSniffedHost  = "sniffed-host"  // Domain rules denied the sniffed HTTP Host
+	ReasonProtocol     = "protocol"      // Client did not speak the protocol expected for the port
+	ReasonBlocklist    = "blocklist"     // A Blocklist threat feed lists the destination
+	ReasonASN          = "asn"           // An ASNRuler denied the autonomous system of the destination
+	ReasonQuota        = "quota"         // Client used up its transfer quota
+	ReasonRateLimit    = "rate-limit"    // Client exceeded its request rate
+	ReasonConcurrency  = "concurrency"   // Client exceeded its concurrent sessions
+)
+
+// DenialReasoner may additionally be implemented by a Ruler, to name the
+// policy that denied a request.
+// It gets called with either the domain (and a nil IP) for denials by
+// DomainAllowed(), or the IP for denials by ConnectionAllowed().
+type DenialReasoner interface {
+	DenialReason(client *ClientInfo, domain string, requested net.IP) string
+}
+
+func denialReason(ruler Ruler, client *ClientInfo, domain string, requested net.IP) string {
+	if dr, ok := ruler.(DenialReasoner); ok {
+		if reason := dr.DenialReason(client, domain, requested); len(reason) != 0 {
+			return reason
+		}
+	}
+	return ReasonRuler
+}
+
+type denialCounter struct {
+	sync.Mutex
+	counts map[string]uint64
+}
+
+func (self *denialCounter) add(reason string) {
+	self.Lock()
+	defer self.Unlock()
+	if self.counts == nil {
+		self.counts = make(map[string]uint64)
+	}
+	self.counts[reason]++
+}
+
+func (self *denialCounter) snapshot() map[string]uint64 {
+	self.Lock()
+	defer self.Unlock()
+	rv := make(map[string]uint64, len(self.counts))
+	for reason, count := range self.counts {
+		rv[reason] = count
+	}
+	return rv
+}
+
+// vim: set noet ts=2 sw=2:
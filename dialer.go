@@ -0,0 +1,117 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "context"
+import "net"
+
+// Dialer dials outgoing connections, e.g. through a userspace network stack
+// instead of the kernel's. The Net of wireguard-go's tun/netstack package
+// (gVisor) implements it, so the server can egress through a userspace
+// WireGuard tunnel, without root or kernel interfaces:
+//
+//	tun, tnet, _ := netstack.CreateNetTUN(addrs, dns, 1420)
+//	dev := device.NewDevice(tun, conn.NewDefaultBind(), logger)
+//	dev.IpcSet(config)
+//	dev.Up()
+//	server.SetDialer(tnet)
+//	server.SetDNSResolver(gosocksv5d.NewHostResolver(tnet))
+//
+// Socket level options, such as SessionOptions.Mark and Device, the
+// SocketHook and binding to the listener address do not apply to
+// connections dialed this way.
+// See: Server.SetDialer(), SessionOptions.Dialer
+type Dialer interface {
+	DialContext(ctx context.Context, network, address string) (net.Conn, error)
+}
+
+// Adapter to use ordinary functions as Dialer.
+type DialerFunc func(ctx context.Context, network, address string) (net.Conn, error)
+
+func (self DialerFunc) DialContext(ctx context.Context, network, address string) (net.Conn, error) {
+	return self(ctx, network, address)
+}
+
+// HostLookuper looks up hosts, returning addresses as strings, like the Net
+// of wireguard-go's tun/netstack package.
+type HostLookuper interface {
+	LookupContextHost(ctx context.Context, host string) ([]string, error)
+}
+
+type hostResolver struct {
+	lookuper HostLookuper
+}
+
+// Creates a DNSResolver looking up hosts via lookuper, e.g. to resolve
+// through the same userspace network stack a Dialer dials through.
+func NewHostResolver(lookuper HostLookuper) DNSResolver {
+	return &hostResolver{lookuper}
+}
+
+func (self *hostResolver) LookupIP(host string) ([]net.IP, error) {
+	addrs, err := self.lookuper.LookupContextHost(context.Background(), host)
+	if err != nil {
+		return nil, err
+	}
+	rv := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if ip := net.ParseIP(addr); ip != nil {
+			rv = append(rv, NormalizeIP(ip))
+		}
+	}
+	if len(rv) == 0 {
+		return nil, &net.DNSError{Err: "no such host", Name: host, IsNotFound: true}
+	}
+	return rv, nil
+}
+
+// Dials address via the Dialer of opts or the server, if any, or otherwise
+// directly, see dialer().
+func (sock *sockConn) dial(lip net.IP, opts *SessionOptions, network, address string) (net.Conn, error) {
+	dialer := opts.Dialer
+	if dialer == nil {
+		dialer = sock.srv.dialer
+	}
+	if dialer != nil {
+		return dialer.DialContext(context.Background(), network, address)
+	}
+	return sock.dialer(lip, opts).Dial(network, address)
+}
+
+// Returns the IP of the remote address of conn, which may not be a TCPAddr
+// if dialed by a Dialer.
+func remoteIP(conn net.Conn) net.IP {
+	switch addr := conn.RemoteAddr().(type) {
+	case *net.TCPAddr:
+		return NormalizeIP(addr.IP)
+	case nil:
+		return nil
+	default:
+		host, _, err := net.SplitHostPort(addr.String())
+		if err != nil {
+			return nil
+		}
+		return NormalizeIP(net.ParseIP(host))
+	}
+}
+
+// vim: set noet ts=2 sw=2:
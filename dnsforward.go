@@ -0,0 +1,277 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "context"
+import "encoding/binary"
+import "errors"
+import "io"
+import "net"
+import "strings"
+import "sync"
+import "time"
+
+const (
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+	dnsClassIN  = 1
+
+	dnsNoError  = 0
+	dnsFormErr  = 1
+	dnsServFail = 2
+	dnsNXDomain = 3
+	dnsNotImp   = 4
+	dnsRefused  = 5
+
+	dnsHeaderLen  = 12
+	dnsMaxUDP     = 512
+	dnsMaxMessage = 65535
+	dnsTCPTimeout = 10 * time.Second
+	defaultDNSTTL = time.Minute
+)
+
+var ErrorDNSMessage = errors.New("Malformed DNS message")
+
+// DNSForwarder answers the A and AAAA queries of clients, e.g. on a LAN, via
+// Server.Resolve(), i.e. the resolver, rules and query log of a server, so
+// that names resolve consistently with the requests made through the server.
+// Names the rules deny get refused. Other query types are not implemented.
+//
+//	dns := &gosocksv5d.DNSForwarder{Server: func() gosocksv5d.Server { return srv }}
+//	go dns.ListenAndServe(ctx, ":53")
+type DNSForwarder struct {
+	Server func() Server // Server resolving queries, called per query
+	TTL    time.Duration // Of answers, a minute if zero
+	Logger Logger        // Of failures serving clients, if not nil
+}
+
+// Serves queries via UDP and TCP on addr until ctx is done.
+func (self *DNSForwarder) ListenAndServe(ctx context.Context, addr string) error {
+	pc, err := net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		pc.Close()
+		return err
+	}
+	errs := make(chan error, 2)
+	go func() { errs <- self.ServePacket(ctx, pc) }()
+	go func() { errs <- self.Serve(ctx, l) }()
+	err = <-errs
+	pc.Close()
+	l.Close()
+	<-errs
+	if ctx.Err() != nil {
+		return ctx.Err()
+	}
+	return err
+}
+
+// Serves queries received via conn, until ctx is done, closing conn then.
+func (self *DNSForwarder) ServePacket(ctx context.Context, conn net.PacketConn) error {
+	stop := context.AfterFunc(ctx, func() { conn.Close() })
+	defer stop()
+	buf := make([]byte, dnsMaxMessage)
+	for {
+		n, addr, err := conn.ReadFrom(buf)
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			client := &ClientInfo{Listener: conn.LocalAddr(), Transport: "udp"}
+			if ua, ok := addr.(*net.UDPAddr); ok {
+				client.IP, client.Port = NormalizeIP(ua.IP), ua.Port
+			}
+			if reply := self.answer(client, query, dnsMaxUDP); reply != nil {
+				conn.WriteTo(reply, addr)
+			}
+		}()
+	}
+}
+
+// Serves queries of the connections accepted via l, until ctx is done,
+// closing l then.
+func (self *DNSForwarder) Serve(ctx context.Context, l net.Listener) error {
+	var wg sync.WaitGroup
+	defer wg.Wait()
+	stop := context.AfterFunc(ctx, func() { l.Close() })
+	defer stop()
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if ctx.Err() != nil {
+				return ctx.Err()
+			}
+			return err
+		}
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			defer conn.Close()
+			closing := context.AfterFunc(ctx, func() { conn.Close() })
+			defer closing()
+			if err := self.serveConn(conn); err != nil && err != io.EOF && self.Logger != nil {
+				self.Logger.Printf("DNS client %v: %v", conn.RemoteAddr(), err)
+			}
+		}()
+	}
+}
+
+// Answers length-prefixed queries, until the client closes the connection or
+// idles.
+func (self *DNSForwarder) serveConn(conn net.Conn) error {
+	client := &ClientInfo{Listener: conn.LocalAddr(), Transport: "tcp"}
+	if ta, ok := conn.RemoteAddr().(*net.TCPAddr); ok {
+		client.IP, client.Port = NormalizeIP(ta.IP), ta.Port
+	}
+	length := make([]byte, 2)
+	for {
+		conn.SetDeadline(time.Now().Add(dnsTCPTimeout))
+		if _, err := io.ReadFull(conn, length); err != nil {
+			return err
+		}
+		query := make([]byte, binary.BigEndian.Uint16(length))
+		if _, err := io.ReadFull(conn, query); err != nil {
+			return err
+		}
+		reply := self.answer(client, query, dnsMaxMessage)
+		if reply == nil {
+			return ErrorDNSMessage
+		}
+		if _, err := conn.Write(binary.BigEndian.AppendUint16(nil, uint16(len(reply)))); err != nil {
+			return err
+		}
+		if _, err := conn.Write(reply); err != nil {
+			return err
+		}
+	}
+}
+
+// Returns the reply to query, truncated to max bytes, or nil if the query is
+// not worth a reply.
+func (self *DNSForwarder) answer(client *ClientInfo, query []byte, max int) []byte {
+	if len(query) < dnsHeaderLen || query[2]&0x80 != 0 {
+		return nil
+	}
+	reply := make([]byte, dnsHeaderLen, max)
+	copy(reply, query[:4])
+	reply[2] = 0x80 | query[2]&0x79 // QR, and opcode and RD of the query
+	reply[3] = 0x80                 // RA
+	fail := func(rcode byte) []byte {
+		reply[3] |= rcode
+		return reply
+	}
+	if query[2]&0x78 != 0 {
+		return fail(dnsNotImp)
+	}
+	if binary.BigEndian.Uint16(query[4:]) != 1 {
+		return fail(dnsFormErr)
+	}
+	name, qtype, qclass, end, err := parseQuestion(query)
+	if err != nil {
+		return fail(dnsFormErr)
+	}
+	reply = append(reply, query[dnsHeaderLen:end]...)
+	binary.BigEndian.PutUint16(reply[4:], 1)
+	if qclass != dnsClassIN || (qtype != dnsTypeA && qtype != dnsTypeAAAA) {
+		return fail(dnsNotImp)
+	}
+
+	addrs, err := self.Server().Resolve(client, name)
+	var dnsErr *net.DNSError
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		return fail(dnsNXDomain)
+	case errors.Is(err, ErrorNotAllowed) || errors.Is(err, ErrorRebinding) || errors.Is(err, ErrorAddress):
+		return fail(dnsRefused)
+	case err != nil:
+		return fail(dnsServFail)
+	}
+
+	ttl := self.TTL
+	if ttl <= 0 {
+		ttl = defaultDNSTTL
+	}
+	var count uint16
+	for _, addr := range addrs {
+		rdata := addr.To4()
+		if qtype == dnsTypeAAAA {
+			if rdata != nil {
+				continue
+			}
+			rdata = addr.To16()
+		}
+		if rdata == nil {
+			continue
+		}
+		if len(reply)+12+len(rdata) > max {
+			reply[2] |= 0x2 // TC
+			break
+		}
+		reply = append(reply, 0xc0, dnsHeaderLen) // Pointer to the question name
+		reply = binary.BigEndian.AppendUint16(reply, qtype)
+		reply = binary.BigEndian.AppendUint16(reply, dnsClassIN)
+		reply = binary.BigEndian.AppendUint32(reply, uint32(ttl/time.Second))
+		reply = binary.BigEndian.AppendUint16(reply, uint16(len(rdata)))
+		reply = append(reply, rdata...)
+		count++
+	}
+	binary.BigEndian.PutUint16(reply[6:], count)
+	return fail(dnsNoError)
+}
+
+// Parses the single question of a query, returning the name, type and class,
+// and the offset it ends at.
+func parseQuestion(query []byte) (name string, qtype, qclass uint16, end int, err error) {
+	var labels []string
+	off := dnsHeaderLen
+	for {
+		if off >= len(query) {
+			return "", 0, 0, 0, ErrorDNSMessage
+		}
+		length := int(query[off])
+		off++
+		if length == 0 {
+			break
+		}
+		// Compression pointers have no business in the question of a query
+		if length > 63 || off+length > len(query) {
+			return "", 0, 0, 0, ErrorDNSMessage
+		}
+		labels = append(labels, string(query[off:off+length]))
+		off += length
+	}
+	if off+4 > len(query) || len(labels) == 0 {
+		return "", 0, 0, 0, ErrorDNSMessage
+	}
+	qtype = binary.BigEndian.Uint16(query[off:])
+	qclass = binary.BigEndian.Uint16(query[off+2:])
+	return strings.Join(labels, "."), qtype, qclass, off + 4, nil
+}
+
+// vim: set noet ts=2 sw=2:
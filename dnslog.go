@@ -0,0 +1,166 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "encoding/json"
+import "io"
+import "net"
+import "sync"
+import "time"
+
+// DNSQuery describes a lookup performed on behalf of a client.
+type DNSQuery struct {
+	Time    time.Time
+	Client  *ClientInfo
+	Domain  string
+	Answers []net.IP
+	Latency time.Duration
+	Cached  bool  // Answered from a cache, see CachingResolver
+	Err     error // Lookup failure, if any
+}
+
+// DNSQueryLogger receives a DNSQuery for every lookup performed on behalf of
+// clients, e.g. for auditing which names get resolved through the server.
+// Calls happen synchronously, so better not block.
+type DNSQueryLogger interface {
+	LogQuery(query *DNSQuery)
+}
+
+type jsonQueryLogger struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+// Creates a DNSQueryLogger writing one JSON object per query to w, e.g.:
+//
+//	{"time":"2013-10-01T12:34:56Z","client":"192.0.2.1:1234","domain":"example.com","answers":["93.184.216.34"],"latency":0.0123,"cached":false,"error":""}
+func NewJSONQueryLogger(w io.Writer) DNSQueryLogger {
+	return &jsonQueryLogger{enc: json.NewEncoder(w)}
+}
+
+func (self *jsonQueryLogger) LogQuery(query *DNSQuery) {
+	answers := make([]string, len(query.Answers))
+	for i, answer := range query.Answers {
+		answers[i] = answer.String()
+	}
+	failure := ""
+	if query.Err != nil {
+		failure = query.Err.Error()
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.enc.Encode(struct {
+		Time    time.Time `json:"time"`
+		Client  string    `json:"client"`
+		Domain  string    `json:"domain"`
+		Answers []string  `json:"answers"`
+		Latency float64   `json:"latency"`
+		Cached  bool      `json:"cached"`
+		Err     string    `json:"error"`
+	}{query.Time, query.Client.String(), query.Domain, answers, query.Latency.Seconds(), query.Cached, failure})
+}
+
+type channelQueryLogger chan<- *DNSQuery
+
+// Creates a DNSQueryLogger sending queries to c. Queries are dropped while c
+// is full.
+func NewChannelQueryLogger(c chan<- *DNSQuery) DNSQueryLogger {
+	return channelQueryLogger(c)
+}
+
+func (self channelQueryLogger) LogQuery(query *DNSQuery) {
+	select {
+	case self <- query:
+	default:
+	}
+}
+
+// Looks up host on behalf of client, accounting and logging the query.
+func (self *server) lookup(client *ClientInfo, host string) ([]net.IP, error) {
+	start := time.Now()
+	var addrs []net.IP
+	var cached bool
+	var err error
+	if cr, ok := self.DNSResolver.(CachingResolver); ok {
+		addrs, cached, err = cr.LookupIPCached(host)
+	} else {
+		addrs, err = self.LookupIP(host)
+	}
+	self.stats.resolver.observe(self.DNSResolver, time.Since(start), cached, err)
+	if len(addrs) != 0 {
+		// Copying, as resolvers may hand out their cached entries
+		normalized := make([]net.IP, len(addrs))
+		for i, addr := range addrs {
+			normalized[i] = NormalizeIP(addr)
+		}
+		addrs = normalized
+	}
+	if self.queryLogger != nil {
+		self.queryLogger.LogQuery(&DNSQuery{
+			Time:    start,
+			Client:  client,
+			Domain:  host,
+			Answers: append([]net.IP(nil), addrs...),
+			Latency: time.Since(start),
+			Cached:  cached,
+			Err:     err,
+		})
+	}
+	return addrs, err
+}
+
+func (self *server) Resolve(client *ClientInfo, domain string) ([]net.IP, error) {
+	domain, err := NormalizeDomain(domain)
+	if err != nil {
+		return nil, err
+	}
+	checkIPs := true
+	if dr, ok := self.Ruler.(DomainRuler); ok {
+		switch dr.DomainAllowed(client, domain) {
+		case AllowConnection:
+			checkIPs = false
+		case DeferConnection:
+			break
+		default:
+			return nil, ErrorNotAllowed
+		}
+	}
+	addrs, err := self.lookup(client, domain)
+	if err != nil || !checkIPs {
+		return addrs, err
+	}
+	if self.rebind != nil && self.rebind.check(domain, addrs) != nil {
+		return nil, ErrorRebinding
+	}
+	allowed := make([]net.IP, 0, len(addrs))
+	for _, addr := range addrs {
+		if self.ConnectionAllowed(client, addr) == AllowConnection {
+			allowed = append(allowed, addr)
+		}
+	}
+	if len(allowed) == 0 || (self.rulerMode == RulerDenyAny && len(allowed) != len(addrs)) {
+		return nil, ErrorNotAllowed
+	}
+	return allowed, nil
+}
+
+// vim: set noet ts=2 sw=2:
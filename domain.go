@@ -0,0 +1,82 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "net"
+import "strings"
+
+const (
+	maxDomainLength = 253
+	maxLabelLength  = 63
+)
+
+// Returns the canonical form of a domain name, as used for resolving, rule
+// matching, logging and statistics: ASCII (international names get punycode
+// encoded), lower case, without a trailing dot.
+//
+// Returns ErrorAddress for names exceeding length limits or containing
+// invalid labels. Underscores are tolerated, as these are commonly found in
+// (internal) host names.
+func NormalizeDomain(domain string) (string, error) {
+	domain, err := toASCII(strings.TrimSuffix(domain, "."))
+	if err != nil {
+		return "", err
+	}
+	if len(domain) == 0 || len(domain) > maxDomainLength {
+		return "", ErrorAddress
+	}
+	for _, label := range strings.Split(domain, ".") {
+		if !isValidLabel(label) {
+			return "", ErrorAddress
+		}
+	}
+	return domain, nil
+}
+
+// Returns the canonical form of an IP address, as used for rules, dialing,
+// logging and statistics: 4 bytes for IPv4 addresses, including IPv4-mapped
+// IPv6 addresses (::ffff:a.b.c.d), 16 bytes otherwise.
+func NormalizeIP(ip net.IP) net.IP {
+	if ip4 := ip.To4(); ip4 != nil {
+		return ip4
+	}
+	return ip.To16()
+}
+
+func isValidLabel(label string) bool {
+	if len(label) == 0 || len(label) > maxLabelLength {
+		return false
+	}
+	if label[0] == '-' || label[len(label)-1] == '-' {
+		return false
+	}
+	for i := 0; i < len(label); i++ {
+		switch c := label[i]; {
+		case c >= 'a' && c <= 'z', c >= '0' && c <= '9', c == '-', c == '_':
+		default:
+			return false
+		}
+	}
+	return true
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,88 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "net"
+import "sync/atomic"
+
+// Returns whether ruler would allow a request, the way connect() checks the
+// Ruler of the server, resolving host if necessary and rips is nil, along
+// with the first IP denied, if any.
+func (sock *sockConn) verdict(ruler Ruler, host string, rips []net.IP) (allowed bool, denied net.IP, err error) {
+	if len(host) != 0 {
+		if dr, ok := ruler.(DomainRuler); ok {
+			switch dr.DomainAllowed(sock.info, host) {
+			case AllowConnection:
+				return true, nil, nil
+			case DeferConnection:
+				break
+			default:
+				return false, nil, nil
+			}
+		}
+		if rips == nil {
+			if rips, err = sock.srv.lookup(sock.info, host); err != nil {
+				return false, nil, err
+			}
+		}
+	}
+	count := 0
+	for _, rip := range rips {
+		if ruler.ConnectionAllowed(sock.info, rip) == AllowConnection {
+			count++
+		} else if denied == nil {
+			denied = rip
+		}
+	}
+	allowed = count != 0 && (sock.srv.rulerMode != RulerDenyAny || count == len(rips))
+	return allowed, denied, nil
+}
+
+// Checks the request against the dry-run Ruler, if any, logging and counting
+// whether it would have been decided differently than allowed by the active
+// one. Rips is nil if not resolved yet.
+func (sock *sockConn) dryRun(host string, rips []net.IP, port int, allowed bool) {
+	if sock.srv.dryRun == nil {
+		return
+	}
+	would, denied, err := sock.verdict(sock.srv.dryRun, host, rips)
+	if err != nil || would == allowed {
+		return
+	}
+	atomic.AddUint64(&sock.srv.stats.divergences, 1)
+	dest := host
+	if len(dest) == 0 {
+		dest = rips[0].String()
+	}
+	if would {
+		sock.Printf("Dry run: would have allowed %v", joinHostPort(dest, port))
+		return
+	}
+	domain := host
+	if denied != nil {
+		domain = ""
+	}
+	sock.Printf("Dry run: would have denied %v (%v)", joinHostPort(dest, port),
+		denialReason(sock.srv.dryRun, sock.info, domain, denied))
+}
+
+// vim: set noet ts=2 sw=2:
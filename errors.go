@@ -0,0 +1,112 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "fmt"
+import "net"
+import "syscall"
+
+// DialError reports a request that could not be connected, e.g. because
+// the destination could not be resolved or refused the connection.
+// ReplyCode is the SOCKS reply sent to the client.
+type DialError struct {
+	ReplyCode ReplyCode
+	Dest      string
+	Err       error
+}
+
+func (self *DialError) Error() string {
+	return fmt.Sprintf("Cannot connect to %s: %v", self.Dest, self.Err)
+}
+
+func (self *DialError) Unwrap() error {
+	return self.Err
+}
+
+// PolicyDeniedError reports a request or client denied by policy.
+// Err is the sentinel, e.g. ErrorNotAllowed, ErrorRebinding or ErrorBanned,
+// so errors.Is() works as expected.
+type PolicyDeniedError struct {
+	Reason string // See ReasonRuler and friends
+	Dest   string // Empty for denied clients
+	Err    error
+}
+
+func (self *PolicyDeniedError) Error() string {
+	if len(self.Dest) == 0 {
+		return fmt.Sprintf("%v (%s)", self.Err, self.Reason)
+	}
+	return fmt.Sprintf("%v: %s (%s)", self.Err, self.Dest, self.Reason)
+}
+
+func (self *PolicyDeniedError) Unwrap() error {
+	return self.Err
+}
+
+// HandshakeError reports a client failing the SOCKS handshake.
+type HandshakeError struct {
+	Err error
+}
+
+func (self *HandshakeError) Error() string {
+	return fmt.Sprintf("Handshake failed: %v", self.Err)
+}
+
+func (self *HandshakeError) Unwrap() error {
+	return self.Err
+}
+
+// Returns the SOCKS reply code best describing an error, e.g. one returned
+// by a dialer, or reported to the AccessLogger. Nil is ReplySuccess.
+func ReplyCodeFromError(err error) ReplyCode {
+	var dialErr *DialError
+	var policyErr *PolicyDeniedError
+	var addrErr net.InvalidAddrError
+	var netErr net.Error
+	var upstreamErr *UpstreamError
+	switch {
+	case err == nil:
+		return ReplySuccess
+	case errors.As(err, &dialErr):
+		return dialErr.ReplyCode
+	case errors.As(err, &policyErr):
+		return ReplyNotAllowed
+	case errors.As(err, &upstreamErr):
+		return upstreamErr.ReplyCode
+	case errors.Is(err, ErrorCommand):
+		return ReplyNotSupported
+	case errors.Is(err, ErrorAddress), errors.As(err, &addrErr):
+		return ReplyNotAddressable
+	case errors.Is(err, syscall.ECONNREFUSED):
+		return ReplyRefused
+	case errors.Is(err, syscall.ENETUNREACH):
+		return ReplyNetUnreachable
+	case errors.Is(err, syscall.EHOSTUNREACH):
+		return ReplyHostUnreachable
+	case errors.As(err, &netErr) && netErr.Timeout():
+		return ReplyTTL
+	}
+	return ReplyFailure
+}
+
+// vim: set noet ts=2 sw=2:
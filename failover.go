@@ -0,0 +1,199 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "context"
+import "errors"
+import "net"
+import "strings"
+import "sync"
+import "time"
+
+var ErrorUpstreamDown = errors.New("Upstream down")
+
+// What to do with sessions routed via Upstreams while the first hop is down,
+// see SessionOptions.Failover.
+type Failover int
+
+const (
+	FailoverFail      Failover = iota // Fail requests
+	FailoverDirect                    // Dial destinations directly
+	FailoverAlternate                 // Connect via SessionOptions.AlternateUpstreams
+)
+
+// UpstreamHealth configures the health checks of upstreams, i.e. dialing
+// the first hop of each chain in use every Interval, and connecting to each
+// upstream of a pool in use via the hops of the chain preceding it.
+// Upstreams go down after Fall consecutive failures, counting failures to
+// dial them for sessions too, and back up only after Rise consecutive
+// successful checks, so that sessions do not flap between routes.
+type UpstreamHealth struct {
+	Interval time.Duration
+	Timeout  time.Duration // Of each check
+	Fall     int
+	Rise     int
+}
+
+type upstreamState struct {
+	down   bool
+	streak int // Consecutive results contradicting the state
+}
+
+type upstreamHealth struct {
+	sync.Mutex
+	*UpstreamHealth
+	srv     *server
+	entries map[string]*upstreamState
+}
+
+func newUpstreamHealth(config *UpstreamHealth, srv *server) *upstreamHealth {
+	return &upstreamHealth{UpstreamHealth: config, srv: srv, entries: make(map[string]*upstreamState)}
+}
+
+// Returns the key of the health of the last hop of route, as reached via the
+// hops before it.
+func routeKey(route []Upstream) string {
+	addresses := make([]string, len(route))
+	for i, upstream := range route {
+		addresses[i] = upstream.Address
+	}
+	return strings.Join(addresses, " -> ")
+}
+
+// Returns whether the last hop of route is up, starting to check it if not
+// checked yet.
+func (self *upstreamHealth) up(route ...Upstream) bool {
+	key := routeKey(route)
+	self.Lock()
+	defer self.Unlock()
+	entry, ok := self.entries[key]
+	if !ok {
+		entry = &upstreamState{}
+		self.entries[key] = entry
+		go self.watch(key, route)
+	}
+	return !entry.down
+}
+
+// Records the result of a check of, or dialing, the route of key.
+func (self *upstreamHealth) report(key string, ok bool) {
+	self.Lock()
+	defer self.Unlock()
+	entry := self.entries[key]
+	if entry == nil || entry.down != ok {
+		if entry != nil {
+			entry.streak = 0
+		}
+		return
+	}
+	entry.streak++
+	switch {
+	case entry.down && entry.streak >= self.Rise:
+		self.srv.Printf("Upstream %v up", key)
+	case !entry.down && entry.streak >= self.Fall:
+		self.srv.Printf("Upstream %v down", key)
+	default:
+		return
+	}
+	entry.down, entry.streak = !entry.down, 0
+}
+
+func (self *upstreamHealth) watch(key string, route []Upstream) {
+	ticker := time.NewTicker(self.Interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+		case <-self.srv.closing:
+			return
+		}
+		conn, err := self.dial(route)
+		if err == nil {
+			conn.Close()
+		}
+		self.report(key, err == nil)
+	}
+}
+
+// Dials the first hop of route for a check, via the server Dialer, if any,
+// connecting through the hops to the last one.
+func (self *upstreamHealth) dial(route []Upstream) (net.Conn, error) {
+	ctx, cancel := context.WithTimeout(context.Background(), self.Timeout)
+	defer cancel()
+	var conn net.Conn
+	var err error
+	if self.srv.dialer == nil {
+		var dialer net.Dialer
+		conn, err = dialer.DialContext(ctx, "tcp", route[0].Address)
+	} else {
+		conn, err = self.srv.dialer.DialContext(ctx, "tcp", route[0].Address)
+	}
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(self.Timeout))
+	for i, upstream := range route[:len(route)-1] {
+		host, port, err := splitHostPort(route[i+1].Address)
+		if err == nil {
+			conn, err = upstream.connect(conn, host, port)
+		}
+		if err != nil {
+			conn.Close()
+			return nil, err
+		}
+	}
+	return conn, nil
+}
+
+// Reroutes sessions per opts.Failover while the first hop of opts.Upstreams
+// is down, failing the request if there is no route left.
+func (sock *sockConn) failover(opts *SessionOptions, host string, rips []net.IP, port int) {
+	health := sock.srv.health
+	first := opts.Upstreams[0]
+	if health.up(first) {
+		return
+	}
+	switch {
+	case opts.Failover == FailoverDirect:
+		sock.Printf("Upstream %v down, connecting directly", first)
+		opts.Upstreams = nil
+		opts.Tags = mergeTags(opts.Tags, map[string]string{"upstream": "direct"})
+		return
+
+	case opts.Failover == FailoverAlternate && len(opts.AlternateUpstreams) != 0:
+		if health.up(opts.AlternateUpstreams[0]) {
+			sock.Printf("Upstream %v down, connecting via %v", first, opts.AlternateUpstreams[0])
+			opts.Upstreams = opts.AlternateUpstreams
+			opts.Tags = mergeTags(opts.Tags, map[string]string{"upstream": opts.Upstreams[0].String()})
+			return
+		}
+	}
+	dest := host
+	if len(dest) == 0 {
+		dest = rips[0].String()
+	}
+	err := &DialError{ReplyFailure, joinHostPort(dest, port), &UpstreamError{first.String(), ReplyFailure, ErrorUpstreamDown}}
+	sock.logAccess(EventFailed, host, nil, port, err, "")
+	sock.writeError(ReplyFailure, err)
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,112 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "sync"
+import "time"
+
+// Clients count as active for this long after relaying data, see fairQueue.
+const fairActive = time.Second
+
+// Divides a rate fairly across the clients actively relaying in one
+// direction, so that a client's share does not grow with its connections.
+type fairQueue struct {
+	sync.Mutex
+	rate    int64
+	clients map[string]*fairClient
+}
+
+// The streams of a client in one direction, sharing its share of the rate.
+type fairClient struct {
+	sync.Mutex
+	queue  *fairQueue
+	key    string
+	refs   int
+	next   time.Time // When the client may read again
+	active time.Time // Last read, guarded by queue
+}
+
+func newFairQueue(rate int64) *fairQueue {
+	return &fairQueue{rate: rate, clients: make(map[string]*fairClient)}
+}
+
+// Adds a stream of the client identified by key.
+func (self *fairQueue) join(key string) *fairClient {
+	self.Lock()
+	defer self.Unlock()
+	client, ok := self.clients[key]
+	if !ok {
+		client = &fairClient{queue: self, key: key}
+		self.clients[key] = client
+	}
+	client.refs++
+	return client
+}
+
+// Removes a stream of client.
+func (self *fairQueue) leave(client *fairClient) {
+	self.Lock()
+	defer self.Unlock()
+	if client.refs--; client.refs == 0 {
+		delete(self.clients, client.key)
+	}
+}
+
+// Returns the share of each active client, marking client active first, if
+// not nil.
+func (self *fairQueue) share(client *fairClient) int64 {
+	now := time.Now()
+	self.Lock()
+	defer self.Unlock()
+	if client != nil {
+		client.active = now
+	}
+	var active int64
+	for _, other := range self.clients {
+		if now.Sub(other.active) < fairActive {
+			active++
+		}
+	}
+	return max(self.rate/max(active, 1), 1)
+}
+
+// Maximal number of bytes to read at once, avoiding bursts longer than
+// a tenth of a second at the current share.
+func (self *fairClient) chunk(size int) int {
+	return (&throttle{rate: self.queue.share(nil)}).chunk(size)
+}
+
+// Waits until the n bytes just read are within the share of the client.
+func (self *fairClient) wait(n int) {
+	rate := self.queue.share(self)
+	self.Lock()
+	now := time.Now()
+	if self.next.Before(now) {
+		self.next = now
+	}
+	self.next = self.next.Add(time.Duration(int64(n) * int64(time.Second) / rate))
+	delay := self.next.Sub(now)
+	self.Unlock()
+	time.Sleep(delay)
+}
+
+// vim: set noet ts=2 sw=2:
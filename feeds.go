@@ -0,0 +1,223 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "context"
+import "errors"
+import "fmt"
+import "net/http"
+import "sync"
+import "time"
+
+const (
+	feedInterval = time.Hour
+	feedTimeout  = time.Minute
+)
+
+// Well-known threat feeds.
+const (
+	FeedSpamhausDROP   = "https://www.spamhaus.org/drop/drop_v4.json"
+	FeedSpamhausDROPv6 = "https://www.spamhaus.org/drop/drop_v6.json"
+	FeedAbuseCHFeodo   = "https://feodotracker.abuse.ch/downloads/ipblocklist.txt"
+	FeedAbuseCHURLhaus = "https://urlhaus.abuse.ch/downloads/hostfile/"
+)
+
+var (
+	ErrorFeedTooSmall = errors.New("Feed has too few entries")
+	ErrorFeedInvalid  = errors.New("Feed has too many invalid entries")
+)
+
+// Feed to be fetched by a FeedFetcher, see ParseFeedList for the formats
+// supported.
+type Feed struct {
+	Name     string
+	URL      string
+	Interval time.Duration // Time between updates, an hour if zero
+
+	// Downloads with fewer entries are rejected as broken, keeping the
+	// previous list. At least one entry is required if zero.
+	MinEntries int
+}
+
+// Freshness of a Feed.
+type FeedStats struct {
+	Name     string
+	Updated  time.Time // Last time the feed was verified to be current
+	Modified time.Time // Last time the list got replaced
+	Entries  int
+	Failures uint64 // Failed updates
+	Err      error  // Error of the last update, if it failed
+}
+
+type feedState struct {
+	sync.Mutex // Guards stats
+	Feed
+	stats        FeedStats
+	updating     sync.Mutex // Serializes updates, guarding the fields below
+	etag         string
+	lastModified string
+}
+
+// FeedFetcher periodically downloads threat feeds, swapping them into a
+// Blocklist once verified. Failed downloads keep the previous list.
+type FeedFetcher struct {
+	Client *http.Client // http.DefaultClient if nil
+	Logger Logger       // Logs failed updates, if set
+
+	blocklist *Blocklist
+	feeds     []*feedState
+}
+
+// Creates a new FeedFetcher, updating blocklist from feeds.
+func NewFeedFetcher(blocklist *Blocklist, feeds ...Feed) *FeedFetcher {
+	rv := &FeedFetcher{blocklist: blocklist}
+	for _, feed := range feeds {
+		rv.feeds = append(rv.feeds, &feedState{Feed: feed, stats: FeedStats{Name: feed.Name}})
+	}
+	return rv
+}
+
+// Updates all feeds right away and then every Feed.Interval, until ctx is
+// done.
+func (self *FeedFetcher) Run(ctx context.Context) {
+	var wg sync.WaitGroup
+	for _, feed := range self.feeds {
+		wg.Add(1)
+		go func(feed *feedState) {
+			defer wg.Done()
+			interval := feed.Interval
+			if interval <= 0 {
+				interval = feedInterval
+			}
+			ticker := time.NewTicker(interval)
+			defer ticker.Stop()
+			for {
+				self.update(ctx, feed)
+				select {
+				case <-ticker.C:
+				case <-ctx.Done():
+					return
+				}
+			}
+		}(feed)
+	}
+	wg.Wait()
+}
+
+// Updates all feeds once, returning the errors of the ones that failed.
+func (self *FeedFetcher) Update(ctx context.Context) error {
+	var errs []error
+	for _, feed := range self.feeds {
+		if err := self.update(ctx, feed); err != nil {
+			errs = append(errs, fmt.Errorf("%s: %w", feed.Name, err))
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Returns the freshness of all feeds.
+func (self *FeedFetcher) Stats() []FeedStats {
+	rv := make([]FeedStats, len(self.feeds))
+	for i, feed := range self.feeds {
+		feed.Lock()
+		rv[i] = feed.stats
+		feed.Unlock()
+	}
+	return rv
+}
+
+func (self *FeedFetcher) update(ctx context.Context, feed *feedState) error {
+	feed.updating.Lock()
+	defer feed.updating.Unlock()
+	list, err := self.fetch(ctx, feed)
+	now := time.Now()
+	feed.Lock()
+	defer feed.Unlock()
+	switch {
+	case err != nil:
+		feed.stats.Failures++
+		if self.Logger != nil {
+			self.Logger.Printf("Failed to update feed %v: %v", feed.Name, err)
+		}
+	case list != nil:
+		self.blocklist.Set(feed.Name, list)
+		feed.stats.Modified = now
+		feed.stats.Entries = list.Len()
+		fallthrough
+	default:
+		feed.stats.Updated = now
+	}
+	feed.stats.Err = err
+	return err
+}
+
+// Downloads and verifies a feed, returning a nil list if not modified since
+// the previous download.
+func (self *FeedFetcher) fetch(ctx context.Context, feed *feedState) (*FeedList, error) {
+	ctx, cancel := context.WithTimeout(ctx, feedTimeout)
+	defer cancel()
+	req, err := http.NewRequestWithContext(ctx, "GET", feed.URL, nil)
+	if err != nil {
+		return nil, err
+	}
+	if len(feed.etag) != 0 {
+		req.Header.Set("If-None-Match", feed.etag)
+	}
+	if len(feed.lastModified) != 0 {
+		req.Header.Set("If-Modified-Since", feed.lastModified)
+	}
+	client := self.Client
+	if client == nil {
+		client = http.DefaultClient
+	}
+	resp, err := client.Do(req)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+	switch resp.StatusCode {
+	case http.StatusOK:
+	case http.StatusNotModified:
+		return nil, nil
+	default:
+		return nil, fmt.Errorf("HTTP status %v", resp.Status)
+	}
+	list, err := ParseFeedList(resp.Body)
+	if err != nil {
+		return nil, err
+	}
+	min := feed.MinEntries
+	if min <= 0 {
+		min = 1
+	}
+	if list.Len() < min {
+		return nil, ErrorFeedTooSmall
+	}
+	if list.Invalid() > list.Len() {
+		return nil, ErrorFeedInvalid
+	}
+	feed.etag = resp.Header.Get("ETag")
+	feed.lastModified = resp.Header.Get("Last-Modified")
+	return list, nil
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,92 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "fmt"
+import "net"
+import "strings"
+import "time"
+
+// Protocol quirks recorded in Fingerprints.
+const (
+	QuirkNoMethods        = "no-methods"        // Greeting offered no auth methods at all
+	QuirkDuplicateMethods = "duplicate-methods" // Greeting offered a method more than once
+	QuirkReservedSet      = "rsv-nonzero"       // Request has the reserved byte set
+	QuirkDomainLiteral    = "domain-literal"    // Request passed an IP as a domain name
+	QuirkDomainDot        = "domain-dot"        // Request passed a domain name with a trailing dot
+)
+
+// Fingerprint describes how a client performed the SOCKS handshake, helping
+// to tell client software apart and to spot abusive automation.
+type Fingerprint struct {
+	Methods  []byte        // Auth methods offered, in the order given
+	Quirks   []string      // Protocol deviations, see QuirkNoMethods and friends
+	Greeting time.Duration // Time from accepting to receiving the greeting
+	Request  time.Duration // Time from selecting the method to receiving the request
+
+	selected time.Time
+}
+
+// Formats the fingerprint compactly, e.g. "m=00,02 q=rsv-nonzero g=2.13ms r=812µs".
+func (self *Fingerprint) String() string {
+	methods := make([]string, len(self.Methods))
+	for i, method := range self.Methods {
+		methods[i] = fmt.Sprintf("%02x", method)
+	}
+	quirks := "-"
+	if len(self.Quirks) != 0 {
+		quirks = strings.Join(self.Quirks, ",")
+	}
+	return fmt.Sprintf("m=%s q=%s g=%v r=%v", strings.Join(methods, ","), quirks,
+		self.Greeting.Round(time.Microsecond), self.Request.Round(time.Microsecond))
+}
+
+func (self *Fingerprint) quirk(quirk string) {
+	self.Quirks = append(self.Quirks, quirk)
+}
+
+func (self *Fingerprint) greeting(methods []byte, since time.Time) {
+	self.Greeting = time.Since(since)
+	self.Methods = append([]byte(nil), methods...)
+	if len(methods) == 0 {
+		self.quirk(QuirkNoMethods)
+	}
+	var seen [256]bool
+	for _, method := range methods {
+		if seen[method] {
+			self.quirk(QuirkDuplicateMethods)
+			break
+		}
+		seen[method] = true
+	}
+}
+
+func (self *Fingerprint) domain(domain string) {
+	if net.ParseIP(strings.Trim(domain, "[]")) != nil {
+		self.quirk(QuirkDomainLiteral)
+	}
+	if strings.HasSuffix(domain, ".") {
+		self.quirk(QuirkDomainDot)
+	}
+}
+
+// vim: set noet ts=2 sw=2:
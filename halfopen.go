@@ -0,0 +1,117 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "net"
+import "sync/atomic"
+import "syscall"
+import "time"
+
+// Unanswered keepalive probes after which a peer is found dead, see
+// SessionOptions.Liveness.
+const livenessProbes = 3
+
+// Returns whether a relay error means the peer is gone, rather than having
+// closed the connection.
+// Peers not answering keepalive probes fail reading with ETIMEDOUT.
+func isDeadPeer(err error) bool {
+	return errors.Is(err, syscall.ECONNRESET) || errors.Is(err, syscall.ETIMEDOUT) || errors.Is(err, syscall.EPIPE)
+}
+
+// Enables keepalive probing of the peer after being idle for interval,
+// returning whether the connection supports it.
+func (sock *sockConn) probe(interval time.Duration) bool {
+	tc, ok := sock.conn.(*net.TCPConn)
+	if !ok {
+		return false
+	}
+	err := tc.SetKeepAliveConfig(net.KeepAliveConfig{Enable: true, Idle: interval, Interval: interval, Count: livenessProbes})
+	return err == nil
+}
+
+// Records why the session is ending, unless already known.
+func (sock *sockConn) closing(reason string) {
+	sock.closeReason.CompareAndSwap(nil, &reason)
+}
+
+// Returns why the session relayed with rsock ended, CloseDone if nothing
+// else was recorded.
+func (sock *sockConn) closeReasonWith(rsock *sockConn) string {
+	for _, s := range []*sockConn{sock, rsock} {
+		if reason := s.closeReason.Load(); reason != nil {
+			return *reason
+		}
+	}
+	return CloseDone
+}
+
+// Waits for both directions of a session to finish, closing the session
+// early once a peer is found dead, or once it went half-open for longer than
+// the half-open timeout.
+func (sock *sockConn) awaitRelay(rsock *sockConn, quit chan error) {
+	err := <-quit
+	if isDeadPeer(err) {
+		sock.Printf("Peer is gone, %v", err)
+		sock.closing(ClosePeerDead)
+		sock.reap(rsock, quit)
+		return
+	}
+	timeout := sock.srv.halfOpen
+	if timeout <= 0 {
+		<-quit
+		return
+	}
+	ticker := time.NewTicker(timeout)
+	defer ticker.Stop()
+	last := sock.relayed(rsock)
+	for {
+		select {
+		case <-quit:
+			return
+		case <-ticker.C:
+			if current := sock.relayed(rsock); current != last {
+				last = current
+				continue
+			}
+			sock.Printf("Half-open for %v", timeout)
+			sock.closing(CloseHalfOpen)
+			sock.reap(rsock, quit)
+			return
+		}
+	}
+}
+
+// Returns the bytes relayed in both directions so far.
+func (sock *sockConn) relayed(rsock *sockConn) uint64 {
+	return atomic.LoadUint64(&sock.transferred) + atomic.LoadUint64(&rsock.transferred)
+}
+
+// Closes a session, waiting for the remaining direction to finish.
+func (sock *sockConn) reap(rsock *sockConn, quit chan error) {
+	atomic.AddUint64(&sock.srv.stats.reaped, 1)
+	sock.conn.Close()
+	rsock.conn.Close()
+	<-quit
+}
+
+// vim: set noet ts=2 sw=2:
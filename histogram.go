@@ -0,0 +1,109 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "math"
+import "sync/atomic"
+
+var (
+	durationBounds = []float64{0.1, 0.5, 1, 5, 10, 30, 60, 300, 900, 3600}
+	latencyBounds  = []float64{0.001, 0.005, 0.01, 0.05, 0.1, 0.5, 1, 5}
+	lookupBounds   = []float64{0.0005, 0.001, 0.005, 0.01, 0.025, 0.05, 0.1, 0.25, 0.5, 1, 2.5, 5}
+	byteBounds     = []float64{1 << 10, 1 << 13, 1 << 16, 1 << 20, 1 << 23, 1 << 26, 1 << 30}
+)
+
+// Histogram of observations, such as session durations.
+type Histogram struct {
+	// Upper bounds (inclusive) of the buckets. Observations exceeding the last
+	// bound are counted in an additional, last bucket.
+	Bounds []float64
+	Counts []uint64 // Observations per bucket, one more than Bounds
+	Count  uint64   // Total number of observations
+	Sum    float64  // Sum of all observations
+}
+
+// Estimates the q-quantile (0 < q < 1) of the observations, interpolating
+// linearly within buckets. Observations beyond the last bound count as
+// being equal to it. Returns 0 without any observations.
+func (self Histogram) Quantile(q float64) float64 {
+	if self.Count == 0 || len(self.Bounds) == 0 {
+		return 0
+	}
+	rank := q * float64(self.Count)
+	var seen float64
+	for i, count := range self.Counts {
+		if i == len(self.Bounds) {
+			break
+		}
+		if count > 0 && seen+float64(count) >= rank {
+			lower := 0.0
+			if i > 0 {
+				lower = self.Bounds[i-1]
+			}
+			return lower + (self.Bounds[i]-lower)*(rank-seen)/float64(count)
+		}
+		seen += float64(count)
+	}
+	return self.Bounds[len(self.Bounds)-1]
+}
+
+type histogram struct {
+	bounds []float64
+	counts []uint64
+	count  uint64
+	sum    uint64 // float64 bits
+}
+
+func newHistogram(bounds []float64) *histogram {
+	return &histogram{bounds: bounds, counts: make([]uint64, len(bounds)+1)}
+}
+
+func (self *histogram) observe(value float64) {
+	i := 0
+	for i < len(self.bounds) && value > self.bounds[i] {
+		i++
+	}
+	atomic.AddUint64(&self.counts[i], 1)
+	atomic.AddUint64(&self.count, 1)
+	for {
+		old := atomic.LoadUint64(&self.sum)
+		sum := math.Float64bits(math.Float64frombits(old) + value)
+		if atomic.CompareAndSwapUint64(&self.sum, old, sum) {
+			return
+		}
+	}
+}
+
+func (self *histogram) snapshot() Histogram {
+	rv := Histogram{
+		Bounds: self.bounds,
+		Counts: make([]uint64, len(self.counts)),
+		Count:  atomic.LoadUint64(&self.count),
+		Sum:    math.Float64frombits(atomic.LoadUint64(&self.sum)),
+	}
+	for i := range self.counts {
+		rv.Counts[i] = atomic.LoadUint64(&self.counts[i])
+	}
+	return rv
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,123 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "encoding/json"
+import "io"
+import "net"
+import "sync"
+import "time"
+
+const (
+	defaultCaptureSize    = 4096
+	defaultCaptureTimeout = 10 * time.Second
+)
+
+// Honeypot configures capturing what clients send to denied destinations,
+// e.g. to study abuse attempts against an exposed server.
+// Instead of rejecting denied requests, the server pretends to have
+// connected, records the first bytes the client sends and closes the
+// connection afterwards.
+type Honeypot struct {
+	Size    int           // Bytes to capture at most, 4096 if zero
+	Timeout time.Duration // Time to wait for data, 10 seconds if zero
+	Logger  CaptureLogger
+}
+
+// Capture holds the data a client sent to a denied destination.
+type Capture struct {
+	Time   time.Time
+	Client *ClientInfo
+	Host   string // Requested domain, if any
+	Dest   net.IP // Destination IP, if already known
+	Port   int
+	Reason string // Policy that denied the request
+	Data   []byte
+}
+
+// CaptureLogger receives Honeypot captures.
+type CaptureLogger interface {
+	LogCapture(capture *Capture)
+}
+
+type jsonCaptureLogger struct {
+	sync.Mutex
+	enc *json.Encoder
+}
+
+// Creates a CaptureLogger writing one JSON object per capture to w, with the
+// data base64 encoded, e.g.:
+//
+//	{"time":"2013-10-01T12:34:56Z","client":"192.0.2.1:1234","host":"example.com","dest":"","port":25,"reason":"domain-rule","data":"RUhMTyB4DQo="}
+func NewJSONCaptureLogger(w io.Writer) CaptureLogger {
+	return &jsonCaptureLogger{enc: json.NewEncoder(w)}
+}
+
+func (self *jsonCaptureLogger) LogCapture(capture *Capture) {
+	dest := ""
+	if capture.Dest != nil {
+		dest = capture.Dest.String()
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.enc.Encode(struct {
+		Time   time.Time `json:"time"`
+		Client string    `json:"client"`
+		Host   string    `json:"host"`
+		Dest   string    `json:"dest"`
+		Port   int       `json:"port"`
+		Reason string    `json:"reason"`
+		Data   []byte    `json:"data"`
+	}{capture.Time, capture.Client.String(), capture.Host, dest, capture.Port, capture.Reason, capture.Data})
+}
+
+// Pretends to have connected and captures what the client sends.
+func (sock *sockConn) capture(host string, ip net.IP, port int, reason string) {
+	pot := sock.srv.honeypot
+	size, timeout := pot.Size, pot.Timeout
+	if size <= 0 {
+		size = defaultCaptureSize
+	}
+	if timeout <= 0 {
+		timeout = defaultCaptureTimeout
+	}
+	sock.writeAll([]byte{Version, byte(ReplySuccess), 0x0, byte(AddrIPv4), 0x0, 0x0, 0x0, 0x0, 0x0, 0x0})
+
+	data := make([]byte, size)
+	sock.conn.SetReadDeadline(time.Now().Add(timeout))
+	n, _ := io.ReadFull(sock.conn, data)
+	sock.Printf("Captured %d bytes", n)
+	if pot.Logger == nil {
+		return
+	}
+	pot.Logger.LogCapture(&Capture{
+		Time:   time.Now(),
+		Client: sock.info,
+		Host:   host,
+		Dest:   ip,
+		Port:   port,
+		Reason: reason,
+		Data:   data[:n],
+	})
+}
+
+// vim: set noet ts=2 sw=2:
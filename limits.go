@@ -0,0 +1,230 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "net"
+import "strconv"
+import "sync"
+import "sync/atomic"
+import "time"
+
+const (
+	defaultLimitsTTL = time.Hour
+	defaultDialWait  = 10 * time.Second
+)
+
+var (
+	ErrorRateLimit   = errors.New("Too many requests")
+	ErrorConcurrency = errors.New("Too many concurrent sessions")
+	ErrorDestination = errors.New("Too many connections to destination")
+	ErrorDialWait    = errors.New("Too many connections to destination in progress")
+)
+
+// Limits restricts the requests and sessions per identity, or per client IP
+// if not authenticated, enforced cluster-wide via the SharedStore of the
+// server, if any, falling back to enforcing them per server while the store
+// fails.
+type Limits struct {
+	Rate     int           // Requests per Interval, unlimited if zero
+	Interval time.Duration // Fixed window Rate applies to
+
+	// Concurrent sessions, unlimited if zero. Counts of instances going
+	// away without ending their sessions linger for at most TTL (an hour if
+	// zero), which should exceed the expected session duration.
+	Concurrent int
+	TTL        time.Duration
+
+	// New connections per destination host, or IP if requested by IP, of all
+	// clients, per DestinationInterval (a second if zero), unlimited if zero,
+	// so that the server cannot be used to hammer a single target. Requests
+	// exceeding it fail with a TTL expired reply.
+	DestinationRate     int
+	DestinationInterval time.Duration
+
+	// Dials in flight per destination host, or IP, of this server, unlimited
+	// if zero, smoothing thundering herds of clients reconnecting to a slow
+	// destination at once. Further requests wait for a dial to finish, for
+	// at most DestinationDialWait (10 seconds if zero), failing with a TTL
+	// expired reply after.
+	DestinationDials    int
+	DestinationDialWait time.Duration
+}
+
+// Returns the key identifying client in the shared state.
+func clientKey(client *ClientInfo) string {
+	if len(client.Identity) != 0 {
+		return "id:" + client.Identity
+	}
+	return client.IP.String()
+}
+
+// Adds delta to a counter in the shared store, or in the local one should
+// that fail, returning the new value and the store used.
+func (self *server) count(key string, delta int64, ttl time.Duration) (int64, SharedStore) {
+	if self.store != nil {
+		value, err := self.store.Incr(key, delta, ttl)
+		if err == nil {
+			return value, self.store
+		}
+		self.Printf("Failed to update shared counter %v: %v", key, err)
+	}
+	value, _ := self.local.Incr(key, delta, ttl)
+	return value, self.local
+}
+
+// Checks the limits of the client, denying the request if exceeded.
+// Otherwise counts the session towards the concurrency limit, until
+// sock.release gets called.
+func (sock *sockConn) enforceLimits(host string, ip net.IP, port int) {
+	limits := sock.srv.limits
+	key := clientKey(sock.info)
+	if limits.Rate > 0 && limits.Interval > 0 {
+		window := time.Now().UnixNano() / int64(limits.Interval)
+		count, _ := sock.srv.count("rate:"+key+":"+strconv.FormatInt(window, 10), 1, limits.Interval)
+		if count > int64(limits.Rate) {
+			sock.Printf("Rate limit of %v exceeded", sock.info)
+			sock.deny(host, ip, port, ErrorRateLimit, ReasonRateLimit)
+		}
+	}
+	if limits.Concurrent <= 0 {
+		return
+	}
+	ttl := limits.TTL
+	if ttl <= 0 {
+		ttl = defaultLimitsTTL
+	}
+	count, store := sock.srv.count("sessions:"+key, 1, ttl)
+	release := func() {
+		if _, err := store.Incr("sessions:"+key, -1, ttl); err != nil {
+			sock.Printf("Failed to update shared counter %v: %v", "sessions:"+key, err)
+		}
+	}
+	if count > int64(limits.Concurrent) {
+		release()
+		sock.Printf("Concurrency limit of %v exceeded", sock.info)
+		sock.deny(host, ip, port, ErrorConcurrency, ReasonConcurrency)
+	}
+	sock.release = release
+}
+
+// Fails the request to dest if exceeding the connection rate of the
+// destination.
+func (sock *sockConn) limitDestination(dest, host string, port int) {
+	limits := sock.srv.limits
+	interval := limits.DestinationInterval
+	if interval <= 0 {
+		interval = time.Second
+	}
+	window := time.Now().UnixNano() / int64(interval)
+	count, _ := sock.srv.count("dest:"+dest+":"+strconv.FormatInt(window, 10), 1, interval)
+	if count <= int64(limits.DestinationRate) {
+		return
+	}
+	sock.Printf("Connection rate of %v exceeded", dest)
+	atomic.AddUint64(&sock.srv.stats.throttled, 1)
+	err := &DialError{ReplyTTL, joinHostPort(dest, port), ErrorDestination}
+	sock.logAccess(EventFailed, host, nil, port, err, "")
+	sock.writeError(ReplyTTL, err)
+}
+
+// Semaphores limiting dials in flight, per destination.
+type dialSlots struct {
+	sync.Mutex
+	limit int
+	slots map[string]*dialSlot
+}
+
+type dialSlot struct {
+	sem   chan struct{}
+	users int // Dialing or waiting
+}
+
+func newDialSlots(limit int) *dialSlots {
+	return &dialSlots{limit: limit, slots: make(map[string]*dialSlot)}
+}
+
+// Waits for a slot to dial dest, for at most wait, returning whether
+// acquired.
+func (self *dialSlots) acquire(dest string, wait time.Duration) bool {
+	self.Lock()
+	slot, ok := self.slots[dest]
+	if !ok {
+		slot = &dialSlot{sem: make(chan struct{}, self.limit)}
+		self.slots[dest] = slot
+	}
+	slot.users++
+	self.Unlock()
+	select {
+	case slot.sem <- struct{}{}:
+		return true
+	default:
+	}
+	timer := time.NewTimer(wait)
+	defer timer.Stop()
+	select {
+	case slot.sem <- struct{}{}:
+		return true
+	case <-timer.C:
+		self.leave(dest, slot)
+		return false
+	}
+}
+
+// Releases the slot acquired to dial dest.
+func (self *dialSlots) release(dest string) {
+	self.Lock()
+	slot := self.slots[dest]
+	self.Unlock()
+	<-slot.sem
+	self.leave(dest, slot)
+}
+
+func (self *dialSlots) leave(dest string, slot *dialSlot) {
+	self.Lock()
+	defer self.Unlock()
+	if slot.users--; slot.users == 0 {
+		delete(self.slots, dest)
+	}
+}
+
+// Waits for a slot to dial dest, failing the request if none became
+// available in time. Returns a function releasing the slot.
+func (sock *sockConn) acquireDial(dest, host string, port int) func() {
+	wait := sock.srv.limits.DestinationDialWait
+	if wait <= 0 {
+		wait = defaultDialWait
+	}
+	if sock.srv.dials.acquire(dest, wait) {
+		return func() {
+			sock.srv.dials.release(dest)
+		}
+	}
+	sock.Printf("Waited %v for dialing %v", wait, dest)
+	atomic.AddUint64(&sock.srv.stats.dialWaits, 1)
+	err := &DialError{ReplyTTL, joinHostPort(dest, port), ErrorDialWait}
+	sock.logAccess(EventFailed, host, nil, port, err, "")
+	sock.writeError(ReplyTTL, err)
+	return nil
+}
+
+// vim: set noet ts=2 sw=2:
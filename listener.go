@@ -0,0 +1,194 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "context"
+import "errors"
+import "net"
+import "sync"
+import "sync/atomic"
+import "time"
+
+const (
+	minAcceptBackoff = 5 * time.Millisecond
+	maxAcceptBackoff = time.Second
+)
+
+type connChan chan *net.TCPConn
+
+// A single listening endpoint of a server, which may be stopped and started
+// again (see: Server.Stop(), Server.Continue()).
+type listener struct {
+	srv   *server
+	ip    net.IP
+	port  int
+	opts  SessionOptions
+	conns connChan
+	died  chan error
+
+	sync.Mutex
+	l        net.Listener
+	stopping chan struct{} // Closed by stop(), unblocking accept()
+	done     chan struct{}
+}
+
+func newListener(srv *server, ip net.IP, port int, opts SessionOptions) *listener {
+	return &listener{
+		srv:   srv,
+		ip:    NormalizeIP(ip),
+		port:  port,
+		opts:  opts,
+		conns: make(connChan, srv.backlog),
+		died:  make(chan error, 1),
+	}
+}
+
+// Starts listening and accepting, unless already doing so.
+func (self *listener) start() error {
+	self.Lock()
+	defer self.Unlock()
+	if self.l != nil {
+		return nil
+	}
+	proto := "tcp"
+	if self.ip.To4() == nil {
+		proto = "tcp6"
+	}
+	// Accepted sockets inherit the buffer sizes of the listening socket
+	opts := self.srv.sessionDefaults.Merge(&self.opts)
+	config := net.ListenConfig{KeepAlive: self.srv.keepAlive, Control: opts.controlListener}
+	config.SetMultipathTCP(self.srv.mptcpListen)
+	l, err := config.Listen(context.Background(), proto, joinHostPort(self.ip.String(), self.port))
+	if err != nil {
+		return err
+	}
+	self.l, self.stopping, self.done = l, make(chan struct{}), make(chan struct{})
+	go self.accept(l, self.stopping, self.done)
+	return nil
+}
+
+// Closes the listener, if any, and waits for the accept goroutine to finish.
+func (self *listener) stop() {
+	self.Lock()
+	defer self.Unlock()
+	if self.l == nil {
+		return
+	}
+	close(self.stopping)
+	self.l.Close()
+	<-self.done
+	self.l, self.stopping, self.done = nil, nil, nil
+}
+
+// Closes all connections accepted, but not yet served, returning the number
+// of connections closed.
+func (self *listener) drain() (closed int) {
+	for {
+		select {
+		case conn := <-self.conns:
+			atomic.AddInt64(&self.srv.stats.queueDepth, -1)
+			conn.Close()
+			closed++
+		default:
+			return
+		}
+	}
+}
+
+// Reports a fatal error to the serving loop, unless another one is pending.
+func (self *listener) fail(err error) {
+	select {
+	case self.died <- err:
+	default:
+	}
+}
+
+// Accepts connections until the listener gets closed or fails.
+// Transient errors are retried, backing off exponentially, while fatal errors
+// are reported to died. Waiting for a full queue ends once stopping closes,
+// as the serving loop may be the one stopping, not draining the queue.
+func (self *listener) accept(l net.Listener, stopping, done chan struct{}) {
+	defer close(done)
+
+	srv := self.srv
+	var backoff time.Duration
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			if errors.Is(err, net.ErrClosed) {
+				return
+			}
+			atomic.AddUint64(&srv.stats.acceptErrors, 1)
+			if ne, ok := err.(net.Error); ok && ne.Temporary() {
+				if backoff == 0 {
+					backoff = minAcceptBackoff
+				} else if backoff *= 2; backoff > maxAcceptBackoff {
+					backoff = maxAcceptBackoff
+				}
+				srv.Printf("Error while accepting: %v; retrying in %v", err, backoff)
+				select {
+				case <-time.After(backoff):
+				case <-stopping:
+					return
+				}
+				continue
+			}
+			srv.Printf("Listener failed: %v", err)
+			srv.report(&Report{Err: err, Context: "listener", Conn: l.Addr().String()})
+			l.Close()
+			self.fail(err)
+			return
+		}
+		backoff = 0
+		tconn, ok := conn.(*net.TCPConn)
+		if !ok {
+			srv.Print("Failed to accept; not tcp")
+			conn.Close()
+			continue
+		}
+		atomic.AddUint64(&srv.stats.accepted, 1)
+		srv.stats.acceptRate.add()
+		atomic.AddInt64(&srv.stats.queueDepth, 1)
+		select {
+		case self.conns <- tconn:
+		default:
+			atomic.AddUint64(&srv.stats.queueFull, 1)
+			if srv.dropOnFull {
+				atomic.AddInt64(&srv.stats.queueDepth, -1)
+				atomic.AddUint64(&srv.stats.dropped, 1)
+				srv.Printf("Accept queue full, dropping %v", tconn.RemoteAddr())
+				tconn.Close()
+				continue
+			}
+			srv.Print("Accept queue full")
+			select {
+			case self.conns <- tconn:
+			case <-stopping:
+				atomic.AddInt64(&srv.stats.queueDepth, -1)
+				tconn.Close()
+				return
+			}
+		}
+	}
+}
+
+// vim: set noet ts=2 sw=2:
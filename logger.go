@@ -34,6 +34,27 @@ var (
 	NullLogger = &nullLogger{}
 )
 
+// LogLevel of sessions, see SessionOptions.LogLevel.
+type LogLevel int
+
+const (
+	LogDefault LogLevel = iota // Log lines and access records as usual
+	LogQuiet                   // No log lines, nor access records of connected and closed sessions
+	LogAlert                   // Log lines flagged as alerts, including one per connection or denial
+)
+
+func (self LogLevel) String() string {
+	switch self {
+	case LogDefault:
+		return "default"
+	case LogQuiet:
+		return "quiet"
+	case LogAlert:
+		return "alert"
+	}
+	return "unknown"
+}
+
 // Logger implements a subset of log.Logger.
 // Different Loggers may specify different output destinations or formats.
 type Logger interface {
@@ -0,0 +1,267 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "context"
+import "errors"
+import "fmt"
+import "net"
+import "sort"
+import "sync"
+
+var (
+	ErrorUnknownServer   = errors.New("Unknown server")
+	ErrorDuplicateServer = errors.New("Duplicate server")
+)
+
+// Endpoint a managed server listens on.
+type Endpoint struct {
+	IP      net.IP
+	Port    int
+	Options SessionOptions // See: Server.ListenAndServeWithOptions()
+}
+
+type managedServer struct {
+	srv       Server
+	endpoints []Endpoint
+	started   bool
+}
+
+// Manager runs several named Servers, each with its own configuration and
+// endpoints, starting, stopping, reloading and reporting on them together.
+type Manager struct {
+	sync.Mutex
+	Logger
+	servers map[string]*managedServer
+}
+
+// Creates a new, empty Manager, logging to logger.
+func NewManager(logger Logger) *Manager {
+	return &Manager{Logger: logger, servers: make(map[string]*managedServer)}
+}
+
+// Adds a server, set up as desired, but not listening yet.
+// The server will listen on the endpoints once the Manager gets started.
+func (self *Manager) Add(name string, srv Server, endpoints ...Endpoint) error {
+	self.Lock()
+	defer self.Unlock()
+	if _, ok := self.servers[name]; ok {
+		return ErrorDuplicateServer
+	}
+	self.servers[name] = &managedServer{srv: srv, endpoints: endpoints}
+	return nil
+}
+
+// Starts all servers not started yet.
+// Returns the errors of all endpoints failing to listen, if any.
+func (self *Manager) Start() error {
+	self.Lock()
+	defer self.Unlock()
+	var errs []error
+	for _, name := range self.names() {
+		if err := self.start(name, self.servers[name]); err != nil {
+			errs = append(errs, err)
+		}
+	}
+	return errors.Join(errs...)
+}
+
+// Must be called with the manager locked.
+func (self *Manager) start(name string, managed *managedServer) error {
+	if managed.started {
+		return nil
+	}
+	managed.started = true
+	var errs []error
+	for _, endpoint := range managed.endpoints {
+		endpoint := endpoint
+		srv, ok := managed.srv.(*server)
+		if !ok {
+			go self.serve(name, func() error {
+				return managed.srv.ListenAndServeWithOptions(endpoint.IP, endpoint.Port, endpoint.Options)
+			})
+			continue
+		}
+		l, err := srv.listen(endpoint.IP, endpoint.Port, endpoint.Options)
+		if err != nil {
+			errs = append(errs, &ManagerError{name, endpoint, err})
+			continue
+		}
+		go self.serve(name, func() error {
+			return srv.serve(l)
+		})
+	}
+	return errors.Join(errs...)
+}
+
+func (self *Manager) serve(name string, serve func() error) {
+	if err := serve(); err != nil && err != ErrorServerClosed {
+		self.Printf("Server %s failed: %v", name, err)
+	}
+}
+
+// Stops all servers from accepting new connections.
+// See: Server.Stop()
+func (self *Manager) Stop() {
+	for _, srv := range self.snapshot() {
+		srv.Stop()
+	}
+}
+
+// Lets all servers accept new connections again.
+// See: Server.Continue()
+func (self *Manager) Continue() {
+	for _, srv := range self.snapshot() {
+		srv.Continue()
+	}
+}
+
+// Replaces a server by a new one, set up as desired, and starts it.
+// The old server stops accepting connections right away, but keeps serving
+// its current connections until these finish, or ctx is done.
+// Should the new server fail to listen, the old one continues instead.
+func (self *Manager) Reload(ctx context.Context, name string, srv Server, endpoints ...Endpoint) error {
+	self.Lock()
+	old, ok := self.servers[name]
+	if !ok {
+		self.Unlock()
+		return ErrorUnknownServer
+	}
+	old.srv.Stop()
+	managed := &managedServer{srv: srv, endpoints: endpoints}
+	if err := self.start(name, managed); err != nil {
+		srv.Shutdown(ctx)
+		old.srv.Continue()
+		self.Unlock()
+		return err
+	}
+	self.servers[name] = managed
+	self.Unlock()
+
+	go old.srv.Shutdown(ctx)
+	return nil
+}
+
+// Shuts down and removes a server.
+// See: Server.Shutdown()
+func (self *Manager) Remove(ctx context.Context, name string) error {
+	self.Lock()
+	managed, ok := self.servers[name]
+	delete(self.servers, name)
+	self.Unlock()
+	if !ok {
+		return ErrorUnknownServer
+	}
+	return managed.srv.Shutdown(ctx)
+}
+
+// Shuts down all servers, in parallel.
+// See: Server.Shutdown()
+func (self *Manager) Shutdown(ctx context.Context) error {
+	servers := self.snapshot()
+	errs := make([]error, len(servers))
+	var wg sync.WaitGroup
+	i := 0
+	for _, srv := range servers {
+		wg.Add(1)
+		go func(i int, srv Server) {
+			defer wg.Done()
+			errs[i] = srv.Shutdown(ctx)
+		}(i, srv)
+		i++
+	}
+	wg.Wait()
+	return errors.Join(errs...)
+}
+
+// Returns the server of the specified name, or nil.
+func (self *Manager) Server(name string) Server {
+	self.Lock()
+	defer self.Unlock()
+	if managed, ok := self.servers[name]; ok {
+		return managed.srv
+	}
+	return nil
+}
+
+// Returns the names of all servers, sorted.
+func (self *Manager) Names() []string {
+	self.Lock()
+	defer self.Unlock()
+	return self.names()
+}
+
+// Returns the statistics of all servers, by name.
+func (self *Manager) Stats() map[string]Stats {
+	rv := make(map[string]Stats)
+	for name, srv := range self.snapshot() {
+		rv[name] = srv.Stats()
+	}
+	return rv
+}
+
+// Returns the states of all servers, by name.
+func (self *Manager) States() map[string]ServerState {
+	rv := make(map[string]ServerState)
+	for name, srv := range self.snapshot() {
+		rv[name] = srv.State()
+	}
+	return rv
+}
+
+// Must be called with the manager locked.
+func (self *Manager) names() []string {
+	names := make([]string, 0, len(self.servers))
+	for name := range self.servers {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names
+}
+
+func (self *Manager) snapshot() map[string]Server {
+	self.Lock()
+	defer self.Unlock()
+	rv := make(map[string]Server, len(self.servers))
+	for name, managed := range self.servers {
+		rv[name] = managed.srv
+	}
+	return rv
+}
+
+// ManagerError reports an endpoint of a managed server failing to listen.
+type ManagerError struct {
+	Server   string
+	Endpoint Endpoint
+	Err      error
+}
+
+func (self *ManagerError) Error() string {
+	return fmt.Sprintf("Server %s failed to listen on %s: %v", self.Server,
+		joinHostPort(self.Endpoint.IP.String(), self.Endpoint.Port), self.Err)
+}
+
+func (self *ManagerError) Unwrap() error {
+	return self.Err
+}
+
+// vim: set noet ts=2 sw=2:
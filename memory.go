@@ -0,0 +1,136 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "net"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// Approximate memory a relaying session takes: the buffers of both
+// directions, the goroutines relaying them, and bookkeeping.
+const sessionMemory = 2*bufSize + 32<<10
+
+var (
+	ErrorMemory = errors.New("Memory budget exhausted")
+)
+
+// MemoryBudget bounds the approximate memory sessions take, so the server
+// degrades gracefully under load, by refusing requests, instead of running
+// out of memory.
+// See: Server.SetMemoryBudget()
+type MemoryBudget struct {
+	Bytes uint64 // Budget of all sessions combined
+
+	// If set, requests exceeding the budget additionally close the session
+	// idle longest, if idle for at least this long, making room for later
+	// requests.
+	ReapIdle time.Duration
+}
+
+// Usage of the MemoryBudget, see Stats.Memory.
+type MemoryStats struct {
+	Budget uint64 // Bytes
+	Used   uint64 // Bytes reserved by the sessions relaying
+	Shed   uint64 // Requests refused for exceeding the budget
+	Reaped uint64 // Idle sessions closed to make room
+}
+
+type memoryBudget struct {
+	*MemoryBudget
+	used  uint64
+	mu    sync.Mutex // Serializes reaping
+	shed  uint64
+	reaps uint64
+}
+
+func newMemoryBudget(config *MemoryBudget) *memoryBudget {
+	return &memoryBudget{MemoryBudget: config}
+}
+
+// Reserves n bytes, returning whether they fit into the budget.
+func (self *memoryBudget) reserve(n uint64) bool {
+	for {
+		used := atomic.LoadUint64(&self.used)
+		if used+n > self.Bytes {
+			return false
+		}
+		if atomic.CompareAndSwapUint64(&self.used, used, used+n) {
+			return true
+		}
+	}
+}
+
+func (self *memoryBudget) release(n uint64) {
+	atomic.AddUint64(&self.used, -n)
+}
+
+// Closes the session idle longest, if idle for at least ReapIdle.
+func (self *memoryBudget) reap(sessions *sessionSet) {
+	if self.ReapIdle <= 0 || !self.mu.TryLock() {
+		return
+	}
+	defer self.mu.Unlock()
+	var idlest, ridlest *sockConn
+	var since int64
+	sessions.Lock()
+	for sock, rsock := range sessions.socks {
+		if rsock == nil || sock.activity == nil {
+			continue
+		}
+		if activity := atomic.LoadInt64(sock.activity); idlest == nil || activity < since {
+			idlest, ridlest, since = sock, rsock, activity
+		}
+	}
+	sessions.Unlock()
+	if idlest == nil || time.Since(time.Unix(0, since)) < self.ReapIdle {
+		return
+	}
+	idlest.Printf("Closing, as idle longest while over the memory budget")
+	atomic.AddUint64(&self.reaps, 1)
+	idlest.closing(CloseMemory)
+	idlest.conn.Close()
+	ridlest.conn.Close()
+}
+
+// Reserves the memory of a session about to connect, failing the request
+// if over the budget.
+func (sock *sockConn) reserveMemory(host string, rip net.IP, port int) {
+	budget := sock.srv.memory
+	if budget.reserve(sessionMemory) {
+		sock.reserved = sessionMemory
+		return
+	}
+	atomic.AddUint64(&budget.shed, 1)
+	budget.reap(sock.srv.sessions)
+	dest := host
+	if len(dest) == 0 {
+		dest = rip.String()
+	}
+	sock.Printf("Memory budget of %d bytes exhausted", budget.Bytes)
+	err := &DialError{ReplyFailure, joinHostPort(dest, port), ErrorMemory}
+	sock.logAccess(EventFailed, host, rip, port, err, "")
+	sock.writeError(ReplyFailure, err)
+}
+
+// vim: set noet ts=2 sw=2:
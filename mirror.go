@@ -0,0 +1,133 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "io"
+import "net"
+import "sync"
+import "sync/atomic"
+
+const (
+	mirrorQueue    = 256
+	mirrorDatagram = 1400
+)
+
+// Which directions of a session get mirrored.
+type MirrorDirection int
+
+const (
+	MirrorUpstream   MirrorDirection = 1 << iota // Client to destination
+	MirrorDownstream                             // Destination to client
+
+	MirrorBoth = MirrorUpstream | MirrorDownstream
+)
+
+// Mirror copies relayed data to a secondary sink, e.g. for debugging or an
+// IDS. Attach it to sessions via SessionOptions.
+//
+// Data is queued and written asynchronously, so a slow sink never stalls
+// relaying; data not fitting into the queue is dropped instead.
+// Data of concurrent sessions sharing a Mirror is interleaved.
+type Mirror struct {
+	sync.RWMutex
+	directions MirrorDirection
+	sink       io.Writer
+	chunk      int
+	queue      chan []byte
+	closed     bool
+	dropped    uint64
+}
+
+// Creates a new Mirror writing to sink.
+func NewMirror(sink io.Writer, directions MirrorDirection) *Mirror {
+	rv := &Mirror{
+		directions: directions,
+		sink:       sink,
+		queue:      make(chan []byte, mirrorQueue),
+	}
+	if _, ok := sink.(net.PacketConn); ok {
+		rv.chunk = mirrorDatagram
+	}
+	go rv.run()
+	return rv
+}
+
+// Creates a new Mirror sending to a remote endpoint, e.g.
+// DialMirror("udp", "192.0.2.1:4789", MirrorBoth).
+// Data sent via UDP is split into datagrams of at most 1400 bytes.
+func DialMirror(network, address string, directions MirrorDirection) (*Mirror, error) {
+	conn, err := net.Dial(network, address)
+	if err != nil {
+		return nil, err
+	}
+	return NewMirror(conn, directions), nil
+}
+
+// Returns the number of bytes dropped so far, because the sink did not keep up.
+func (self *Mirror) Dropped() uint64 {
+	return atomic.LoadUint64(&self.dropped)
+}
+
+// Stops mirroring, closing the sink if it is an io.Closer.
+func (self *Mirror) Close() error {
+	self.Lock()
+	defer self.Unlock()
+	if self.closed {
+		return nil
+	}
+	self.closed = true
+	close(self.queue)
+	return nil
+}
+
+func (self *Mirror) copy(data []byte) {
+	self.RLock()
+	defer self.RUnlock()
+	if self.closed {
+		return
+	}
+	select {
+	case self.queue <- append([]byte(nil), data...):
+	default:
+		atomic.AddUint64(&self.dropped, uint64(len(data)))
+	}
+}
+
+func (self *Mirror) run() {
+	for data := range self.queue {
+		for len(data) > 0 {
+			n := len(data)
+			if self.chunk > 0 && n > self.chunk {
+				n = self.chunk
+			}
+			if _, err := self.sink.Write(data[:n]); err != nil {
+				break
+			}
+			data = data[n:]
+		}
+	}
+	if closer, ok := self.sink.(io.Closer); ok {
+		closer.Close()
+	}
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,387 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "fmt"
+import "net"
+import "sync/atomic"
+import "syscall"
+import "time"
+
+var (
+	ErrorSocketOption = errors.New("Socket option not supported on this platform")
+)
+
+// SessionOptions tune how a single connection gets relayed.
+// Zero values leave the server defaults in place.
+type SessionOptions struct {
+	IdleTimeout time.Duration // Close when nothing got relayed in either direction for this long
+	MaxDuration time.Duration // Close when relaying for this long
+	MaxBytes    uint64        // Close when this many bytes got relayed, in both directions combined
+	Bandwidth   string        // Class limiting each direction, see Server.SetBandwidthClass()
+	Mirror      *Mirror       // Copy relayed data here
+	RelayEngine RelayEngine   // Relays the session, see Server.SetRelayEngine()
+
+	// Close when the client sent nothing for this long, and when the
+	// destination sent nothing for this long, respectively, regardless of
+	// the other direction, e.g. to allow long silent downloads, but not idle
+	// uploads. Apply besides IdleTimeout.
+	IdleTimeoutUp   time.Duration
+	IdleTimeoutDown time.Duration
+
+	// Probe both peers with TCP keepalives once idle for this long, one probe
+	// per interval, finding peers dead after livenessProbes unanswered
+	// probes. While probing, sessions outlive IdleTimeout as long as both
+	// peers are alive, and sessions ending due to dead peers get logged as
+	// such (ClosePeerDead).
+	Liveness time.Duration
+
+	// Observe the TLS handshake of sessions passively, reporting fingerprints,
+	// version and server certificate via AccessRecord.TLS. Sessions observed
+	// do not get spliced, see SpliceEngine.
+	ObserveTLS bool
+
+	// Firewall mark of outgoing connections (Linux only), e.g. to route them
+	// via another routing table, given a rule like:
+	//	ip rule add fwmark 0x10 table vpn
+	// Setting marks requires CAP_NET_ADMIN.
+	Mark int
+
+	// Network device, such as a VRF, outgoing connections get bound to
+	// (Linux only). Binding requires CAP_NET_RAW.
+	Device string
+
+	// Socket receive and send buffer sizes (SO_RCVBUF, SO_SNDBUF) of both the
+	// client and the destination connection, in bytes, e.g. to allow larger
+	// TCP windows on links with a high bandwidth-delay product. Linux caps
+	// these at net.core.rmem_max and wmem_max, respectively.
+	// TCP negotiates the window scale during the handshake, so sizes only
+	// fully apply when set beforehand: on Linux, destination connections get
+	// them before connecting, unless dialed by a custom Dialer, and client
+	// connections inherit the ones of the server and listener options from
+	// the listening socket. Sizes set by rules, and on other systems, only
+	// get applied once connected, limited to the window scale negotiated.
+	RecvBuffer int
+	SendBuffer int
+
+	// Chain of proxies to connect through, the first one getting dialed
+	// directly, each one connecting to the next, the last one to the
+	// destination. Destinations requested by domain get resolved by the last
+	// hop only, so the IP checks of the Ruler, RebindProtection and DNS
+	// pinning do not apply to them; DomainRuler checks still do. Access
+	// records see the first hop as destination IP.
+	Upstreams []Upstream
+
+	// Dials destinations, or the first hop of Upstreams, instead of the
+	// Server.SetDialer() one, e.g. to route some rules through a userspace
+	// WireGuard tunnel.
+	Dialer Dialer
+
+	// Upstreams to pick the last hop of Upstreams from per session, e.g. to
+	// balance sessions across egress IPs, or to keep the ones of a client
+	// exiting from the same IP.
+	UpstreamPool []Upstream
+	Balance      Balance
+
+	// Derive distinct upstream credentials per client or identity, so that
+	// upstreams cannot correlate the sessions of different clients.
+	Isolation Isolation
+
+	// Route of sessions while the first hop of Upstreams is down, as told by
+	// health checks, see Server.SetUpstreamHealth(), and the chain to use
+	// instead with FailoverAlternate.
+	Failover           Failover
+	AlternateUpstreams []Upstream
+
+	// Verbosity of sessions, e.g. LogQuiet for high-volume benign
+	// destinations, or LogAlert for the interesting ones. Unlike the other
+	// options, these also apply to requests a SessionRuler's rule denies.
+	LogLevel LogLevel
+	LogTag   string // Added to log lines and access records, e.g. naming the rule
+
+	// Key/value metadata of the session, e.g. a customer ID or policy name,
+	// added to log lines, access records, Server.Sessions() and, for the keys
+	// given to Server.SetMetricTags(), metrics. Merged by key, adding to the
+	// tags of the ClientInfo. Sessions via upstreams get tagged "upstream".
+	Tags map[string]string
+}
+
+// Returns a copy of self, with the non-zero fields of other taking precedence.
+func (self SessionOptions) Merge(other *SessionOptions) SessionOptions {
+	if other == nil {
+		return self
+	}
+	if other.IdleTimeout != 0 {
+		self.IdleTimeout = other.IdleTimeout
+	}
+	if other.IdleTimeoutUp != 0 {
+		self.IdleTimeoutUp = other.IdleTimeoutUp
+	}
+	if other.IdleTimeoutDown != 0 {
+		self.IdleTimeoutDown = other.IdleTimeoutDown
+	}
+	if other.Liveness != 0 {
+		self.Liveness = other.Liveness
+	}
+	if other.MaxDuration != 0 {
+		self.MaxDuration = other.MaxDuration
+	}
+	if other.MaxBytes != 0 {
+		self.MaxBytes = other.MaxBytes
+	}
+	if len(other.Bandwidth) != 0 {
+		self.Bandwidth = other.Bandwidth
+	}
+	if other.Mirror != nil {
+		self.Mirror = other.Mirror
+	}
+	if other.RelayEngine != nil {
+		self.RelayEngine = other.RelayEngine
+	}
+	if other.ObserveTLS {
+		self.ObserveTLS = true
+	}
+	if other.Dialer != nil {
+		self.Dialer = other.Dialer
+	}
+	if other.Mark != 0 {
+		self.Mark = other.Mark
+	}
+	if other.RecvBuffer != 0 {
+		self.RecvBuffer = other.RecvBuffer
+	}
+	if other.SendBuffer != 0 {
+		self.SendBuffer = other.SendBuffer
+	}
+	if len(other.Device) != 0 {
+		self.Device = other.Device
+	}
+	if len(other.Upstreams) != 0 {
+		self.Upstreams = other.Upstreams
+	}
+	if len(other.UpstreamPool) != 0 {
+		self.UpstreamPool = other.UpstreamPool
+	}
+	if other.Balance != BalanceRoundRobin {
+		self.Balance = other.Balance
+	}
+	if other.Isolation != IsolationNone {
+		self.Isolation = other.Isolation
+	}
+	if other.Failover != FailoverFail {
+		self.Failover = other.Failover
+	}
+	if len(other.AlternateUpstreams) != 0 {
+		self.AlternateUpstreams = other.AlternateUpstreams
+	}
+	if other.LogLevel != LogDefault {
+		self.LogLevel = other.LogLevel
+	}
+	if len(other.LogTag) != 0 {
+		self.LogTag = other.LogTag
+	}
+	self.Tags = mergeTags(self.Tags, other.Tags)
+	return self
+}
+
+// SessionRuler may additionally be implemented by a Ruler, to attach options
+// to connections it allowed, e.g. long timeouts for known backup jobs.
+type SessionRuler interface {
+	// Returns the options for a connection about to be made to one of the ips,
+	// or nil to keep the defaults. Host is empty for requests by IP.
+	SessionOptions(client *ClientInfo, host string, ips []net.IP, port int) *SessionOptions
+}
+
+// Control function for net.Dialer, applying the socket level options.
+func (self *SessionOptions) control(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = applySocketOptions(fd, self)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Applies the socket buffer sizes to a listening socket.
+func (self *SessionOptions) controlListener(network, address string, c syscall.RawConn) error {
+	var err error
+	if cerr := c.Control(func(fd uintptr) {
+		err = applyBufferOptions(fd, self)
+	}); cerr != nil {
+		return cerr
+	}
+	return err
+}
+
+// Limits a stream to rate bytes per second.
+type throttle struct {
+	rate int64
+	next time.Time
+}
+
+func newThrottle(rate int64) *throttle {
+	if rate <= 0 {
+		return nil
+	}
+	return &throttle{rate: rate}
+}
+
+// Maximal number of bytes to read at once, avoiding bursts longer than
+// a tenth of a second.
+func (self *throttle) chunk(size int) int {
+	if max := self.rate / 10; int64(size) > max {
+		if max < 1 {
+			return 1
+		}
+		return int(max)
+	}
+	return size
+}
+
+// Waits until the n bytes just read are within the rate.
+func (self *throttle) wait(n int) {
+	now := time.Now()
+	if self.next.Before(now) {
+		self.next = now
+	}
+	self.next = self.next.Add(time.Duration(int64(n) * int64(time.Second) / self.rate))
+	time.Sleep(self.next.Sub(now))
+}
+
+// Applies the options of a connected client to it and its remote side.
+// Returns a function releasing resources once relaying is done.
+func (sock *sockConn) applyOptions(rsock *sockConn) func() {
+	opts := sock.opts
+	activity := time.Now().UnixNano()
+	sock.activity, rsock.activity = &activity, &activity
+	if opts.IdleTimeout > 0 {
+		sock.idle, rsock.idle = opts.IdleTimeout, opts.IdleTimeout
+	}
+	sock.maxBytes, rsock.maxBytes = opts.MaxBytes, opts.MaxBytes
+	now := time.Now().UnixNano()
+	if opts.IdleTimeoutUp > 0 {
+		sock.readIdle, sock.lastRead = opts.IdleTimeoutUp, now
+	}
+	if opts.IdleTimeoutDown > 0 {
+		rsock.readIdle, rsock.lastRead = opts.IdleTimeoutDown, now
+	}
+	sock.engine = sock.srv.relayEngine
+	if opts.RelayEngine != nil {
+		sock.engine = opts.RelayEngine
+	}
+	rsock.engine = sock.engine
+	if opts.ObserveTLS {
+		sock.tls = newTLSObserver()
+		rsock.tls = sock.tls
+	}
+	if opts.RecvBuffer > 0 || opts.SendBuffer > 0 {
+		// Again, for sizes set by rules, custom Dialers and other systems
+		sock.setBuffers(opts)
+		rsock.setBuffers(opts)
+	}
+	if opts.Liveness > 0 {
+		probing := sock.probe(opts.Liveness) && rsock.probe(opts.Liveness)
+		sock.probing, rsock.probing = probing, probing
+	}
+	if len(opts.Bandwidth) != 0 {
+		if rate, ok := sock.srv.bandwidth[opts.Bandwidth]; ok {
+			sock.throttle, rsock.throttle = newThrottle(rate), newThrottle(rate)
+		} else {
+			sock.Printf("Unknown bandwidth class %v", opts.Bandwidth)
+		}
+	}
+	if m := opts.Mirror; m != nil {
+		if m.directions&MirrorUpstream != 0 {
+			sock.mirror = m
+		}
+		if m.directions&MirrorDownstream != 0 {
+			rsock.mirror = m
+		}
+	}
+	var releases []func()
+	if fair := sock.srv.fair; fair != nil {
+		key := clientKey(sock.info)
+		sock.fair, rsock.fair = fair[0].join(key), fair[1].join(key)
+		releases = append(releases, func() {
+			fair[0].leave(sock.fair)
+			fair[1].leave(rsock.fair)
+		})
+	}
+	if opts.MaxDuration > 0 {
+		timer := time.AfterFunc(opts.MaxDuration, func() {
+			sock.Printf("Maximum duration of %v reached", opts.MaxDuration)
+			sock.closing(CloseMaxDuration)
+			sock.conn.Close()
+			rsock.conn.Close()
+		})
+		releases = append(releases, func() {
+			timer.Stop()
+		})
+	}
+	return func() {
+		for _, release := range releases {
+			release()
+		}
+	}
+}
+
+// Applies the LogLevel and LogTag of opts to the log lines of sock, once the
+// request is known.
+func (sock *sockConn) applyLogging(opts *SessionOptions) {
+	if len(opts.LogTag) != 0 {
+		sock.prefix = fmt.Sprintf("%s (%s)", sock.prefix, opts.LogTag)
+	}
+	if len(opts.Tags) != 0 {
+		sock.prefix = fmt.Sprintf("%s {%s}", sock.prefix, formatTags(opts.Tags))
+	}
+	switch opts.LogLevel {
+	case LogQuiet:
+		sock.prefixLogger.Logger = NullLogger
+	case LogAlert:
+		sock.prefix = "ALERT " + sock.prefix
+	}
+}
+
+func (sock *sockConn) touch() {
+	if sock.activity != nil {
+		atomic.StoreInt64(sock.activity, time.Now().UnixNano())
+	}
+}
+
+// Whether nothing got read for the idle timeout of this direction.
+func (sock *sockConn) readIdleExpired() bool {
+	if sock.readIdle <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(&sock.lastRead))) >= sock.readIdle
+}
+
+func (sock *sockConn) idleExpired() bool {
+	if sock.activity == nil || sock.idle <= 0 {
+		return false
+	}
+	return time.Since(time.Unix(0, atomic.LoadInt64(sock.activity))) >= sock.idle
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,153 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "fmt"
+import "net"
+import "net/http"
+import "sort"
+import "strconv"
+import "strings"
+
+// PAC generates a proxy auto-config file, advertising a server to clients,
+// e.g. browsers on a LAN. It implements http.Handler, serving the file:
+//
+//	pac := &gosocksv5d.PAC{Port: 1080}
+//	pac.AddDenied(rules)
+//	http.ListenAndServe(":8080", pac)
+type PAC struct {
+	// Address clients reach the server at, host:port. If empty, the host
+	// the PAC file got requested from, with Port.
+	Proxy string
+	Port  int
+
+	// Domain patterns clients connect to directly, as understood by
+	// RuleSet.Add(), i.e. "example.com", "*.example.com" or ".example.com",
+	// or globs, as understood by RuleSet.AddGlob().
+	Direct []string
+
+	// IPv4 networks clients connect to directly.
+	DirectNetworks []*net.IPNet
+
+	// Connect directly when the server is unreachable.
+	Fallback bool
+}
+
+// Adds the domains denied by the domain and glob rules of rules to Direct,
+// as these are not reachable through the server anyway. If rules fall back
+// to DefaultRuler, loopback and the subnets of all network interfaces are
+// added to DirectNetworks, likewise.
+// Regular expression rules have no equivalent in PAC files, and are ignored.
+func (self *PAC) AddDenied(rules *RuleSet) {
+	var direct []string
+	for _, rule := range rules.exact {
+		if rule.result == DenyConnection {
+			direct = append(direct, rule.pattern)
+		}
+	}
+	for _, rule := range rules.wildcard {
+		if rule.result == DenyConnection {
+			direct = append(direct, rule.pattern)
+		}
+	}
+	for _, rule := range rules.suffix {
+		if rule.result == DenyConnection {
+			direct = append(direct, rule.pattern)
+		}
+	}
+	sort.Strings(direct)
+	for _, rule := range rules.patterns {
+		if rule.glob && rule.result == DenyConnection {
+			direct = append(direct, rule.pattern)
+		}
+	}
+	self.Direct = append(self.Direct, direct...)
+
+	if rules.fallback != DefaultRuler {
+		return
+	}
+	self.DirectNetworks = append(self.DirectNetworks, &net.IPNet{IP: net.IPv4(127, 0, 0, 0), Mask: net.CIDRMask(8, 32)})
+	addrs, _ := net.InterfaceAddrs()
+	for _, addr := range addrs {
+		if ipn, ok := addr.(*net.IPNet); ok && ipn.IP.To4() != nil && !ipn.IP.IsLoopback() {
+			self.DirectNetworks = append(self.DirectNetworks, &net.IPNet{IP: ipn.IP.Mask(ipn.Mask), Mask: ipn.Mask})
+		}
+	}
+}
+
+// Returns the PAC file, advertising proxy (host:port).
+func (self *PAC) Script(proxy string) string {
+	var b strings.Builder
+	b.WriteString("function FindProxyForURL(url, host) {\n")
+	b.WriteString("\tif (isPlainHostName(host)) {\n\t\treturn \"DIRECT\";\n\t}\n")
+	for _, pattern := range self.Direct {
+		var cond string
+		switch {
+		case strings.HasPrefix(pattern, "*."):
+			cond = fmt.Sprintf("dnsDomainIs(host, %s)", strconv.Quote(pattern[1:]))
+		case strings.HasPrefix(pattern, "."):
+			cond = fmt.Sprintf("host == %s || dnsDomainIs(host, %s)", strconv.Quote(pattern[1:]), strconv.Quote(pattern))
+		case strings.ContainsAny(pattern, "*?["):
+			cond = fmt.Sprintf("shExpMatch(host, %s)", strconv.Quote(pattern))
+		default:
+			cond = fmt.Sprintf("host == %s", strconv.Quote(pattern))
+		}
+		fmt.Fprintf(&b, "\tif (%s) {\n\t\treturn \"DIRECT\";\n\t}\n", cond)
+	}
+	if len(self.DirectNetworks) != 0 {
+		// Resolving once, instead of once per isInNet(host, ...)
+		b.WriteString("\tvar ip = dnsResolve(host);\n")
+	}
+	for _, network := range self.DirectNetworks {
+		ip := network.IP.To4()
+		mask := network.Mask
+		if len(mask) == net.IPv6len {
+			mask = mask[12:]
+		}
+		if ip == nil || len(mask) != net.IPv4len {
+			continue
+		}
+		fmt.Fprintf(&b, "\tif (ip && isInNet(ip, %q, %q)) {\n\t\treturn \"DIRECT\";\n\t}\n", ip.String(), net.IP(mask).String())
+	}
+	result := fmt.Sprintf("SOCKS5 %s; SOCKS %s", proxy, proxy)
+	if self.Fallback {
+		result += "; DIRECT"
+	}
+	fmt.Fprintf(&b, "\treturn %s;\n}\n", strconv.Quote(result))
+	return b.String()
+}
+
+func (self *PAC) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	proxy := self.Proxy
+	if len(proxy) == 0 {
+		host, _, err := net.SplitHostPort(r.Host)
+		if err != nil {
+			host = strings.Trim(r.Host, "[]")
+		}
+		proxy = joinHostPort(host, self.Port)
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, self.Script(proxy))
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,143 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "bytes"
+import "errors"
+import "sync/atomic"
+import "time"
+
+// Protocols clients are expected to speak, see ProtocolEnforcement.
+type Protocol string
+
+const (
+	ProtocolTLS  Protocol = "tls"  // TLS ClientHello
+	ProtocolSSH  Protocol = "ssh"  // SSH identification string, which servers may send first
+	ProtocolHTTP Protocol = "http" // HTTP/1.x request line
+)
+
+// ProtocolEnforcement configures checking that the first bytes clients send
+// match the protocol expected for the destination port, e.g. to catch
+// tunneling through a policy only allowing well-known ports.
+// Clients not sending anything in time count as mismatches, except for SSH,
+// whose clients may wait for the identification string of the server, which
+// does not get relayed while checking, so that these clients get waited for
+// briefly only, and pass.
+// Checking happens once connected to the destination, before relaying, i.e.
+// sessions closed for a mismatch did reach the destination, but without any
+// data of the client.
+type ProtocolEnforcement struct {
+	Ports    map[int]Protocol // Expected protocols by destination port, see DefaultProtocolPorts
+	FlagOnly bool             // Only log and count mismatches, instead of closing the session
+}
+
+var (
+	ErrorProtocolMismatch = errors.New("Client does not speak the expected protocol")
+
+	// Ports of the well-known protocols.
+	DefaultProtocolPorts = map[int]Protocol{
+		22:  ProtocolSSH,
+		80:  ProtocolHTTP,
+		443: ProtocolTLS,
+		465: ProtocolTLS,
+		993: ProtocolTLS,
+		995: ProtocolTLS,
+	}
+)
+
+// Servers of SSH may speak first, see ProtocolEnforcement.
+const serverFirstTimeout = 500 * time.Millisecond
+
+// Returns whether servers may speak first, so that clients sending nothing
+// are inconclusive.
+func (self Protocol) serverFirst() bool {
+	return self == ProtocolSSH
+}
+
+// Returns whether data starts like protocol, and whether that could be
+// decided yet. Incomplete data never matches.
+func matchProtocol(protocol Protocol, data []byte) (match bool, complete bool) {
+	switch protocol {
+	case ProtocolTLS:
+		// Handshake record of TLS 1.x (or SSL 3), holding a ClientHello
+		if len(data) < 6 {
+			return false, false
+		}
+		return data[0] == 0x16 && data[1] == 0x3 && data[5] == 0x1, true
+
+	case ProtocolSSH:
+		if len(data) < 4 {
+			return false, false
+		}
+		return bytes.HasPrefix(data, []byte("SSH-")), true
+
+	case ProtocolHTTP:
+		// Method token, i.e. upper case letters, followed by a space
+		for i, c := range data {
+			switch {
+			case c == ' ':
+				return i > 0, true
+			case c < 'A' || c > 'Z' || i >= 16:
+				return false, true
+			}
+		}
+		return false, false
+	}
+	return true, true
+}
+
+// Checks the client speaks the protocol expected for the destination port,
+// if any, closing the session if not, unless only flagging mismatches.
+func (sock *sockConn) enforceProtocol() {
+	protocol, ok := sock.srv.protocols.Ports[sock.port]
+	if !ok {
+		return
+	}
+	timeout := sniffTimeout
+	if protocol.serverFirst() {
+		timeout = serverFirstTimeout
+	}
+	var match bool
+	data := sock.peek(timeout, func(data []byte) (complete bool) {
+		match, complete = matchProtocol(protocol, data)
+		return
+	})
+	if match {
+		return
+	}
+	if len(data) == 0 && protocol.serverFirst() {
+		sock.Printf("Not checking %v to %v, as the client awaits the server", protocol, joinHostPort(sock.destination(), sock.port))
+		return
+	}
+	atomic.AddUint64(&sock.srv.stats.mismatches, 1)
+	if sock.srv.protocols.FlagOnly {
+		sock.Printf("Not speaking %v to %v", protocol, joinHostPort(sock.destination(), sock.port))
+		return
+	}
+	reason := ReasonProtocol
+	sock.srv.stats.denials.add(reason)
+	err := &PolicyDeniedError{reason, joinHostPort(sock.destination(), sock.port), ErrorProtocolMismatch}
+	sock.logAccess(EventDenied, sock.host, sock.ip, sock.port, err, reason)
+	panic(err)
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,110 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "bytes"
+import "encoding/binary"
+import "errors"
+import "net"
+import "strconv"
+import "strings"
+
+var (
+	ErrorProxyHeader = errors.New("Invalid PROXY protocol header")
+)
+
+var proxyV2Signature = []byte{0x0d, 0x0a, 0x0d, 0x0a, 0x00, 0x0d, 0x0a, 0x51, 0x55, 0x49, 0x54, 0x0a}
+
+const maxProxyV1Length = 107
+
+func (self *server) isTrustedProxy(ip net.IP) bool {
+	for _, network := range self.trustedProxies {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Reads a PROXY protocol (v1 or v2) header, returning the client address it
+// carries, or nil if the header does not carry one (UNKNOWN, LOCAL).
+func (sock *sockConn) readProxyHeader() *net.TCPAddr {
+	first := sock.readAll(1)[0]
+	switch first {
+	case 'P':
+		return sock.readProxyV1()
+	case proxyV2Signature[0]:
+		return sock.readProxyV2()
+	}
+	panic(ErrorProxyHeader)
+}
+
+func (sock *sockConn) readProxyV1() *net.TCPAddr {
+	line := []byte{'P'}
+	for !bytes.HasSuffix(line, []byte("\r\n")) {
+		if len(line) >= maxProxyV1Length {
+			panic(ErrorProxyHeader)
+		}
+		line = append(line, sock.readAll(1)[0])
+	}
+	fields := strings.Fields(string(line))
+	if len(fields) < 2 || fields[0] != "PROXY" {
+		panic(ErrorProxyHeader)
+	}
+	if fields[1] == "UNKNOWN" {
+		return nil
+	}
+	if len(fields) != 6 || (fields[1] != "TCP4" && fields[1] != "TCP6") {
+		panic(ErrorProxyHeader)
+	}
+	ip := net.ParseIP(fields[2])
+	port, err := strconv.Atoi(fields[4])
+	if ip == nil || err != nil || port < 0 || port > 0xffff {
+		panic(ErrorProxyHeader)
+	}
+	return &net.TCPAddr{IP: ip, Port: port}
+}
+
+func (sock *sockConn) readProxyV2() *net.TCPAddr {
+	header := sock.readAll(15)
+	if !bytes.Equal(header[:11], proxyV2Signature[1:]) || header[11]>>4 != 0x2 {
+		panic(ErrorProxyHeader)
+	}
+	command, family := header[11]&0xf, header[12]
+	payload := sock.readAll(uint32(binary.BigEndian.Uint16(header[13:])))
+	if command == 0x0 {
+		// LOCAL, e.g. health checks of the proxy itself
+		return nil
+	}
+	switch {
+	case command != 0x1:
+		panic(ErrorProxyHeader)
+	case family == 0x11 && len(payload) >= 12:
+		return &net.TCPAddr{IP: net.IP(payload[0:4]), Port: int(binary.BigEndian.Uint16(payload[8:]))}
+	case family == 0x21 && len(payload) >= 36:
+		return &net.TCPAddr{IP: net.IP(payload[0:16]), Port: int(binary.BigEndian.Uint16(payload[32:]))}
+	}
+	// Unsupported family, e.g. unix sockets
+	return nil
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,58 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "strconv"
+import "time"
+
+var (
+	ErrorQuota = errors.New("Transfer quota exceeded")
+)
+
+// Quota limits the bytes relayed, in both directions, per identity, or per
+// client IP if not authenticated, within fixed periods, e.g. per day.
+// Usage is shared via the SharedStore of the server, if any, and accounted
+// once sessions end, so that sessions in flight may exceed the quota.
+type Quota struct {
+	Bytes  uint64
+	Period time.Duration
+}
+
+// Returns the key of the current period of the quota of client.
+func (self *Quota) key(client *ClientInfo) string {
+	period := time.Now().UnixNano() / int64(self.Period)
+	return "quota:" + clientKey(client) + ":" + strconv.FormatInt(period, 10)
+}
+
+// Adds bytes to the usage of client, returning the new usage.
+func (self *server) useQuota(client *ClientInfo, bytes uint64) uint64 {
+	used, _ := self.count(self.quota.key(client), int64(bytes), self.quota.Period)
+	return uint64(used)
+}
+
+// Returns whether client used up its quota.
+func (sock *sockConn) quotaExceeded() bool {
+	return sock.srv.quota != nil && sock.srv.useQuota(sock.info, 0) >= sock.srv.quota.Bytes
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,91 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "context"
+import "net"
+import "strings"
+import "sync"
+import "time"
+
+const reverseLookupTimeout = 5 * time.Second
+
+type reverseEntry struct {
+	name    string
+	expires time.Time
+}
+
+// Caching reverse (PTR) lookups, for enriching access records.
+type reverseResolver struct {
+	sync.Mutex
+	ttl     time.Duration
+	entries map[string]reverseEntry
+	swept   time.Time
+}
+
+func newReverseResolver(ttl time.Duration) *reverseResolver {
+	return &reverseResolver{ttl: ttl, entries: make(map[string]reverseEntry), swept: time.Now()}
+}
+
+// Returns the first name ip resolves to, or an empty string.
+// Failed lookups get cached as well.
+func (self *reverseResolver) lookup(ip net.IP) string {
+	if ip == nil {
+		return ""
+	}
+	key := ip.String()
+	now := time.Now()
+	self.Lock()
+	entry, ok := self.entries[key]
+	self.Unlock()
+	if ok && now.Before(entry.expires) {
+		return entry.name
+	}
+
+	ctx, cancel := context.WithTimeout(context.Background(), reverseLookupTimeout)
+	defer cancel()
+	var name string
+	if names, err := net.DefaultResolver.LookupAddr(ctx, key); err == nil && len(names) != 0 {
+		name = strings.TrimSuffix(names[0], ".")
+	}
+
+	self.Lock()
+	defer self.Unlock()
+	self.entries[key] = reverseEntry{name, now.Add(self.ttl)}
+	if now.Sub(self.swept) > self.ttl {
+		for key, entry := range self.entries {
+			if now.After(entry.expires) {
+				delete(self.entries, key)
+			}
+		}
+		self.swept = now
+	}
+	return name
+}
+
+// Fills in the names of the client and destination of record.
+func (self *reverseResolver) enrich(record *AccessRecord) {
+	record.ClientName = self.lookup(record.Client.IP)
+	record.DestName = self.lookup(record.Dest)
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,90 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "net"
+
+var (
+	ErrorRebinding = errors.New("Domain resolved to internal IP")
+)
+
+var sharedAddressSpace = &net.IPNet{IP: net.IPv4(100, 64, 0, 0), Mask: net.CIDRMask(10, 32)}
+
+// RebindProtection rejects requests for domains resolving to private, loopback
+// or link-local IPs, so that attacker controlled DNS cannot be used to pivot
+// into internal networks.
+//
+// Applies to domains explicitly allowed by a DomainRuler, too; exempt
+// domains meant to resolve internally via ExemptDomain().
+type RebindProtection struct {
+	domains  *RuleSet
+	networks []*net.IPNet
+}
+
+// Creates a new RebindProtection without any exemptions.
+func NewRebindProtection() *RebindProtection {
+	return &RebindProtection{NewRuleSet(nil), nil}
+}
+
+// Exempts domains, using RuleSet pattern syntax, e.g. ".corp.example.com".
+func (self *RebindProtection) ExemptDomain(pattern string) error {
+	return self.domains.Add(pattern, AllowConnection)
+}
+
+// Exempts a network domains may resolve to.
+func (self *RebindProtection) ExemptNetwork(network *net.IPNet) {
+	self.networks = append(self.networks, network)
+}
+
+func (self *RebindProtection) isExemptIP(ip net.IP) bool {
+	if !isInternalIP(ip) {
+		return true
+	}
+	for _, network := range self.networks {
+		if network.Contains(ip) {
+			return true
+		}
+	}
+	return false
+}
+
+// Returns the first IP domain illegally resolved to, or nil.
+func (self *RebindProtection) check(domain string, ips []net.IP) net.IP {
+	if self.domains.match(domain, false) != nil {
+		return nil
+	}
+	for _, ip := range ips {
+		if !self.isExemptIP(ip) {
+			return ip
+		}
+	}
+	return nil
+}
+
+func isInternalIP(ip net.IP) bool {
+	return ip.IsLoopback() || ip.IsPrivate() || ip.IsUnspecified() ||
+		ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() ||
+		ip.IsInterfaceLocalMulticast() || sharedAddressSpace.Contains(ip)
+}
+
+// vim: set noet ts=2 sw=2:
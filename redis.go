@@ -0,0 +1,262 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "bufio"
+import "errors"
+import "fmt"
+import "io"
+import "net"
+import "net/url"
+import "strconv"
+import "strings"
+import "sync"
+import "time"
+
+const (
+	redisTimeout = 2 * time.Second
+	redisPrefix  = "gosocksv5d:"
+
+	// Increments, setting the expiry of new counters.
+	redisIncrScript = `local v = redis.call("INCRBY", KEYS[1], ARGV[1])
+if v == tonumber(ARGV[1]) then redis.call("PEXPIRE", KEYS[1], ARGV[2]) end
+return v`
+)
+
+var (
+	ErrorRedisProtocol = errors.New("Invalid Redis reply")
+)
+
+// Redis configures a RedisStore.
+type Redis struct {
+	Addr     string        // host:port of the server
+	Password string        // Used to AUTH, if not empty
+	DB       int           // Database to SELECT
+	Prefix   string        // Prefix of all keys, "gosocksv5d:" if empty
+	Timeout  time.Duration // Of dialing and each command, 2 seconds if zero
+}
+
+// Parses a Redis URL, e.g. "redis://:password@host:6379/2", into a Redis
+// config, the path giving the database.
+func ParseRedisURL(s string) (Redis, error) {
+	var rv Redis
+	u, err := url.Parse(s)
+	if err != nil {
+		return rv, err
+	}
+	if u.Scheme != "redis" || len(u.Host) == 0 {
+		return rv, fmt.Errorf("invalid Redis URL %q", s)
+	}
+	rv.Addr = u.Host
+	if u.Port() == "" {
+		rv.Addr = net.JoinHostPort(u.Hostname(), "6379")
+	}
+	if u.User != nil {
+		rv.Password, _ = u.User.Password()
+	}
+	if db := strings.Trim(u.Path, "/"); len(db) != 0 {
+		if rv.DB, err = strconv.Atoi(db); err != nil {
+			return rv, fmt.Errorf("invalid Redis database %q", db)
+		}
+	}
+	return rv, nil
+}
+
+// RedisError is an error reply of a Redis server.
+type RedisError string
+
+func (self RedisError) Error() string {
+	return "Redis: " + string(self)
+}
+
+// RedisStore implements a SharedStore in Redis, for sharing state between
+// the instances of a cluster, e.g. behind a load balancer.
+// A single connection is used, redialed as needed.
+type RedisStore struct {
+	sync.Mutex
+	config Redis
+	conn   net.Conn
+	rd     *bufio.Reader
+}
+
+// Creates a new RedisStore. Connecting is deferred until first used.
+func NewRedisStore(config Redis) *RedisStore {
+	if len(config.Prefix) == 0 {
+		config.Prefix = redisPrefix
+	}
+	if config.Timeout <= 0 {
+		config.Timeout = redisTimeout
+	}
+	return &RedisStore{config: config}
+}
+
+func (self *RedisStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	reply, err := self.do("EVAL", redisIncrScript, "1", self.config.Prefix+key,
+		strconv.FormatInt(delta, 10), strconv.FormatInt(ttl.Milliseconds(), 10))
+	if err != nil {
+		return 0, err
+	}
+	value, ok := reply.(int64)
+	if !ok {
+		return 0, ErrorRedisProtocol
+	}
+	return value, nil
+}
+
+func (self *RedisStore) Set(key, value string, ttl time.Duration) error {
+	_, err := self.do("SET", self.config.Prefix+key, value, "PX", strconv.FormatInt(ttl.Milliseconds(), 10))
+	return err
+}
+
+func (self *RedisStore) Get(key string) (string, bool, error) {
+	reply, err := self.do("GET", self.config.Prefix+key)
+	if err != nil || reply == nil {
+		return "", false, err
+	}
+	value, ok := reply.(string)
+	if !ok {
+		return "", false, ErrorRedisProtocol
+	}
+	return value, true, nil
+}
+
+// Closes the connection, if any. The store redials when used again.
+func (self *RedisStore) Close() error {
+	self.Lock()
+	defer self.Unlock()
+	return self.reset()
+}
+
+// Must be called with the store locked.
+func (self *RedisStore) reset() error {
+	if self.conn == nil {
+		return nil
+	}
+	err := self.conn.Close()
+	self.conn, self.rd = nil, nil
+	return err
+}
+
+// Runs a command, returning its reply: an int64, a string, nil or a slice
+// of these.
+func (self *RedisStore) do(args ...string) (interface{}, error) {
+	self.Lock()
+	defer self.Unlock()
+	if self.conn == nil {
+		if err := self.dial(); err != nil {
+			return nil, err
+		}
+	}
+	reply, err := self.command(args)
+	if _, ok := err.(RedisError); err != nil && !ok {
+		// Connection state unknown
+		self.reset()
+	}
+	return reply, err
+}
+
+// Must be called with the store locked.
+func (self *RedisStore) dial() error {
+	conn, err := net.DialTimeout("tcp", self.config.Addr, self.config.Timeout)
+	if err != nil {
+		return err
+	}
+	self.conn, self.rd = conn, bufio.NewReader(conn)
+	if len(self.config.Password) != 0 {
+		if _, err := self.command([]string{"AUTH", self.config.Password}); err != nil {
+			self.reset()
+			return err
+		}
+	}
+	if self.config.DB != 0 {
+		if _, err := self.command([]string{"SELECT", strconv.Itoa(self.config.DB)}); err != nil {
+			self.reset()
+			return err
+		}
+	}
+	return nil
+}
+
+// Must be called with the store locked.
+func (self *RedisStore) command(args []string) (interface{}, error) {
+	self.conn.SetDeadline(time.Now().Add(self.config.Timeout))
+	buf := []byte(fmt.Sprintf("*%d\r\n", len(args)))
+	for _, arg := range args {
+		buf = append(buf, fmt.Sprintf("$%d\r\n%s\r\n", len(arg), arg)...)
+	}
+	if _, err := self.conn.Write(buf); err != nil {
+		return nil, err
+	}
+	return readRedisReply(self.rd)
+}
+
+func readRedisReply(rd *bufio.Reader) (interface{}, error) {
+	line, err := rd.ReadString('\n')
+	if err != nil {
+		return nil, err
+	}
+	if len(line) < 3 || line[len(line)-2] != '\r' {
+		return nil, ErrorRedisProtocol
+	}
+	kind, line := line[0], line[1:len(line)-2]
+	switch kind {
+	case '+':
+		return line, nil
+	case '-':
+		return nil, RedisError(line)
+	case ':':
+		return strconv.ParseInt(line, 10, 64)
+	case '$':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < -1 {
+			return nil, ErrorRedisProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		data := make([]byte, n+2)
+		if _, err := io.ReadFull(rd, data); err != nil {
+			return nil, err
+		}
+		return string(data[:n]), nil
+	case '*':
+		n, err := strconv.Atoi(line)
+		if err != nil || n < -1 {
+			return nil, ErrorRedisProtocol
+		}
+		if n == -1 {
+			return nil, nil
+		}
+		rv := make([]interface{}, n)
+		for i := range rv {
+			if rv[i], err = readRedisReply(rd); err != nil {
+				if _, ok := err.(RedisError); !ok {
+					return nil, err
+				}
+			}
+		}
+		return rv, nil
+	}
+	return nil, ErrorRedisProtocol
+}
+
+// vim: set noet ts=2 sw=2:
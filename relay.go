@@ -0,0 +1,306 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "io"
+import "net"
+import "sync/atomic"
+import "time"
+
+// Direction a RelayEngine relays in.
+type RelayDirection int
+
+const (
+	RelayUp   RelayDirection = iota // Client to destination
+	RelayDown                       // Destination to client
+)
+
+// RelayConn is a side of a session, as relayed by a RelayEngine.
+//
+// Reading applies the features of the session to the direction read, i.e.
+// idle timeouts, transfer caps, bandwidth classes, fair sharing, mirroring
+// and accounting, returning io.EOF once the direction is done.
+// Writing retries until all is written, or writing fails.
+type RelayConn interface {
+	io.Reader
+	io.Writer
+
+	// Returns the underlying connection, and whether relaying may bypass
+	// Read and Write, as the session uses none of the features applied by
+	// these, e.g. for splicing. Use Relayed() to account bytes relayed so.
+	Raw() (net.Conn, bool)
+
+	// Accounts n bytes read bypassing Read.
+	Relayed(n int64)
+}
+
+// RelayEngine moves the bytes of sessions, e.g. using a faster mechanism, or
+// inspecting traffic, one direction at a time, each from its own goroutine.
+// See Server.SetRelayEngine() and SessionOptions.RelayEngine.
+type RelayEngine interface {
+	// Relays from src to dst, until src hits EOF, or either fails, returning
+	// the error ending it, if any.
+	Relay(dst, src RelayConn, dir RelayDirection) error
+}
+
+// Function adapter for RelayEngine
+type RelayEngineFunc func(dst, src RelayConn, dir RelayDirection) error
+
+func (self RelayEngineFunc) Relay(dst, src RelayConn, dir RelayDirection) error {
+	return self(dst, src, dir)
+}
+
+// CopyEngine relays via a buffer, the default.
+var CopyEngine RelayEngine = copyEngine{}
+
+type copyEngine struct{}
+
+func (copyEngine) Relay(dst, src RelayConn, dir RelayDirection) error {
+	buf := make([]byte, bufSize)
+	for {
+		nr, err := src.Read(buf)
+		if nr > 0 {
+			if _, werr := dst.Write(buf[:nr]); werr != nil {
+				return werr
+			}
+		}
+		if err == io.EOF {
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// SpliceEngine relays TCP sessions within the kernel (Linux), via splice(2),
+// sparing the copies to and from user space, for sessions not using any of
+// the features applied by RelayConn.Read, i.e. no idle timeouts, transfer
+// caps, bandwidth limits or mirroring. Other sessions get relayed by
+// CopyEngine.
+// Bytes relayed are accounted once a direction is done.
+var SpliceEngine RelayEngine = spliceEngine{}
+
+type spliceEngine struct{}
+
+func (spliceEngine) Relay(dst, src RelayConn, dir RelayDirection) error {
+	rsrc, ok := src.Raw()
+	if !ok {
+		return CopyEngine.Relay(dst, src, dir)
+	}
+	rdst, ok := dst.Raw()
+	tdst, tcp := rdst.(*net.TCPConn)
+	if !ok || !tcp {
+		return CopyEngine.Relay(dst, src, dir)
+	}
+	rsrc.SetReadDeadline(time.Time{})
+	tdst.SetWriteDeadline(time.Time{})
+	n, err := tdst.ReadFrom(rsrc)
+	src.Relayed(n)
+	return err
+}
+
+// SockmapEngine relays TCP sessions within the kernel (Linux 5.13 or later,
+// on 64-bit little endian systems), via a sockmap, i.e. an eBPF program
+// redirecting what either socket receives to the other one, without waking
+// up the server, for sessions not using any of the features applied by
+// RelayConn.Read in either direction, like SpliceEngine. Setting up the
+// sockmap requires CAP_BPF and CAP_NET_ADMIN; where it fails, sessions get
+// relayed by CopyEngine instead.
+// Bytes relayed are accounted once a direction is done.
+var SockmapEngine RelayEngine = &sockmapEngine{}
+
+// Returns an engine limiting each direction of each session relayed by
+// engine to rate bytes per second.
+func RateLimitEngine(engine RelayEngine, rate int64) RelayEngine {
+	return RelayEngineFunc(func(dst, src RelayConn, dir RelayDirection) error {
+		return engine.Relay(dst, &throttledConn{src, newThrottle(rate)}, dir)
+	})
+}
+
+type throttledConn struct {
+	RelayConn
+	throttle *throttle
+}
+
+func (self *throttledConn) Read(b []byte) (int, error) {
+	n, err := self.RelayConn.Read(b[:self.throttle.chunk(len(b))])
+	if n > 0 {
+		self.throttle.wait(n)
+	}
+	return n, err
+}
+
+func (self *throttledConn) Raw() (net.Conn, bool) {
+	conn, _ := self.RelayConn.Raw()
+	return conn, false
+}
+
+// Returns an engine copying the data engine relays to mirror, in the
+// directions of the mirror, besides any Mirror of SessionOptions.
+func MirrorEngine(engine RelayEngine, mirror *Mirror) RelayEngine {
+	return RelayEngineFunc(func(dst, src RelayConn, dir RelayDirection) error {
+		if dir == RelayUp && mirror.directions&MirrorUpstream != 0 ||
+			dir == RelayDown && mirror.directions&MirrorDownstream != 0 {
+			src = &mirroredConn{src, mirror}
+		}
+		return engine.Relay(dst, src, dir)
+	})
+}
+
+type mirroredConn struct {
+	RelayConn
+	mirror *Mirror
+}
+
+func (self *mirroredConn) Read(b []byte) (int, error) {
+	n, err := self.RelayConn.Read(b)
+	if n > 0 {
+		self.mirror.copy(b[:n])
+	}
+	return n, err
+}
+
+func (self *mirroredConn) Raw() (net.Conn, bool) {
+	conn, _ := self.RelayConn.Raw()
+	return conn, false
+}
+
+// A side of a session, relayed with peer.
+type relayConn struct {
+	sock, peer *sockConn
+	capped     bool // Cap reached, closing once the rest got written
+}
+
+// Returns the direction reading from sock relays.
+func (sock *sockConn) direction() RelayDirection {
+	if sock.info != nil {
+		return RelayUp
+	}
+	return RelayDown
+}
+
+func (self *relayConn) Read(b []byte) (int, error) {
+	sock, peer := self.sock, self.peer
+	if self.capped {
+		sock.Printf("Transfer cap of %d bytes reached", sock.maxBytes)
+		sock.closing(CloseCapped)
+		atomic.AddUint64(&sock.srv.stats.capped, 1)
+		sock.conn.Close()
+		peer.conn.Close()
+		return 0, io.EOF
+	}
+	if sock.throttle != nil {
+		b = b[:sock.throttle.chunk(len(b))]
+	}
+	if sock.fair != nil {
+		b = b[:sock.fair.chunk(len(b))]
+	}
+	for {
+		nr, err := sock.Read(b)
+		used := atomic.AddUint64(&sock.transferred, uint64(nr))
+		if sock.maxBytes > 0 && nr > 0 {
+			if used += atomic.LoadUint64(&peer.transferred); used > sock.maxBytes {
+				// Relay up to the cap only
+				excess := min(used-sock.maxBytes, uint64(nr))
+				atomic.AddUint64(&sock.transferred, -excess)
+				nr -= int(excess)
+				self.capped = true
+			}
+		}
+		if nr > 0 {
+			atomic.AddUint64(&sock.srv.stats.relayed, uint64(nr))
+		}
+		if nr > 0 && sock.mirror != nil {
+			sock.mirror.copy(b[:nr])
+		}
+		if nr > 0 && sock.tls != nil {
+			sock.tls.observe(sock.direction(), b[:nr])
+		}
+		if nr > 0 && sock.throttle != nil {
+			sock.throttle.wait(nr)
+		}
+		if nr > 0 && sock.fair != nil {
+			sock.fair.wait(nr)
+		}
+		if self.capped {
+			return nr, nil
+		}
+		if err == nil || isDeadPeer(err) {
+			return nr, err
+		}
+		if ne, ok := err.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
+			switch {
+			case ne.Timeout() && sock.idleExpired() && !sock.probing:
+				sock.Printf("Idle for %v", sock.idle)
+				sock.closing(CloseIdle)
+				return nr, io.EOF
+			case ne.Timeout() && sock.idleExpired():
+				// Dead peers fail reading once probes go unanswered instead
+				sock.Printf("Idle for %v, peers alive", sock.idle)
+			case ne.Timeout() && sock.readIdleExpired():
+				sock.Printf("Nothing received for %v", sock.readIdle)
+				sock.closing(CloseIdle)
+				sock.conn.Close()
+				peer.conn.Close()
+				return nr, io.EOF
+			}
+			if nr > 0 {
+				return nr, nil
+			}
+			continue
+		}
+		return nr, err
+	}
+}
+
+func (self *relayConn) Write(b []byte) (int, error) {
+	written := 0
+	for written < len(b) {
+		n, err := self.sock.Write(b[written:])
+		written += n
+		if err != nil {
+			if ne, ok := err.(net.Error); ok && (ne.Timeout() || ne.Temporary()) {
+				continue
+			}
+			return written, err
+		}
+	}
+	return written, nil
+}
+
+func (self *relayConn) Raw() (net.Conn, bool) {
+	sock := self.sock
+	plain := sock.idle <= 0 && sock.readIdle <= 0 && sock.maxBytes == 0 &&
+		sock.throttle == nil && sock.fair == nil && sock.mirror == nil && sock.tls == nil
+	return sock.conn, plain
+}
+
+func (self *relayConn) Relayed(n int64) {
+	if n > 0 {
+		atomic.AddUint64(&self.sock.transferred, uint64(n))
+		atomic.AddUint64(&self.sock.srv.stats.relayed, uint64(n))
+		self.sock.touch()
+	}
+}
+
+// vim: set noet ts=2 sw=2:
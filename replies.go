@@ -0,0 +1,94 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "net"
+import "sync"
+import "time"
+
+// ErrorReplies configures how protocol errors of clients failing repeatedly,
+// such as scanners, get answered, making the server less useful as a
+// scanning oracle.
+// Once a client reached the threshold, its error replies get delayed, or
+// dropped altogether, by closing the connection without a reply.
+type ErrorReplies struct {
+	Threshold int           // Failures within Window before replies get delayed or dropped
+	Window    time.Duration // Time window failures are counted in
+	Delay     time.Duration // Delay replies by this long
+	Drop      bool          // Close the connection without any reply instead
+}
+
+type failureEntry struct {
+	since    time.Time
+	failures int
+}
+
+type errorReplies struct {
+	sync.Mutex
+	*ErrorReplies
+	entries map[string]*failureEntry
+	swept   time.Time
+}
+
+func newErrorReplies(config *ErrorReplies) *errorReplies {
+	return &errorReplies{ErrorReplies: config, entries: make(map[string]*failureEntry), swept: time.Now()}
+}
+
+// Records a failure of a client, returning whether it exceeded the threshold.
+func (self *errorReplies) fail(ip net.IP) bool {
+	now := time.Now()
+	key := ip.String()
+	self.Lock()
+	defer self.Unlock()
+	if now.Sub(self.swept) >= self.Window {
+		for k, entry := range self.entries {
+			if now.Sub(entry.since) > self.Window {
+				delete(self.entries, k)
+			}
+		}
+		self.swept = now
+	}
+	entry, ok := self.entries[key]
+	if !ok || now.Sub(entry.since) > self.Window {
+		entry = &failureEntry{since: now}
+		self.entries[key] = entry
+	}
+	entry.failures++
+	return entry.failures > self.Threshold
+}
+
+// To be called before replying to a protocol error.
+// Delays, or drops the connection by panicking with err, for clients failing
+// repeatedly.
+func (sock *sockConn) protocolError(err error) {
+	replies := sock.srv.errorReplies
+	if replies == nil || !replies.fail(sock.info.IP) {
+		return
+	}
+	if replies.Drop {
+		sock.Printf("Dropping reply to repeated protocol failure")
+		panic(err)
+	}
+	time.Sleep(replies.Delay)
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,220 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "bytes"
+import "crypto/rand"
+import "encoding/hex"
+import "encoding/json"
+import "errors"
+import "fmt"
+import "net/http"
+import "net/url"
+import "runtime"
+import "runtime/debug"
+import "strings"
+import "sync/atomic"
+import "time"
+
+const (
+	reporterQueue   = 64
+	reporterTimeout = 10 * time.Second
+)
+
+var (
+	ErrorSentryDSN = errors.New("Invalid Sentry DSN")
+)
+
+// Report describes a recovered panic or an internal error.
+type Report struct {
+	Time    time.Time
+	Err     error
+	Panic   bool        // Whether Err got recovered from a panic
+	Stack   []byte      // Stack trace of the panic, if any
+	Context string      // Where it happened, e.g. "session", "relay", "listener"
+	Client  *ClientInfo // Client of the connection, if any
+	Conn    string      // Connection, as local -> remote, if any
+}
+
+// Reporter receives recovered panics and internal errors, e.g. to forward
+// them to an error tracker.
+//
+// Errors ending sessions in the regular course of things, such as clients
+// disconnecting or failing the protocol, are not reported.
+type Reporter interface {
+	Report(report *Report)
+}
+
+// Returns whether a recovered value is a bug, rather than an error ending a
+// session in the regular course of things.
+func unexpectedPanic(r interface{}) bool {
+	if _, ok := r.(runtime.Error); ok {
+		return true
+	}
+	_, ok := r.(error)
+	return !ok
+}
+
+func (self *server) report(report *Report) {
+	if self.reporter == nil {
+		return
+	}
+	report.Time = time.Now()
+	self.reporter.Report(report)
+}
+
+// Reports a value recovered while serving a connection, if unexpected.
+func (sock *sockConn) reportPanic(context string, r interface{}) {
+	if sock.srv.reporter == nil || !unexpectedPanic(r) {
+		return
+	}
+	err, ok := r.(error)
+	if !ok {
+		err = fmt.Errorf("%v", r)
+	}
+	sock.srv.report(&Report{
+		Err:     err,
+		Panic:   true,
+		Stack:   debug.Stack(),
+		Context: context,
+		Client:  sock.info,
+		Conn:    fmt.Sprintf("%v -> %v", sock.conn.LocalAddr(), sock.conn.RemoteAddr()),
+	})
+}
+
+type logReporter struct {
+	Logger
+}
+
+// Creates a Reporter logging reports, including stack traces.
+func NewLogReporter(logger Logger) Reporter {
+	return &logReporter{logger}
+}
+
+func (self *logReporter) Report(report *Report) {
+	msg := fmt.Sprintf("%s: %v", report.Context, report.Err)
+	if report.Client != nil {
+		msg = fmt.Sprintf("%s (client %v)", msg, report.Client)
+	}
+	if report.Panic {
+		msg = fmt.Sprintf("%s\n%s", msg, report.Stack)
+	}
+	self.Print(msg)
+}
+
+// SentryReporter sends reports to a Sentry compatible error tracker, via its
+// HTTP store endpoint.
+//
+// Reports are queued and sent asynchronously; reports not fitting into the
+// queue are dropped.
+type SentryReporter struct {
+	endpoint string
+	auth     string
+	client   *http.Client
+	queue    chan []byte
+	dropped  uint64
+	Tags     map[string]string // Sent along with each report, e.g. environment
+}
+
+// Creates a new SentryReporter for a DSN, i.e.
+// https://<key>@<host>/<project>
+func NewSentryReporter(dsn string) (*SentryReporter, error) {
+	u, err := url.Parse(dsn)
+	if err != nil || u.User == nil || len(u.Host) == 0 {
+		return nil, ErrorSentryDSN
+	}
+	project := strings.Trim(u.Path, "/")
+	if len(project) == 0 {
+		return nil, ErrorSentryDSN
+	}
+	rv := &SentryReporter{
+		endpoint: fmt.Sprintf("%s://%s/api/%s/store/", u.Scheme, u.Host, project),
+		auth:     fmt.Sprintf("Sentry sentry_version=7, sentry_client=gosocksv5d/1, sentry_key=%s", u.User.Username()),
+		client:   &http.Client{Timeout: reporterTimeout},
+		queue:    make(chan []byte, reporterQueue),
+	}
+	go rv.send()
+	return rv, nil
+}
+
+func (self *SentryReporter) Report(report *Report) {
+	id := make([]byte, 16)
+	rand.Read(id)
+	level := "error"
+	if report.Panic {
+		level = "fatal"
+	}
+	tags := map[string]string{"context": report.Context}
+	for k, v := range self.Tags {
+		tags[k] = v
+	}
+	extra := map[string]string{}
+	if report.Client != nil {
+		extra["client"] = report.Client.String()
+	}
+	if len(report.Conn) != 0 {
+		extra["conn"] = report.Conn
+	}
+	if report.Panic {
+		extra["stack"] = string(report.Stack)
+	}
+	event, err := json.Marshal(map[string]interface{}{
+		"event_id":  hex.EncodeToString(id),
+		"timestamp": report.Time.UTC().Format(time.RFC3339),
+		"level":     level,
+		"platform":  "go",
+		"logger":    "gosocksv5d",
+		"message":   report.Err.Error(),
+		"exception": []map[string]string{{"type": fmt.Sprintf("%T", report.Err), "value": report.Err.Error()}},
+		"tags":      tags,
+		"extra":     extra,
+	})
+	if err != nil {
+		return
+	}
+	select {
+	case self.queue <- event:
+	default:
+		atomic.AddUint64(&self.dropped, 1)
+	}
+}
+
+// Returns the number of reports dropped, due to a full queue.
+func (self *SentryReporter) Dropped() uint64 {
+	return atomic.LoadUint64(&self.dropped)
+}
+
+func (self *SentryReporter) send() {
+	for event := range self.queue {
+		req, err := http.NewRequest("POST", self.endpoint, bytes.NewReader(event))
+		if err != nil {
+			continue
+		}
+		req.Header.Set("Content-Type", "application/json")
+		req.Header.Set("X-Sentry-Auth", self.auth)
+		if resp, err := self.client.Do(req); err == nil {
+			resp.Body.Close()
+		}
+	}
+}
+
+// vim: set noet ts=2 sw=2:
@@ -23,6 +23,9 @@ package gosocksv5d
 
 import "math/rand"
 import "net"
+import "strings"
+import "sync"
+import "time"
 
 var (
 	// Default resolver, simply wrapping net.LookupIP().
@@ -36,6 +39,13 @@ type DNSResolver interface {
 	LookupIP(host string) (addrs []net.IP, err error)
 }
 
+// CachingResolver may additionally be implemented by a DNSResolver caching
+// answers, to tell whether a lookup was answered from its cache.
+type CachingResolver interface {
+	DNSResolver
+	LookupIPCached(host string) (addrs []net.IP, cached bool, err error)
+}
+
 type defaultResolver struct{}
 
 func (self defaultResolver) LookupIP(host string) (addrs []net.IP, err error) {
@@ -43,19 +53,159 @@ func (self defaultResolver) LookupIP(host string) (addrs []net.IP, err error) {
 }
 
 type shuffleResolver struct {
+	sync.Mutex
 	resolver DNSResolver
+	rand     *rand.Rand
 }
 
-func (self shuffleResolver) LookupIP(host string) (addrs []net.IP, err error) {
-	addrs, err = self.resolver.LookupIP(host)
+// Creates a DNSResolver wrapping resolver, shuffling the IPs it returns,
+// spreading connections over all IPs of a domain.
+// Shuffles using source, for reproducible orders, or the global source of
+// math/rand if nil.
+func NewShuffleResolver(resolver DNSResolver, source rand.Source) DNSResolver {
+	rv := &shuffleResolver{resolver: resolver}
+	if source != nil {
+		rv.rand = rand.New(source)
+	}
+	return rv
+}
+
+func (self *shuffleResolver) LookupIP(host string) (addrs []net.IP, err error) {
+	addrs, _, err = self.LookupIPCached(host)
+	return
+}
+
+func (self *shuffleResolver) LookupIPCached(host string) (addrs []net.IP, cached bool, err error) {
+	if cr, ok := self.resolver.(CachingResolver); ok {
+		addrs, cached, err = cr.LookupIPCached(host)
+	} else {
+		addrs, err = self.resolver.LookupIP(host)
+	}
 	if err == nil {
-		for n := len(addrs); n > 1; n-- {
-			if r := rand.Intn(n + 1); r != n {
-				addrs[r], addrs[n] = addrs[n], addrs[r]
+		self.shuffle(addrs)
+	}
+	return
+}
+
+// Fisher-Yates
+func (self *shuffleResolver) shuffle(addrs []net.IP) {
+	intn := rand.Intn
+	if self.rand != nil {
+		// rand.Rand is not safe for concurrent use, unlike the global source
+		self.Lock()
+		defer self.Unlock()
+		intn = self.rand.Intn
+	}
+	for i := len(addrs) - 1; i > 0; i-- {
+		j := intn(i + 1)
+		addrs[i], addrs[j] = addrs[j], addrs[i]
+	}
+}
+
+type cacheEntry struct {
+	addrs   []net.IP
+	expires time.Time
+}
+
+type cachingResolver struct {
+	sync.Mutex
+	resolver DNSResolver
+	ttl      time.Duration
+	entries  map[string]cacheEntry
+	swept    time.Time
+}
+
+// Creates a CachingResolver, caching the answers (but not the failures) of
+// resolver for the specified duration.
+func NewCachingResolver(resolver DNSResolver, ttl time.Duration) CachingResolver {
+	return &cachingResolver{resolver: resolver, ttl: ttl, entries: make(map[string]cacheEntry), swept: time.Now()}
+}
+
+func (self *cachingResolver) LookupIP(host string) (addrs []net.IP, err error) {
+	addrs, _, err = self.LookupIPCached(host)
+	return
+}
+
+func (self *cachingResolver) LookupIPCached(host string) (addrs []net.IP, cached bool, err error) {
+	now := time.Now()
+	self.Lock()
+	entry, ok := self.entries[host]
+	self.Unlock()
+	if ok && now.Before(entry.expires) {
+		return append([]net.IP(nil), entry.addrs...), true, nil
+	}
+	addrs, err = self.resolver.LookupIP(host)
+	if err != nil {
+		return nil, false, err
+	}
+	self.Lock()
+	defer self.Unlock()
+	self.entries[host] = cacheEntry{append([]net.IP(nil), addrs...), now.Add(self.ttl)}
+	if now.Sub(self.swept) > self.ttl {
+		for key, entry := range self.entries {
+			if now.After(entry.expires) {
+				delete(self.entries, key)
 			}
 		}
+		self.swept = now
+	}
+	return addrs, false, nil
+}
+
+type pinKey struct {
+	client string
+	domain string
+}
+
+type pinEntry struct {
+	ip      net.IP
+	expires time.Time
+}
+
+// Remembers the IPs clients got connected to for domains, for a while.
+type pinCache struct {
+	sync.Mutex
+	ttl   time.Duration
+	pins  map[pinKey]pinEntry
+	swept time.Time
+}
+
+func newPinCache(ttl time.Duration) *pinCache {
+	return &pinCache{ttl: ttl, pins: make(map[pinKey]pinEntry), swept: time.Now()}
+}
+
+// Moves the IP pinned for client and domain, if any, to the front of addrs.
+// Pinned IPs no longer present in addrs are ignored.
+func (self *pinCache) apply(client net.IP, domain string, addrs []net.IP) {
+	key := pinKey{client.String(), strings.ToLower(domain)}
+	self.Lock()
+	entry, ok := self.pins[key]
+	self.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		return
+	}
+	for i, addr := range addrs {
+		if addr.Equal(entry.ip) {
+			addrs[0], addrs[i] = addrs[i], addrs[0]
+			return
+		}
+	}
+}
+
+func (self *pinCache) pin(client net.IP, domain string, ip net.IP) {
+	now := time.Now()
+	key := pinKey{client.String(), strings.ToLower(domain)}
+	self.Lock()
+	defer self.Unlock()
+	self.pins[key] = pinEntry{ip, now.Add(self.ttl)}
+	if now.Sub(self.swept) > self.ttl {
+		for key, entry := range self.pins {
+			if now.After(entry.expires) {
+				delete(self.pins, key)
+			}
+		}
+		self.swept = now
 	}
-	return
 }
 
 // vim: set noet ts=2 sw=2:
@@ -0,0 +1,96 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "fmt"
+import "net"
+import "sync/atomic"
+import "time"
+
+// Statistics of the lookups performed on behalf of clients.
+type ResolverStats struct {
+	Resolver    string    // Type of the DNSResolver in use
+	Queries     uint64    // Lookups performed
+	Failures    uint64    // Lookups failing, for whatever reason
+	NXDomain    uint64    // Lookups failing as the name does not exist
+	Timeouts    uint64    // Lookups timing out
+	CacheHits   uint64    // Lookups answered from the cache, see CachingResolver
+	CacheMisses uint64    // Lookups not answered from the cache, see CachingResolver
+	Latency     Histogram // Seconds per lookup, see Histogram.Quantile()
+}
+
+type resolverStats struct {
+	queries     uint64
+	failures    uint64
+	nxdomain    uint64
+	timeouts    uint64
+	cacheHits   uint64
+	cacheMisses uint64
+	latency     *histogram
+}
+
+func newResolverStats() *resolverStats {
+	return &resolverStats{latency: newHistogram(lookupBounds)}
+}
+
+func (self *resolverStats) observe(resolver DNSResolver, latency time.Duration, cached bool, err error) {
+	atomic.AddUint64(&self.queries, 1)
+	self.latency.observe(latency.Seconds())
+	if _, ok := resolver.(CachingResolver); ok {
+		if cached {
+			atomic.AddUint64(&self.cacheHits, 1)
+		} else {
+			atomic.AddUint64(&self.cacheMisses, 1)
+		}
+	}
+	if err == nil {
+		return
+	}
+	atomic.AddUint64(&self.failures, 1)
+	var dnsErr *net.DNSError
+	var netErr net.Error
+	switch {
+	case errors.As(err, &dnsErr) && dnsErr.IsNotFound:
+		atomic.AddUint64(&self.nxdomain, 1)
+	case errors.As(err, &netErr) && netErr.Timeout():
+		atomic.AddUint64(&self.timeouts, 1)
+	}
+}
+
+func (self *resolverStats) snapshot(resolver DNSResolver) ResolverStats {
+	if sr, ok := resolver.(*shuffleResolver); ok {
+		resolver = sr.resolver
+	}
+	return ResolverStats{
+		Resolver:    fmt.Sprintf("%T", resolver),
+		Queries:     atomic.LoadUint64(&self.queries),
+		Failures:    atomic.LoadUint64(&self.failures),
+		NXDomain:    atomic.LoadUint64(&self.nxdomain),
+		Timeouts:    atomic.LoadUint64(&self.timeouts),
+		CacheHits:   atomic.LoadUint64(&self.cacheHits),
+		CacheMisses: atomic.LoadUint64(&self.cacheMisses),
+		Latency:     self.latency.snapshot(),
+	}
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,466 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package reverse
+
+import "encoding/binary"
+import "errors"
+import "io"
+import "net"
+import "os"
+import "strconv"
+import "sync"
+import "time"
+
+const (
+	frameOpen   = iota // Opens a stream
+	frameData          // Carries stream data
+	frameClose         // Half-closes a stream, i.e. no more data follows
+	frameReset         // Aborts a stream
+	frameWindow        // Grants the peer more send window, as a uint32 payload
+)
+
+const (
+	headerSize    = 9 // type, stream id, payload length
+	maxPayload    = 16 * 1024
+	initialWindow = 256 * 1024
+	acceptBacklog = 64
+)
+
+var (
+	ErrorSessionClosed = errors.New("Session closed")
+	ErrorStreamReset   = errors.New("Stream reset by peer")
+	ErrorStreamClosed  = errors.New("Stream closed")
+	ErrorProtocol      = errors.New("Multiplexing protocol violation")
+)
+
+// Session multiplexes streams over a single connection, each stream being a
+// net.Conn of its own, with per-stream flow control, so that a stalled stream
+// does not stall the others.
+//
+// Either end may open streams. Session implements net.Listener, accepting
+// the streams opened by the peer.
+type Session struct {
+	sync.Mutex
+	conn    net.Conn
+	wlock   sync.Mutex
+	streams map[uint32]*stream
+	nextID  uint32
+	accept  chan *stream
+	closed  chan struct{}
+	err     error
+}
+
+// Creates a new Session over conn. The ends of a connection must disagree
+// on initiator, e.g. the dialing end passing true.
+func NewSession(conn net.Conn, initiator bool) *Session {
+	rv := &Session{
+		conn:    conn,
+		streams: make(map[uint32]*stream),
+		nextID:  2,
+		accept:  make(chan *stream, acceptBacklog),
+		closed:  make(chan struct{}),
+	}
+	if initiator {
+		rv.nextID = 1
+	}
+	go rv.recv()
+	return rv
+}
+
+// Opens a new stream to the peer.
+func (self *Session) Open() (net.Conn, error) {
+	self.Lock()
+	if self.err != nil {
+		self.Unlock()
+		return nil, self.err
+	}
+	s := newStream(self, self.nextID)
+	self.nextID += 2
+	self.streams[s.id] = s
+	self.Unlock()
+	if err := self.write(frameOpen, s.id, nil); err != nil {
+		self.remove(s.id)
+		return nil, err
+	}
+	return s, nil
+}
+
+// Accepts the next stream opened by the peer.
+func (self *Session) Accept() (net.Conn, error) {
+	select {
+	case s := <-self.accept:
+		return s, nil
+	case <-self.closed:
+		return nil, self.err
+	}
+}
+
+// Returns the local address of the underlying connection.
+func (self *Session) Addr() net.Addr {
+	return self.conn.LocalAddr()
+}
+
+// Returns the remote address of the underlying connection.
+func (self *Session) RemoteAddr() net.Addr {
+	return self.conn.RemoteAddr()
+}
+
+// Returns a channel closed once the session is closed, by either end.
+func (self *Session) Done() <-chan struct{} {
+	return self.closed
+}
+
+// Closes the session and all its streams.
+func (self *Session) Close() error {
+	self.fail(ErrorSessionClosed)
+	return nil
+}
+
+func (self *Session) fail(err error) {
+	self.Lock()
+	if self.err != nil {
+		self.Unlock()
+		return
+	}
+	self.err = err
+	streams := self.streams
+	self.streams = make(map[uint32]*stream)
+	self.Unlock()
+	close(self.closed)
+	self.conn.Close()
+	for _, s := range streams {
+		s.fail(err)
+	}
+}
+
+func (self *Session) remove(id uint32) {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.streams, id)
+}
+
+func (self *Session) write(kind byte, id uint32, payload []byte) error {
+	frame := make([]byte, headerSize+len(payload))
+	frame[0] = kind
+	binary.BigEndian.PutUint32(frame[1:], id)
+	binary.BigEndian.PutUint32(frame[5:], uint32(len(payload)))
+	copy(frame[headerSize:], payload)
+	self.wlock.Lock()
+	defer self.wlock.Unlock()
+	if _, err := self.conn.Write(frame); err != nil {
+		self.fail(err)
+		return err
+	}
+	return nil
+}
+
+func (self *Session) recv() {
+	header := make([]byte, headerSize)
+	for {
+		if _, err := io.ReadFull(self.conn, header); err != nil {
+			self.fail(err)
+			return
+		}
+		kind := header[0]
+		id := binary.BigEndian.Uint32(header[1:])
+		length := binary.BigEndian.Uint32(header[5:])
+		if length > maxPayload {
+			self.fail(ErrorProtocol)
+			return
+		}
+		payload := make([]byte, length)
+		if _, err := io.ReadFull(self.conn, payload); err != nil {
+			self.fail(err)
+			return
+		}
+
+		self.Lock()
+		s := self.streams[id]
+		if kind == frameOpen && s == nil && self.err == nil {
+			s = newStream(self, id)
+			select {
+			case self.accept <- s:
+				self.streams[id] = s
+			default:
+				s = nil
+			}
+			self.Unlock()
+			if s == nil {
+				self.write(frameReset, id, nil)
+			}
+			continue
+		}
+		self.Unlock()
+		if s == nil {
+			continue
+		}
+		switch kind {
+		case frameData:
+			if !s.push(payload) {
+				self.fail(ErrorProtocol)
+				return
+			}
+		case frameClose:
+			s.remoteClose()
+		case frameReset:
+			self.remove(id)
+			s.fail(ErrorStreamReset)
+		case frameWindow:
+			if length != 4 {
+				self.fail(ErrorProtocol)
+				return
+			}
+			s.grant(binary.BigEndian.Uint32(payload))
+		}
+	}
+}
+
+// Address of a stream end, as the underlying connection address is not
+// meaningful to, e.g., a SOCKS server binding outgoing connections to it.
+type streamAddr uint32
+
+func (self streamAddr) Network() string {
+	return "mux"
+}
+
+func (self streamAddr) String() string {
+	return "stream:" + strconv.FormatUint(uint64(self), 10)
+}
+
+type stream struct {
+	sync.Mutex
+	id       uint32
+	sess     *Session
+	buf      []byte
+	window   uint32 // Bytes the peer is willing to receive
+	rclosed  bool   // Peer will not send any more data
+	wclosed  bool   // We will not send any more data
+	err      error
+	rd, wd   time.Time
+	readable chan struct{}
+	writable chan struct{}
+}
+
+func newStream(sess *Session, id uint32) *stream {
+	return &stream{
+		id:       id,
+		sess:     sess,
+		window:   initialWindow,
+		readable: make(chan struct{}, 1),
+		writable: make(chan struct{}, 1),
+	}
+}
+
+func notify(c chan struct{}) {
+	select {
+	case c <- struct{}{}:
+	default:
+	}
+}
+
+// Waits for c to be notified, the deadline or the session to end.
+func (self *stream) wait(c chan struct{}, deadline time.Time) error {
+	var timeout <-chan time.Time
+	if !deadline.IsZero() {
+		d := time.Until(deadline)
+		if d <= 0 {
+			return os.ErrDeadlineExceeded
+		}
+		timer := time.NewTimer(d)
+		defer timer.Stop()
+		timeout = timer.C
+	}
+	select {
+	case <-c:
+		return nil
+	case <-timeout:
+		return os.ErrDeadlineExceeded
+	case <-self.sess.closed:
+		return nil
+	}
+}
+
+func (self *stream) Read(b []byte) (int, error) {
+	for {
+		self.Lock()
+		if len(self.buf) > 0 {
+			n := copy(b, self.buf)
+			self.buf = self.buf[n:]
+			self.Unlock()
+			var grant [4]byte
+			binary.BigEndian.PutUint32(grant[:], uint32(n))
+			self.sess.write(frameWindow, self.id, grant[:])
+			return n, nil
+		}
+		err, rclosed, deadline := self.err, self.rclosed, self.rd
+		self.Unlock()
+		if err != nil {
+			return 0, err
+		}
+		if rclosed {
+			return 0, io.EOF
+		}
+		if err := self.wait(self.readable, deadline); err != nil {
+			return 0, err
+		}
+	}
+}
+
+func (self *stream) Write(b []byte) (n int, err error) {
+	for len(b) > 0 {
+		self.Lock()
+		err, wclosed, window, deadline := self.err, self.wclosed, self.window, self.wd
+		if err == nil && !wclosed && window > 0 {
+			chunk := len(b)
+			if chunk > maxPayload {
+				chunk = maxPayload
+			}
+			if uint32(chunk) > window {
+				chunk = int(window)
+			}
+			self.window -= uint32(chunk)
+			self.Unlock()
+			if err := self.sess.write(frameData, self.id, b[:chunk]); err != nil {
+				return n, err
+			}
+			n += chunk
+			b = b[chunk:]
+			continue
+		}
+		self.Unlock()
+		switch {
+		case err != nil:
+			return n, err
+		case wclosed:
+			return n, ErrorStreamClosed
+		}
+		if err := self.wait(self.writable, deadline); err != nil {
+			return n, err
+		}
+	}
+	return n, nil
+}
+
+// Half-closes the stream, i.e. the peer reads EOF once it read all data sent
+// so far.
+func (self *stream) CloseWrite() error {
+	self.Lock()
+	if self.wclosed || self.err != nil {
+		self.Unlock()
+		return nil
+	}
+	self.wclosed = true
+	self.Unlock()
+	return self.sess.write(frameClose, self.id, nil)
+}
+
+// Closes the stream, resetting it unless both ends finished sending.
+func (self *stream) Close() error {
+	self.Lock()
+	done := self.err != nil
+	clean := self.rclosed && self.wclosed
+	if !done {
+		self.err = ErrorStreamClosed
+	}
+	self.Unlock()
+	if done {
+		return nil
+	}
+	self.sess.remove(self.id)
+	notify(self.readable)
+	notify(self.writable)
+	if clean {
+		return nil
+	}
+	return self.sess.write(frameReset, self.id, nil)
+}
+
+func (self *stream) LocalAddr() net.Addr {
+	return streamAddr(self.id)
+}
+
+func (self *stream) RemoteAddr() net.Addr {
+	return self.sess.RemoteAddr()
+}
+
+func (self *stream) SetDeadline(t time.Time) error {
+	self.SetReadDeadline(t)
+	return self.SetWriteDeadline(t)
+}
+
+func (self *stream) SetReadDeadline(t time.Time) error {
+	self.Lock()
+	self.rd = t
+	self.Unlock()
+	notify(self.readable)
+	return nil
+}
+
+func (self *stream) SetWriteDeadline(t time.Time) error {
+	self.Lock()
+	self.wd = t
+	self.Unlock()
+	notify(self.writable)
+	return nil
+}
+
+// Queues received data, returning false if the peer exceeded its window.
+func (self *stream) push(data []byte) bool {
+	self.Lock()
+	defer self.Unlock()
+	if self.err != nil {
+		// Closed locally already, discard
+		return true
+	}
+	if len(self.buf)+len(data) > initialWindow {
+		return false
+	}
+	self.buf = append(self.buf, data...)
+	notify(self.readable)
+	return true
+}
+
+func (self *stream) remoteClose() {
+	self.Lock()
+	self.rclosed = true
+	self.Unlock()
+	notify(self.readable)
+}
+
+func (self *stream) grant(n uint32) {
+	self.Lock()
+	self.window += n
+	self.Unlock()
+	notify(self.writable)
+}
+
+func (self *stream) fail(err error) {
+	self.Lock()
+	if self.err == nil {
+		self.err = err
+	}
+	self.Unlock()
+	notify(self.readable)
+	notify(self.writable)
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,260 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package reverse implements reverse SOCKS, for proxies behind NAT or
+// firewalls not accepting inbound connections:
+// Instead of listening, the proxy dials out to a rendezvous endpoint, a
+// Controller, which then opens SOCKS sessions over that connection, each
+// session being a stream of a multiplexed Session.
+//
+// On the proxy:
+//
+//	srv := gosocksv5d.NewServer()
+//	proxy := &reverse.Proxy{Name: "branch-office"}
+//	proxy.Serve(ctx, srv, "controller.example.com:7000")
+//
+// On the controller, serving local SOCKS clients through the proxy:
+//
+//	ctrl := reverse.NewController(gosocksv5d.DefaultLogger)
+//	go ctrl.Serve(rendezvousListener)
+//	ctrl.Forward(socksListener, "branch-office")
+package reverse
+
+import "context"
+import "errors"
+import "io"
+import "net"
+import "sort"
+import "sync"
+import "time"
+import "github.com/nmaier/gosocksv5d"
+
+const (
+	helloMagic     = "GSR1"
+	helloTimeout   = 10 * time.Second
+	minDialBackoff = time.Second
+	maxDialBackoff = time.Minute
+)
+
+var (
+	ErrorHello        = errors.New("Invalid rendezvous hello")
+	ErrorUnknownProxy = errors.New("No such proxy connected")
+)
+
+// Proxy serves SOCKS sessions arriving over a connection it dials to a
+// Controller.
+type Proxy struct {
+	// Name the proxy registers as with the Controller, at most 255 bytes.
+	Name string
+
+	// Dials the controller, e.g. using TLS. Plain TCP if nil.
+	Dial func(ctx context.Context, network, addr string) (net.Conn, error)
+
+	// Logs connection failures. gosocksv5d.DefaultLogger if nil.
+	Logger gosocksv5d.Logger
+}
+
+// Serves sessions of srv over connections to the controller at addr,
+// redialing with exponential back-off whenever the connection fails, until
+// ctx is done.
+// Returns ctx.Err() then, or ErrorHello right away if the Name is too long.
+func (self *Proxy) Serve(ctx context.Context, srv gosocksv5d.Server, addr string) error {
+	if len(self.Name) > 255 {
+		return ErrorHello
+	}
+	dial := self.Dial
+	if dial == nil {
+		dial = (&net.Dialer{}).DialContext
+	}
+	logger := self.Logger
+	if logger == nil {
+		logger = gosocksv5d.DefaultLogger
+	}
+	var backoff time.Duration
+	for {
+		conn, err := dial(ctx, "tcp", addr)
+		if err == nil {
+			backoff = 0
+			err = self.serveConn(ctx, srv, conn)
+		}
+		if ctx.Err() != nil {
+			return ctx.Err()
+		}
+		if backoff == 0 {
+			backoff = minDialBackoff
+		} else if backoff *= 2; backoff > maxDialBackoff {
+			backoff = maxDialBackoff
+		}
+		logger.Printf("Rendezvous with %v failed: %v; retrying in %v", addr, err, backoff)
+		select {
+		case <-time.After(backoff):
+		case <-ctx.Done():
+			return ctx.Err()
+		}
+	}
+}
+
+func (self *Proxy) serveConn(ctx context.Context, srv gosocksv5d.Server, conn net.Conn) error {
+	hello := append([]byte(helloMagic), byte(len(self.Name)))
+	if _, err := conn.Write(append(hello, self.Name...)); err != nil {
+		conn.Close()
+		return err
+	}
+	sess := NewSession(conn, true)
+	defer sess.Close()
+	go func() {
+		select {
+		case <-ctx.Done():
+			sess.Close()
+		case <-sess.Done():
+		}
+	}()
+	for {
+		stream, err := sess.Accept()
+		if err != nil {
+			return err
+		}
+		go srv.HandleConn(ctx, stream)
+	}
+}
+
+// Controller accepts connections of Proxies, opening SOCKS sessions to them.
+type Controller struct {
+	sync.Mutex
+	gosocksv5d.Logger
+	sessions map[string]*Session
+}
+
+// Creates a new Controller, logging proxies coming and going to logger.
+func NewController(logger gosocksv5d.Logger) *Controller {
+	return &Controller{Logger: logger, sessions: make(map[string]*Session)}
+}
+
+// Accepts proxies connecting on l, until l fails or gets closed.
+// A proxy connecting replaces a connected one of the same name.
+func (self *Controller) Serve(l net.Listener) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go self.register(conn)
+	}
+}
+
+func (self *Controller) register(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(helloTimeout))
+	hello := make([]byte, len(helloMagic)+1)
+	if _, err := io.ReadFull(conn, hello); err != nil || string(hello[:len(helloMagic)]) != helloMagic {
+		self.Printf("Invalid hello from %v", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	name := make([]byte, hello[len(helloMagic)])
+	if _, err := io.ReadFull(conn, name); err != nil {
+		self.Printf("Invalid hello from %v", conn.RemoteAddr())
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	sess := NewSession(conn, false)
+	self.Lock()
+	prev := self.sessions[string(name)]
+	self.sessions[string(name)] = sess
+	self.Unlock()
+	if prev != nil {
+		prev.Close()
+	}
+	self.Printf("Proxy %q connected from %v", name, conn.RemoteAddr())
+
+	<-sess.Done()
+	self.Lock()
+	if self.sessions[string(name)] == sess {
+		delete(self.sessions, string(name))
+	}
+	self.Unlock()
+	self.Printf("Proxy %q disconnected", name)
+}
+
+// Opens a SOCKS session to the named proxy, i.e. returns a connection to
+// speak SOCKS over.
+func (self *Controller) Dial(name string) (net.Conn, error) {
+	self.Lock()
+	sess := self.sessions[name]
+	self.Unlock()
+	if sess == nil {
+		return nil, ErrorUnknownProxy
+	}
+	return sess.Open()
+}
+
+// Returns the names of the connected proxies.
+func (self *Controller) Names() []string {
+	self.Lock()
+	defer self.Unlock()
+	rv := make([]string, 0, len(self.sessions))
+	for name := range self.sessions {
+		rv = append(rv, name)
+	}
+	sort.Strings(rv)
+	return rv
+}
+
+// Forwards SOCKS clients accepted on l to the named proxy, until l fails or
+// gets closed. Clients get disconnected right away while the proxy is not
+// connected.
+func (self *Controller) Forward(l net.Listener, name string) error {
+	for {
+		conn, err := l.Accept()
+		if err != nil {
+			return err
+		}
+		go func() {
+			defer conn.Close()
+			stream, err := self.Dial(name)
+			if err != nil {
+				self.Printf("Cannot forward %v to %q: %v", conn.RemoteAddr(), name, err)
+				return
+			}
+			defer stream.Close()
+			done := make(chan struct{})
+			go func() {
+				pipe(stream, conn)
+				close(done)
+			}()
+			pipe(conn, stream)
+			<-done
+		}()
+	}
+}
+
+// Copies src to dst, half-closing dst afterwards.
+func pipe(dst, src net.Conn) {
+	io.Copy(dst, src)
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		dst.Close()
+	}
+}
+
+// vim: set noet ts=2 sw=2:
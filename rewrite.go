@@ -0,0 +1,132 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "net"
+import "strconv"
+import "strings"
+
+// Rewriter implements destination rewriting (think NAT), transparent to the
+// client.
+type Rewriter interface {
+	// Returns the destination to connect to instead of the requested one.
+	// Hosts are either domain names or textual IPs.
+	// Return the requested host and port to leave a request alone.
+	Rewrite(client *ClientInfo, host string, port int) (string, int)
+}
+
+type rewriteTarget struct {
+	host string
+	port int
+}
+
+// RewriteMap implements a Rewriter using a static mapping.
+//
+// Examples:
+//
+//	rewrites := gosocksv5d.NewRewriteMap()
+//	rewrites.Add("old-service.corp:443", "new-host:8443")
+//	rewrites.Add("legacy.corp", "10.0.0.1") // all ports, keeping the port
+//	rewrites.Add("www.example.com:80", ":443") // just the port
+//	rewrites.Add(":8080", ":80") // all hosts
+//	server.SetRewriter(rewrites)
+type RewriteMap struct {
+	targets map[string]rewriteTarget
+}
+
+// Creates a new, empty RewriteMap.
+func NewRewriteMap() *RewriteMap {
+	return &RewriteMap{make(map[string]rewriteTarget)}
+}
+
+// Adds a new mapping. Both from and to may either be a "host:port" pair,
+// just a host or just a ":port". Mapping just a host applies to all ports,
+// mapping just a port to all hosts. Mapping to just a host keeps the
+// requested port, mapping to just a port keeps the requested host.
+// More specific mappings take precedence.
+func (self *RewriteMap) Add(from, to string) error {
+	fhost, fport, err := splitHostPort(from)
+	if err != nil {
+		return err
+	}
+	thost, tport, err := splitHostPort(to)
+	if err != nil {
+		return err
+	}
+	self.targets[joinHostPort(fhost, fport)] = rewriteTarget{thost, tport}
+	return nil
+}
+
+func (self *RewriteMap) Rewrite(client *ClientInfo, host string, port int) (string, int) {
+	name := strings.ToLower(host)
+	target, ok := self.targets[joinHostPort(name, port)]
+	if !ok {
+		target, ok = self.targets[joinHostPort(name, 0)]
+	}
+	if !ok {
+		target, ok = self.targets[joinHostPort("", port)]
+	}
+	if !ok {
+		return host, port
+	}
+	if len(target.host) != 0 {
+		host = target.host
+	}
+	if target.port != 0 {
+		port = target.port
+	}
+	return host, port
+}
+
+// Splits "host:port", ":port" or just "host", resulting in an empty host or
+// zero port for the missing parts. IPs and domain names get canonicalized.
+func splitHostPort(dest string) (host string, port int, err error) {
+	host, sport, err := net.SplitHostPort(dest)
+	if err != nil {
+		host, sport, err = strings.Trim(dest, "[]"), "", nil
+	}
+	if len(sport) != 0 {
+		port, err = strconv.Atoi(sport)
+		if err != nil || port <= 0 || port > 0xffff {
+			return "", 0, ErrorAddress
+		}
+	}
+	if len(host) == 0 && port == 0 {
+		return "", 0, ErrorAddress
+	}
+	if ip := net.ParseIP(host); ip != nil {
+		return ip.String(), port, nil
+	}
+	if len(host) == 0 {
+		return "", port, nil
+	}
+	if host, err = NormalizeDomain(host); err != nil {
+		return "", 0, err
+	}
+	return host, port, nil
+}
+
+func joinHostPort(host string, port int) string {
+	return net.JoinHostPort(host, strconv.Itoa(port))
+}
+
+// vim: set noet ts=2 sw=2:
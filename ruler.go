@@ -33,20 +33,41 @@ var (
 type RulerResult int
 
 const (
-	DenyConnection  RulerResult = iota // Ruler allows this connection
-	AllowConnection                    // Ruler denies this connection
+	DenyConnection  RulerResult = iota // Ruler denies this connection
+	AllowConnection                    // Ruler allows this connection
+	DeferConnection                    // Ruler leaves the decision to the IP based checks
+)
+
+// RulerMode specifies how the Ruler verdicts for the IPs a domain resolved to
+// are combined.
+type RulerMode int
+
+const (
+	RulerSkipDenied RulerMode = iota // Skip denied IPs; fail only if none is allowed
+	RulerDenyAny                     // Fail if any of the IPs is denied
 )
 
 // Ruler implements access rule sets.
 // Each connection attempt will check the Ruler whether this connection should be allowed or not.
 type Ruler interface {
-	// Requestee is allowed to connect to the request IP via a socksv5d server.
-	ConnectionAllowed(requestee, requested net.IP) RulerResult
+	// Client is allowed to connect to the requested IP via a socksv5d server.
+	ConnectionAllowed(client *ClientInfo, requested net.IP) RulerResult
+}
+
+// DomainRuler may additionally be implemented by a Ruler, to check requests
+// for domain names before these get resolved.
+type DomainRuler interface {
+	// Client is allowed to connect to the requested domain.
+	// Returning DeferConnection will check the resolved IPs via
+	// ConnectionAllowed() instead, while AllowConnection only checks them
+	// against the DefaultRuler, denying local IPs, and RebindProtection.
+	// The domain is passed in its NormalizeDomain() form.
+	DomainAllowed(client *ClientInfo, domain string) RulerResult
 }
 
 type defaultRuler struct{}
 
-func (self *defaultRuler) ConnectionAllowed(requestee, requested net.IP) RulerResult {
+func (self *defaultRuler) ConnectionAllowed(client *ClientInfo, requested net.IP) RulerResult {
 	if !requested.IsGlobalUnicast() {
 		return DenyConnection
 	}
@@ -68,3 +89,7 @@ func (self *defaultRuler) ConnectionAllowed(requestee, requested net.IP) RulerRe
 	}
 	return AllowConnection
 }
+
+func (self *defaultRuler) DenialReason(client *ClientInfo, domain string, requested net.IP) string {
+	return ReasonDefaultLocal
+}
@@ -0,0 +1,323 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "errors"
+import "net"
+import "path"
+import "regexp"
+import "sort"
+import "strings"
+import "sync/atomic"
+import "time"
+
+var (
+	ErrorPattern = errors.New("Invalid pattern!")
+)
+
+type domainRule struct {
+	ruleHits
+	pattern string
+	result  RulerResult
+	opts    *SessionOptions
+}
+
+// Match counter of a rule.
+type ruleHits struct {
+	hits uint64
+	last int64 // Unix nanoseconds of the last match
+}
+
+func (self *ruleHits) hit() {
+	atomic.AddUint64(&self.hits, 1)
+	atomic.StoreInt64(&self.last, time.Now().UnixNano())
+}
+
+func (self *ruleHits) snapshot(pattern string, result RulerResult) RuleHits {
+	rv := RuleHits{Pattern: pattern, Result: result, Hits: atomic.LoadUint64(&self.hits)}
+	if last := atomic.LoadInt64(&self.last); last != 0 {
+		rv.LastHit = time.Unix(0, last)
+	}
+	return rv
+}
+
+// Matches of a rule, e.g. to find stale or noisy rules.
+type RuleHits struct {
+	Pattern string
+	Result  RulerResult
+	Hits    uint64    // Times the rule decided a request, or one of its IPs
+	LastHit time.Time // Zero if never
+}
+
+// RuleCounter may additionally be implemented by a Ruler, to report the
+// matches of its rules, e.g. in Stats.Rules.
+type RuleCounter interface {
+	Hits() []RuleHits
+}
+
+type patternRule struct {
+	evaluations uint64
+	matches     uint64
+	nanos       uint64
+	domainRule
+	match func(domain string) bool
+	glob  bool // Whether pattern is a glob, rather than a regular expression
+}
+
+func (self *patternRule) eval(domain string, count bool) bool {
+	if !count {
+		return self.match(domain)
+	}
+	start := time.Now()
+	matched := self.match(domain)
+	atomic.AddUint64(&self.nanos, uint64(time.Since(start)))
+	atomic.AddUint64(&self.evaluations, 1)
+	if matched {
+		atomic.AddUint64(&self.matches, 1)
+	}
+	return matched
+}
+
+// Evaluation statistics of a regular expression or glob rule.
+type RuleStats struct {
+	Pattern     string
+	Evaluations uint64
+	Matches     uint64
+	Duration    time.Duration // Total time spent evaluating the pattern
+}
+
+// RuleSet implements a Ruler matching the unresolved domain names of requests
+// against a set of patterns. Requests for IPs, as well as domains not matching
+// any pattern, are checked by the fallback Ruler.
+//
+// Supported patterns:
+//   - "example.com" matches example.com only
+//   - "*.example.com" matches all subdomains of example.com, but not
+//     example.com itself
+//   - ".example.com" matches example.com and all subdomains
+//
+// The most specific pattern wins. International domain names may be given
+// in either their Unicode or ASCII ("xn--") form.
+//
+// Regular expression and glob rules are only evaluated, in the order they were
+// added, when none of the above patterns matched.
+//
+// Add all rules before passing the RuleSet to a server.
+type RuleSet struct {
+	fallback Ruler
+	exact    map[string]*domainRule
+	wildcard map[string]*domainRule
+	suffix   map[string]*domainRule
+	patterns []*patternRule
+}
+
+// Creates a new, empty RuleSet.
+// See: gosocksv5d.DefaultRuler
+func NewRuleSet(fallback Ruler) *RuleSet {
+	return &RuleSet{
+		fallback,
+		make(map[string]*domainRule),
+		make(map[string]*domainRule),
+		make(map[string]*domainRule),
+		nil,
+	}
+}
+
+// Adds a new pattern, replacing any existing rule for the same pattern.
+func (self *RuleSet) Add(pattern string, result RulerResult) error {
+	name, rules := pattern, self.exact
+	switch {
+	case strings.HasPrefix(name, "*."):
+		name = name[2:]
+		rules = self.wildcard
+	case strings.HasPrefix(name, "."):
+		name = name[1:]
+		rules = self.suffix
+	}
+	name, err := NormalizeDomain(name)
+	if err != nil {
+		return ErrorPattern
+	}
+	rules[name] = &domainRule{pattern: pattern, result: result}
+	return nil
+}
+
+// Adds a regular expression rule. The expression has to match the whole
+// (lower case) domain name, in its ASCII form, i.e. international domain
+// names are punycode encoded ("xn--").
+func (self *RuleSet) AddRegexp(expr string, result RulerResult) error {
+	re, err := regexp.Compile("^(?:" + expr + ")$")
+	if err != nil {
+		return err
+	}
+	self.addPattern(expr, result, re.MatchString)
+	return nil
+}
+
+// Adds a glob rule, using path.Match() syntax, e.g. "cdn-*.example.???".
+func (self *RuleSet) AddGlob(pattern string, result RulerResult) error {
+	pattern, err := toASCII(strings.TrimSuffix(pattern, "."))
+	if err != nil {
+		return ErrorPattern
+	}
+	if _, err := path.Match(pattern, ""); err != nil {
+		return err
+	}
+	self.addPattern(pattern, result, func(domain string) bool {
+		matched, _ := path.Match(pattern, domain)
+		return matched
+	})
+	self.patterns[len(self.patterns)-1].glob = true
+	return nil
+}
+
+func (self *RuleSet) addPattern(pattern string, result RulerResult, match func(string) bool) {
+	rule := &patternRule{domainRule: domainRule{pattern: pattern, result: result}, match: match}
+	self.patterns = append(self.patterns, rule)
+}
+
+// Returns the evaluation statistics of all regular expression and glob rules.
+func (self *RuleSet) Stats() []RuleStats {
+	stats := make([]RuleStats, len(self.patterns))
+	for i, rule := range self.patterns {
+		stats[i] = RuleStats{
+			rule.pattern,
+			atomic.LoadUint64(&rule.evaluations),
+			atomic.LoadUint64(&rule.matches),
+			time.Duration(atomic.LoadUint64(&rule.nanos)),
+		}
+	}
+	return stats
+}
+
+// Returns the matches of all rules, domain rules ordered by pattern, then
+// regular expression and glob rules in the order they were added, followed
+// by the ones of the fallback Ruler, if a RuleCounter.
+func (self *RuleSet) Hits() []RuleHits {
+	var rv []RuleHits
+	var domains []*domainRule
+	for _, rules := range []map[string]*domainRule{self.exact, self.wildcard, self.suffix} {
+		for _, rule := range rules {
+			domains = append(domains, rule)
+		}
+	}
+	sort.Slice(domains, func(i, j int) bool {
+		return domains[i].pattern < domains[j].pattern
+	})
+	for _, rule := range domains {
+		rv = append(rv, rule.snapshot(rule.pattern, rule.result))
+	}
+	for _, rule := range self.patterns {
+		rv = append(rv, rule.snapshot(rule.pattern, rule.result))
+	}
+	if rc, ok := self.fallback.(RuleCounter); ok {
+		rv = append(rv, rc.Hits()...)
+	}
+	return rv
+}
+
+// Attaches SessionOptions to the rule previously added for pattern, applied
+// to the connections the rule allows.
+func (self *RuleSet) SetOptions(pattern string, opts *SessionOptions) error {
+	for _, rules := range []map[string]*domainRule{self.exact, self.wildcard, self.suffix} {
+		for _, rule := range rules {
+			if rule.pattern == pattern {
+				rule.opts = opts
+				return nil
+			}
+		}
+	}
+	for _, rule := range self.patterns {
+		if rule.pattern == pattern {
+			rule.opts = opts
+			return nil
+		}
+	}
+	return ErrorPattern
+}
+
+// Returns the rule matching domain, if any. Evaluations of regular expression
+// and glob rules only count towards their Stats() when count is set.
+func (self *RuleSet) match(domain string, count bool) *domainRule {
+	domain = strings.TrimSuffix(strings.ToLower(domain), ".")
+	if rule, ok := self.exact[domain]; ok {
+		return rule
+	}
+	if rule, ok := self.suffix[domain]; ok {
+		return rule
+	}
+	for name := domain; ; {
+		i := strings.IndexByte(name, '.')
+		if i < 0 {
+			break
+		}
+		name = name[i+1:]
+		if rule, ok := self.wildcard[name]; ok {
+			return rule
+		}
+		if rule, ok := self.suffix[name]; ok {
+			return rule
+		}
+	}
+	for _, rule := range self.patterns {
+		if rule.eval(domain, count) {
+			return &rule.domainRule
+		}
+	}
+	return nil
+}
+
+func (self *RuleSet) ConnectionAllowed(client *ClientInfo, requested net.IP) RulerResult {
+	return self.fallback.ConnectionAllowed(client, requested)
+}
+
+func (self *RuleSet) DomainAllowed(client *ClientInfo, domain string) RulerResult {
+	if rule := self.match(domain, true); rule != nil {
+		rule.hit()
+		return rule.result
+	}
+	if dr, ok := self.fallback.(DomainRuler); ok {
+		return dr.DomainAllowed(client, domain)
+	}
+	return DeferConnection
+}
+
+func (self *RuleSet) SessionOptions(client *ClientInfo, host string, ips []net.IP, port int) *SessionOptions {
+	if len(host) != 0 {
+		if rule := self.match(host, false); rule != nil {
+			return rule.opts
+		}
+	}
+	if sr, ok := self.fallback.(SessionRuler); ok {
+		return sr.SessionOptions(client, host, ips, port)
+	}
+	return nil
+}
+
+func (self *RuleSet) DenialReason(client *ClientInfo, domain string, requested net.IP) string {
+	if requested == nil {
+		return ReasonDomainRule
+	}
+	return denialReason(self.fallback, client, domain, requested)
+}
+
+// vim: set noet ts=2 sw=2:
@@ -23,7 +23,10 @@
 Package gosocksv5d implements a SOCKS v5 server.
 
 The server supports a subset of RFC 1928:
- - Only "No Authentication" auth method
+ - "No Authentication" auth method, by default
+ - Private auth methods (0x80 - 0xFE), registered via SetAuthMethod;
+   once any is registered, clients have to authenticate, unless allowed
+   otherwise via SetAllowNoAuth
  - Only "Connect" command
  - All defined address types: IPv4, IPv6, domain name
 
@@ -37,22 +40,46 @@ Examples:
 */
 package gosocksv5d
 
+import "context"
 import "errors"
 import "net"
+import "sync"
+import "sync/atomic"
+import "time"
 
 var (
-	ErrorAlreadyListening = errors.New("Already listening")
+	ErrorAlreadyListening  = errors.New("Already listening")
+	ErrorServerClosed      = errors.New("Server closed")
+	ErrorTooManyHandshakes = errors.New("Too many handshakes")
+)
+
+const (
+	defaultBacklog = 10
+	shutdownPoll   = 100 * time.Millisecond
 )
 
 // Server implements a socks v5 server.
 type Server interface {
 	// Starts a new server. The server will bind to the provided IP and port.
-	// Once running, the call will never return, so you better call this from a
-	// goroutine.
+	// Once running, the call will only return when the listener fails, so you
+	// better call this from a goroutine.
 	ListenAndServe(ip net.IP, port int) error
 
+	// Like ListenAndServe(), with options for the sessions of this listener.
+	// These take precedence over SetSessionDefaults(), but not over the options
+	// of a SessionRuler.
+	ListenAndServeWithOptions(ip net.IP, port int, opts SessionOptions) error
+
+	// Serves a single connection accepted by other means, e.g. a custom
+	// listener or connection multiplexer, returning once done, with the error
+	// ending the session, if any. The connection gets closed when ctx is done.
+	// Connections not supporting half-closing get closed entirely once the
+	// destination finished sending.
+	HandleConn(ctx context.Context, conn net.Conn) error
+
 	// Set a new DNS resolver, in case you don't like the default one.
-	// See: gosocksv5d.DefaultResolver
+	// The resolver is used as is; wrap it to shuffle the IPs it returns.
+	// See: gosocksv5d.DefaultResolver, gosocksv5d.NewShuffleResolver()
 	// Attempting to set this after calling ListenAndServer will panic()
 	SetDNSResolver(resolver DNSResolver)
 
@@ -66,108 +93,493 @@ type Server interface {
 	// Attempting to set this after calling ListenAndServer will panic()
 	SetRuler(ruler Ruler)
 
+	// Set how the Ruler verdicts for the IPs of a domain are combined.
+	// See: gosocksv5d.RulerSkipDenied (default), gosocksv5d.RulerDenyAny
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetRulerMode(mode RulerMode)
+
+	// Set an AccessLogger, receiving a record for each request.
+	// Nil disables access logging, which is the default.
+	// See: gosocksv5d.NewFail2banLogger()
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetAccessLogger(logger AccessLogger)
+
+	// Enrich access records with the reverse DNS names of clients and
+	// destinations, caching names for the specified duration.
+	// Lookups happen asynchronously, so records may be delivered out of order.
+	// A zero duration disables lookups, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetReverseDNS(ttl time.Duration)
+
+	// Set a Rewriter, mapping requested destinations to the actual ones.
+	// Rulers will see the rewritten destinations.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetRewriter(rewriter Rewriter)
+
+	// Pin the IP a client got connected to for a domain for the specified
+	// duration, so that further requests of the same client for the same domain
+	// will prefer the same IP (if still resolved). A zero duration disables
+	// pinning, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetDNSPinning(ttl time.Duration)
+
+	// Set a RebindProtection, rejecting domains resolving to internal IPs.
+	// Nil disables the protection, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetRebindProtection(protection *RebindProtection)
+
+	// Limit the number of connections simultaneously negotiating, i.e. not
+	// relaying yet. Connections exceeding the limit get closed immediately.
+	// A limit of 0 means no limit, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetMaxHandshakes(limit int)
+
+	// Set the depth of the queue between accepting and serving connections.
+	// When the queue is full, accepting waits, leaving further connections to
+	// the kernel backlog, unless drop is set, in which case connections not
+	// fitting into the queue are closed right away.
+	// The default is a depth of 10, waiting when full.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetAcceptBacklog(depth int, drop bool)
+
+	// Set up banning misbehaving clients.
+	// Nil disables banning, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetAutoBan(ban *AutoBan)
+
+	// Set the networks of trusted proxies, such as load balancers.
+	// Connections from trusted proxies must start with a PROXY protocol
+	// (v1 or v2) header, and the client address it carries will be used instead
+	// of the one of the connection.
+	// Headers are never read from untrusted connections. No proxies are
+	// trusted by default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetTrustedProxies(networks ...*net.IPNet)
+
+	// Set the options for sessions, unless overridden by a SessionRuler.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetSessionDefaults(opts SessionOptions)
+
+	// Define a bandwidth class, as referenced by SessionOptions, limiting each
+	// direction of a session to rate bytes per second.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetBandwidthClass(name string, rate int64)
+
+	// Set up a Honeypot, capturing what clients send to denied destinations.
+	// Nil rejects denied requests right away, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetHoneypot(honeypot *Honeypot)
+
+	// Set up delaying or dropping error replies to clients repeatedly failing
+	// the protocol. Nil replies to all errors right away, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetErrorReplies(replies *ErrorReplies)
+
+	// Set a DNSQueryLogger, receiving every lookup performed for clients.
+	// Nil disables query logging, which is the default.
+	// See: gosocksv5d.NewJSONQueryLogger(), gosocksv5d.NewChannelQueryLogger()
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetDNSQueryLogger(logger DNSQueryLogger)
+
+	// Set how the IPs a domain resolved to get ordered before connecting.
+	// See: gosocksv5d.OrderAsResolved (default), gosocksv5d.OrderRFC6724
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetAddressOrder(order AddressOrder)
+
+	// Enable Multipath TCP for accepting client connections, and for dialing
+	// destinations, falling back to plain TCP where not supported by the
+	// system or peer. Both are disabled by default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetMultipathTCP(listen, dial bool)
+
+	// Register a private authentication method (0x80 - 0xFE), for bespoke
+	// clients. When offered by a client, registered methods take precedence
+	// over no authentication, in the order the client offered them.
+	// Once any method is registered, clients have to authenticate, i.e.
+	// select a method yielding an identity, unless allowed otherwise by
+	// SetAllowNoAuth().
+	// Nil unregisters the method.
+	// Attempting to register other method numbers will panic()
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetAuthMethod(method byte, auth AuthMethod)
+
+	// Allow clients to go without authenticating despite registered
+	// AuthMethods, i.e. to select no authentication, or methods not yielding
+	// an identity, such as DeflateMethod. Clients are allowed so by default
+	// only as long as no method is registered.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetAllowNoAuth(allow bool)
+
+	// Set a Reporter, receiving recovered panics and internal errors, along
+	// with stack traces and connection context.
+	// Nil only logs them, which is the default.
+	// See: gosocksv5d.NewLogReporter(), gosocksv5d.NewSentryReporter()
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetReporter(reporter Reporter)
+
+	// Close sessions once one direction finished, if the other one does not
+	// relay anything for timeout, e.g. as its peer vanished without closing
+	// the connection. Zero keeps such sessions until their idle timeout, which
+	// is the default.
+	// Sessions are closed as soon as either peer is found dead regardless, i.e.
+	// reset the connection or stopped answering TCP keepalive probes.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetHalfOpenTimeout(timeout time.Duration)
+
+	// Set whether client and destination sockets disable Nagle's algorithm
+	// (TCP_NODELAY), which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetNoDelay(noDelay bool)
+
+	// Set the TCP keepalive period of client and destination sockets.
+	// Zero keeps the default of 15 seconds, negative disables keepalives.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetKeepAlive(period time.Duration)
+
+	// Set a SocketHook, getting access to the raw client and destination
+	// sockets, e.g. to set further socket options.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetSocketHook(hook SocketHook)
+
+	// Sniff the Host of plaintext HTTP requests to the ports, logging it, and
+	// checking it against the domain rules of the Ruler, if a DomainRuler,
+	// closing sessions to denied hosts. Hosts the rules defer on get checked
+	// by the IPs they resolve to, as requested domains do. Disabled by default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetHostSniffing(ports ...int)
+
+	// Set up checking clients speak the protocols expected for destination
+	// ports. Nil disables checking, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetProtocolEnforcement(enforcement *ProtocolEnforcement)
+
+	// Set a candidate Ruler, evaluated alongside the active one without
+	// affecting any requests, logging the requests it would have decided
+	// differently, e.g. to validate a new policy before enforcing it.
+	// Nil disables the dry run, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetDryRunRuler(ruler Ruler)
+
+	// Set a SharedStore, sharing bans and quota usage with other instances
+	// using the same store, e.g. a RedisStore. Nil keeps all state local,
+	// which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetSharedStore(store SharedStore)
+
+	// Limit the bytes relayed per identity or client within a period.
+	// Nil disables the quota, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetQuota(quota *Quota)
+
+	// Limit the requests and concurrent sessions per identity or client.
+	// Nil disables the limits, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetLimits(limits *Limits)
+
+	// Fail requests fast to destinations dialing failed for repeatedly.
+	// Does not apply to sessions established via Upstreams.
+	// Nil disables the circuit breaker, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetCircuitBreaker(breaker *CircuitBreaker)
+
+	// Check the health of upstreams, so that sessions get rerouted per
+	// SessionOptions.Failover while the first hop of their chain is down.
+	// Nil disables the health checks, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetUpstreamHealth(health *UpstreamHealth)
+
+	// Count sessions and bytes by the values of these tag keys, see
+	// SessionOptions.Tags and Stats.Tagged. Better pick keys of few distinct
+	// values, e.g. a policy name, rather than a customer ID of many.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetMetricTags(keys ...string)
+
+	// Divide rate bytes per second and direction fairly across the clients
+	// relaying, i.e. identities, or IPs if not authenticated, regardless of
+	// how many connections each uses. Applies besides bandwidth classes.
+	// Zero disables fair sharing, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetFairBandwidth(rate int64)
+
+	// Refuse requests with ReplyFailure while the approximate memory of the
+	// sessions relaying would exceed the budget, instead of risking running
+	// out of memory, see Stats.Memory.
+	// Nil disables the budget, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetMemoryBudget(budget *MemoryBudget)
+
+	// Relay sessions with engine, unless overridden by
+	// SessionOptions.RelayEngine, e.g. SpliceEngine.
+	// Nil relays with CopyEngine, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetRelayEngine(engine RelayEngine)
+
+	// Notify alerters once metrics, such as the connections open, cross
+	// thresholds, and once they recover. Nil disables alerts, which is the
+	// default.
+	// Watching starts with the first listener, or connection handled, and
+	// stops on Shutdown, closing the Alerters implementing io.Closer.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetAlerts(alerts *Alerts)
+
+	// Dial destinations, upstreams and upstream health checks via dialer,
+	// unless overridden by SessionOptions.Dialer, e.g. through a userspace
+	// network stack. Nil dials directly, which is the default.
+	// Attempting to set this after calling ListenAndServer will panic()
+	SetDialer(dialer Dialer)
+
+	// Returns a snapshot of the server counters.
+	Stats() Stats
+
+	// Resolves domain on behalf of client as for a request, i.e. subject to
+	// the domain and IP rules, and rebinding protection, returning
+	// ErrorNotAllowed or ErrorRebinding if denied, and the allowed IPs
+	// otherwise. See DNSForwarder.
+	Resolve(client *ClientInfo, domain string) ([]net.IP, error)
+
+	// Returns the n destinations (all if n <= 0) most bytes got relayed to
+	// and from within the last window, of at most an hour, by sessions that
+	// ended within the window, in descending order.
+	TopDestinations(n int, window time.Duration) []DestinationTraffic
+
+	// Returns the sessions currently relaying, oldest first.
+	Sessions() []Session
+
+	// Returns whether the server is currently accepting connections.
+	State() ServerState
+
+	// Registers a channel to be notified about state transitions, e.g. to get
+	// a readiness signal once the server is listening.
+	// Notifications are sent without blocking, so use a buffered channel.
+	NotifyState(c chan<- ServerState)
+
 	// Stops the server again from accepting new connections.
 	// Already accepted connection will still be served!
+	// Stopping a stopped server does nothing.
 	Stop()
 
 	// Allows the server to accept new connections (again).
 	// You don't need to Continue() after ListenAndServe().
+	// Should listening fail again, ListenAndServe() will return the error, for
+	// each listener failing, while the others continue.
 	Continue()
-}
 
-type connChan chan *net.TCPConn
-type boolChan chan bool
+	// Stops the server, just like Stop(), and closes all connections currently
+	// being served as well.
+	// Returns the number of connections closed.
+	Terminate() int
+
+	// Stops the server for good, waiting for the connections being served to
+	// finish, until ctx is done, closing the remaining connections then and
+	// returning the ctx error.
+	// ListenAndServe() calls return ErrorServerClosed.
+	Shutdown(ctx context.Context) error
+}
 
 type server struct {
-	running   boolChan
-	instances int
+	stats serverStats
+	sync.Mutex
+	listeners map[*listener]struct{}
+	state     ServerState
+	notify    []chan<- ServerState
+	closing   chan struct{}
+	closed    bool
+	sessions  *sessionSet
 	DNSResolver
 	Logger
 	Ruler
+	rulerMode RulerMode
+	Rewriter
+	AccessLogger
+	rdns            *reverseResolver
+	pins            *pinCache
+	rebind          *RebindProtection
+	handshakes      chan struct{}
+	backlog         int
+	dropOnFull      bool
+	bans            *banList
+	trustedProxies  []*net.IPNet
+	sessionDefaults SessionOptions
+	bandwidth       map[string]int64
+	honeypot        *Honeypot
+	errorReplies    *errorReplies
+	queryLogger     DNSQueryLogger
+	addressOrder    AddressOrder
+	mptcpListen     bool
+	mptcpDial       bool
+	authMethods     map[byte]AuthMethod
+	allowNoAuth     bool
+	reporter        Reporter
+	halfOpen        time.Duration
+	delay           bool
+	keepAlive       time.Duration
+	socketHook      SocketHook
+	sniffPorts      map[int]bool
+	protocols       *ProtocolEnforcement
+	dryRun          Ruler
+	store           SharedStore
+	local           SharedStore // Fallback of store
+	quota           *Quota
+	limits          *Limits
+	circuits        *circuits
+	health          *upstreamHealth
+	poolNext        atomic.Uint64
+	tagged          *taggedStats
+	fair            []*fairQueue // Up, down
+	memory          *memoryBudget
+	relayEngine     RelayEngine
+	dials           *dialSlots
+	alerts          *alertWatch
+	dialer          Dialer
 }
 
 // Creates a new server.
 // Afterwards, set up the instance as desired in terms of logger, resolver, etc.
 // Then call ListenAndServe()
 func NewServer() Server {
-	return &server{make(boolChan, 1), 0, DefaultResolver, DefaultLogger, DefaultRuler}
-}
-
-func (self *server) listen(c connChan, ip net.IP, port int) (l net.Listener, err error) {
-	proto := "tcp"
-	if ip.To4() == nil {
-		proto = "tcp6"
-	}
-	l, err = net.ListenTCP(proto, &net.TCPAddr{ip, int(port)})
-	if err == nil {
-		go func() {
-			for {
-				conn, err := l.Accept()
-				if err != nil {
-					if ne, ok := err.(net.Error); ok && ne.Temporary() {
-						self.Printf("Error while accepting: %v", err)
-						continue
-					}
-				}
-				tconn, ok := conn.(*net.TCPConn)
-				if !ok {
-					self.Print("Failed to accept; not tcp")
-					conn.Close()
-					continue
-				}
-				c <- tconn
-			}
-		}()
+	return &server{
+		stats:       newServerStats(),
+		listeners:   make(map[*listener]struct{}),
+		closing:     make(chan struct{}),
+		sessions:    newSessionSet(),
+		backlog:     defaultBacklog,
+		bandwidth:   make(map[string]int64),
+		authMethods: make(map[byte]AuthMethod),
+		local:       NewMemoryStore(),
+		DNSResolver: DefaultResolver,
+		Logger:      DefaultLogger,
+		Ruler:       DefaultRuler,
 	}
-	return
 }
 
 func (self *server) ListenAndServe(ip net.IP, port int) error {
-	conns := make(connChan, 10)
-
-	var l net.Listener
-	var err error
+	return self.ListenAndServeWithOptions(ip, port, SessionOptions{})
+}
 
-	self.Printf("Starting sock server for %v:%d", ip, port)
-	l, err = self.listen(conns, ip, port)
+func (self *server) ListenAndServeWithOptions(ip net.IP, port int, opts SessionOptions) error {
+	l, err := self.listen(ip, port, opts)
 	if err != nil {
 		return err
 	}
-	self.instances++
+	return self.serve(l)
+}
+
+// Starts listening, without serving yet.
+func (self *server) listen(ip net.IP, port int, opts SessionOptions) (*listener, error) {
+	if self.isClosed() {
+		return nil, ErrorServerClosed
+	}
+	l := newListener(self, ip, port, opts)
+
+	self.Printf("Starting sock server for %v:%d", ip, port)
+	if err := l.start(); err != nil {
+		self.Lock()
+		if len(self.listeners) == 0 {
+			self.setState(StateFailed)
+		}
+		self.Unlock()
+		return nil, err
+	}
+	self.addListener(l)
+	return l, nil
+}
+
+// Serves the connections of a listener, until it fails or the server closes.
+func (self *server) serve(l *listener) error {
+	defer self.removeListener(l)
 
 	for {
 		select {
-		case running := <-self.running:
-			switch {
-			case !running && l != nil:
-				l.Close()
-				l = nil
-				self.instances--
-
-			case running && l == nil:
-				l, err = self.listen(conns, ip, port)
-				if err != nil {
-					return err
-				}
-				self.instances++
+		case err := <-l.died:
+			l.stop()
+			self.Lock()
+			// Failed only once no listener is left accepting
+			delete(self.listeners, l)
+			if len(self.listeners) == 0 {
+				self.setState(StateFailed)
+			}
+			self.Unlock()
+			return err
+		case <-self.closing:
+			l.stop()
+			l.drain()
+			return ErrorServerClosed
+		case conn := <-l.conns:
+			atomic.AddInt64(&self.stats.queueDepth, -1)
+			if !self.acquireHandshake() {
+				atomic.AddUint64(&self.stats.rejected, 1)
+				self.Printf("Too many handshakes, rejecting %v", conn.RemoteAddr())
+				conn.Close()
+				continue
 			}
-		case conn := <-conns:
-			sock := newSockConn(conn, self, self, self)
-			go sock.handle(ip)
+			sock := newSockConn(conn, self)
+			self.sessions.add(sock)
+			go sock.handle(l)
+		}
+	}
+}
+
+func (self *server) HandleConn(ctx context.Context, conn net.Conn) error {
+	if self.isClosed() {
+		conn.Close()
+		return ErrorServerClosed
+	}
+	if !self.acquireHandshake() {
+		atomic.AddUint64(&self.stats.rejected, 1)
+		self.Printf("Too many handshakes, rejecting %v", conn.RemoteAddr())
+		conn.Close()
+		return ErrorTooManyHandshakes
+	}
+	if self.alerts != nil {
+		self.alerts.start()
+	}
+	ip := net.IPv4zero
+	if addr, ok := conn.LocalAddr().(*net.TCPAddr); ok {
+		ip = addr.IP
+	}
+
+	done := make(chan struct{})
+	defer close(done)
+	go func() {
+		select {
+		case <-ctx.Done():
+			conn.Close()
+		case <-done:
 		}
+	}()
+
+	sock := newSockConn(conn, self)
+	self.sessions.add(sock)
+	return sock.handle(&listener{srv: self, ip: ip})
+}
+
+func (self *server) addListener(l *listener) {
+	self.Lock()
+	defer self.Unlock()
+	self.listeners[l] = struct{}{}
+	self.setState(StateListening)
+	if self.alerts != nil {
+		self.alerts.start()
 	}
-	panic("Not reached!")
+}
+
+func (self *server) removeListener(l *listener) {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.listeners, l)
 }
 
 func (self *server) panicIfListening() {
-	if self.instances > 0 {
+	self.Lock()
+	defer self.Unlock()
+	if len(self.listeners) > 0 {
 		panic(ErrorAlreadyListening)
 	}
 }
 
 func (self *server) SetDNSResolver(resolver DNSResolver) {
 	self.panicIfListening()
-	self.DNSResolver = shuffleResolver{resolver}
+	self.DNSResolver = resolver
 }
 
 func (self *server) SetLogger(logger Logger) {
@@ -180,16 +592,401 @@ func (self *server) SetRuler(ruler Ruler) {
 	self.Ruler = ruler
 }
 
+func (self *server) SetAccessLogger(logger AccessLogger) {
+	self.panicIfListening()
+	self.AccessLogger = logger
+}
+
+func (self *server) SetReverseDNS(ttl time.Duration) {
+	self.panicIfListening()
+	self.rdns = nil
+	if ttl > 0 {
+		self.rdns = newReverseResolver(ttl)
+	}
+}
+
+func (self *server) SetRulerMode(mode RulerMode) {
+	self.panicIfListening()
+	self.rulerMode = mode
+}
+
+func (self *server) SetRewriter(rewriter Rewriter) {
+	self.panicIfListening()
+	self.Rewriter = rewriter
+}
+
+func (self *server) SetDNSPinning(ttl time.Duration) {
+	self.panicIfListening()
+	self.pins = nil
+	if ttl > 0 {
+		self.pins = newPinCache(ttl)
+	}
+}
+
+func (self *server) SetRebindProtection(protection *RebindProtection) {
+	self.panicIfListening()
+	self.rebind = protection
+}
+
+func (self *server) SetMaxHandshakes(limit int) {
+	self.panicIfListening()
+	self.handshakes = nil
+	if limit > 0 {
+		self.handshakes = make(chan struct{}, limit)
+	}
+}
+
+func (self *server) SetAcceptBacklog(depth int, drop bool) {
+	self.panicIfListening()
+	if depth < 0 {
+		depth = 0
+	}
+	self.backlog, self.dropOnFull = depth, drop
+}
+
+func (self *server) SetAutoBan(ban *AutoBan) {
+	self.panicIfListening()
+	self.bans = nil
+	if ban != nil {
+		self.bans = newBanList(ban, self)
+	}
+}
+
+func (self *server) SetTrustedProxies(networks ...*net.IPNet) {
+	self.panicIfListening()
+	self.trustedProxies = networks
+}
+
+func (self *server) SetSessionDefaults(opts SessionOptions) {
+	self.panicIfListening()
+	self.sessionDefaults = opts
+}
+
+func (self *server) SetBandwidthClass(name string, rate int64) {
+	self.panicIfListening()
+	self.bandwidth[name] = rate
+}
+
+func (self *server) SetHoneypot(honeypot *Honeypot) {
+	self.panicIfListening()
+	self.honeypot = honeypot
+}
+
+func (self *server) SetErrorReplies(replies *ErrorReplies) {
+	self.panicIfListening()
+	self.errorReplies = nil
+	if replies != nil {
+		self.errorReplies = newErrorReplies(replies)
+	}
+}
+
+func (self *server) SetDNSQueryLogger(logger DNSQueryLogger) {
+	self.panicIfListening()
+	self.queryLogger = logger
+}
+
+func (self *server) SetAddressOrder(order AddressOrder) {
+	self.panicIfListening()
+	self.addressOrder = order
+}
+
+func (self *server) SetMultipathTCP(listen, dial bool) {
+	self.panicIfListening()
+	self.mptcpListen, self.mptcpDial = listen, dial
+}
+
+func (self *server) SetAuthMethod(method byte, auth AuthMethod) {
+	self.panicIfListening()
+	if method < MethodPrivateFirst || method > MethodPrivateLast {
+		panic(ErrorAuthMethod)
+	}
+	if auth == nil {
+		delete(self.authMethods, method)
+		return
+	}
+	self.authMethods[method] = auth
+}
+
+func (self *server) SetReporter(reporter Reporter) {
+	self.panicIfListening()
+	self.reporter = reporter
+}
+
+func (self *server) SetHalfOpenTimeout(timeout time.Duration) {
+	self.panicIfListening()
+	self.halfOpen = timeout
+}
+
+func (self *server) SetNoDelay(noDelay bool) {
+	self.panicIfListening()
+	self.delay = !noDelay
+}
+
+func (self *server) SetKeepAlive(period time.Duration) {
+	self.panicIfListening()
+	self.keepAlive = period
+}
+
+func (self *server) SetSocketHook(hook SocketHook) {
+	self.panicIfListening()
+	self.socketHook = hook
+}
+
+func (self *server) SetHostSniffing(ports ...int) {
+	self.panicIfListening()
+	self.sniffPorts = make(map[int]bool)
+	for _, port := range ports {
+		self.sniffPorts[port] = true
+	}
+}
+
+func (self *server) SetProtocolEnforcement(enforcement *ProtocolEnforcement) {
+	self.panicIfListening()
+	self.protocols = enforcement
+}
+
+func (self *server) SetDryRunRuler(ruler Ruler) {
+	self.panicIfListening()
+	self.dryRun = ruler
+}
+
+func (self *server) SetSharedStore(store SharedStore) {
+	self.panicIfListening()
+	self.store = store
+}
+
+func (self *server) SetQuota(quota *Quota) {
+	self.panicIfListening()
+	self.quota = quota
+}
+
+func (self *server) SetLimits(limits *Limits) {
+	self.panicIfListening()
+	self.limits, self.dials = limits, nil
+	if limits != nil && limits.DestinationDials > 0 {
+		self.dials = newDialSlots(limits.DestinationDials)
+	}
+}
+
+func (self *server) SetCircuitBreaker(breaker *CircuitBreaker) {
+	self.panicIfListening()
+	self.circuits = nil
+	if breaker != nil {
+		self.circuits = newCircuits(breaker)
+	}
+}
+
+func (self *server) SetUpstreamHealth(health *UpstreamHealth) {
+	self.panicIfListening()
+	self.health = nil
+	if health != nil {
+		self.health = newUpstreamHealth(health, self)
+	}
+}
+
+func (self *server) SetMetricTags(keys ...string) {
+	self.panicIfListening()
+	self.tagged = nil
+	if len(keys) != 0 {
+		self.tagged = newTaggedStats(keys)
+	}
+}
+
+func (self *server) SetFairBandwidth(rate int64) {
+	self.panicIfListening()
+	self.fair = nil
+	if rate > 0 {
+		self.fair = []*fairQueue{newFairQueue(rate), newFairQueue(rate)}
+	}
+}
+
+func (self *server) SetMemoryBudget(budget *MemoryBudget) {
+	self.panicIfListening()
+	self.memory = nil
+	if budget != nil {
+		self.memory = newMemoryBudget(budget)
+	}
+}
+
+func (self *server) SetRelayEngine(engine RelayEngine) {
+	self.panicIfListening()
+	self.relayEngine = engine
+}
+
+func (self *server) SetAlerts(alerts *Alerts) {
+	self.panicIfListening()
+	self.alerts = nil
+	if alerts != nil {
+		self.alerts = newAlertWatch(alerts, self)
+	}
+}
+
+func (self *server) SetDialer(dialer Dialer) {
+	self.panicIfListening()
+	self.dialer = dialer
+}
+
+func (self *server) SetAllowNoAuth(allow bool) {
+	self.panicIfListening()
+	self.allowNoAuth = allow
+}
+
+// Whether clients have to authenticate, see SetAllowNoAuth().
+func (self *server) requiresAuth() bool {
+	return len(self.authMethods) != 0 && !self.allowNoAuth
+}
+
+func (self *server) acquireHandshake() bool {
+	if self.handshakes == nil {
+		return true
+	}
+	select {
+	case self.handshakes <- struct{}{}:
+		return true
+	default:
+		return false
+	}
+}
+
+func (self *server) releaseHandshake() {
+	if self.handshakes != nil {
+		<-self.handshakes
+	}
+}
+
+func (self *server) Stats() Stats {
+	rv := Stats{
+		Accepted:     atomic.LoadUint64(&self.stats.accepted),
+		AcceptErrors: atomic.LoadUint64(&self.stats.acceptErrors),
+		QueueFull:    atomic.LoadUint64(&self.stats.queueFull),
+		Dropped:      atomic.LoadUint64(&self.stats.dropped),
+		QueueDepth:   atomic.LoadInt64(&self.stats.queueDepth),
+		Rejected:     atomic.LoadUint64(&self.stats.rejected),
+		Banned:       atomic.LoadUint64(&self.stats.banned),
+		Bans:         atomic.LoadUint64(&self.stats.bans),
+		Reaped:       atomic.LoadUint64(&self.stats.reaped),
+		Mismatches:   atomic.LoadUint64(&self.stats.mismatches),
+		Divergences:  atomic.LoadUint64(&self.stats.divergences),
+		Capped:       atomic.LoadUint64(&self.stats.capped),
+		Throttled:    atomic.LoadUint64(&self.stats.throttled),
+		DialWaits:    atomic.LoadUint64(&self.stats.dialWaits),
+		Relayed:      atomic.LoadUint64(&self.stats.relayed),
+		AcceptRate:   self.stats.acceptRate.rate(),
+		Denials:      self.stats.denials.snapshot(),
+
+		SessionDuration:  self.stats.sessionDuration.snapshot(),
+		BytesUp:          self.stats.bytesUp.snapshot(),
+		BytesDown:        self.stats.bytesDown.snapshot(),
+		HandshakeLatency: self.stats.handshakeLatency.snapshot(),
+
+		Resolver: self.stats.resolver.snapshot(self.DNSResolver),
+	}
+	if self.tagged != nil {
+		rv.Tagged = self.tagged.snapshot()
+	}
+	if self.circuits != nil {
+		rv.Circuits = self.circuits.snapshot()
+	}
+	if self.memory != nil {
+		rv.Memory = MemoryStats{
+			Budget: self.memory.Bytes,
+			Used:   atomic.LoadUint64(&self.memory.used),
+			Shed:   atomic.LoadUint64(&self.memory.shed),
+			Reaped: atomic.LoadUint64(&self.memory.reaps),
+		}
+	}
+	if rc, ok := self.Ruler.(RuleCounter); ok {
+		rv.Rules = rc.Hits()
+	}
+	return rv
+}
+
+func (self *server) TopDestinations(n int, window time.Duration) []DestinationTraffic {
+	return self.stats.traffic.top(n, window)
+}
+
+func (self *server) Sessions() []Session {
+	return self.sessions.list()
+}
+
 func (self *server) Continue() {
-	for i := 0; i < self.instances; i++ {
-		self.running <- true
+	self.Lock()
+	defer self.Unlock()
+	if len(self.listeners) == 0 || self.closed {
+		return
 	}
+	started := 0
+	for l := range self.listeners {
+		if err := l.start(); err != nil {
+			self.Printf("Failed to continue listening on %v:%d: %v", l.ip, l.port, err)
+			l.fail(err)
+			continue
+		}
+		started++
+	}
+	if started == 0 {
+		self.setState(StateFailed)
+		return
+	}
+	self.setState(StateListening)
 }
 
 func (self *server) Stop() {
-	for i := 0; i < self.instances; i++ {
-		self.running <- false
+	self.Lock()
+	defer self.Unlock()
+	if len(self.listeners) == 0 {
+		return
+	}
+	for l := range self.listeners {
+		l.stop()
+	}
+	self.setState(StatePaused)
+}
+
+func (self *server) Terminate() int {
+	self.Stop()
+	closed := self.sessions.closeAll()
+	self.Lock()
+	for l := range self.listeners {
+		closed += l.drain()
+	}
+	self.Unlock()
+	self.Printf("Terminated %d connections", closed)
+	return closed
+}
+
+func (self *server) isClosed() bool {
+	self.Lock()
+	defer self.Unlock()
+	return self.closed
+}
+
+func (self *server) Shutdown(ctx context.Context) error {
+	self.Lock()
+	if !self.closed {
+		self.closed = true
+		close(self.closing)
+		if self.alerts != nil {
+			self.alerts.close()
+		}
+	}
+	for l := range self.listeners {
+		l.stop()
+	}
+	self.setState(StateClosed)
+	self.Unlock()
+
+	ticker := time.NewTicker(shutdownPoll)
+	defer ticker.Stop()
+	for self.sessions.count() > 0 {
+		select {
+		case <-ctx.Done():
+			self.Printf("Closed %d remaining connections", self.sessions.closeAll())
+			return ctx.Err()
+		case <-ticker.C:
+		}
 	}
+	return nil
 }
 
 // vim: set noet ts=2 sw=2:
@@ -0,0 +1,125 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "sort"
+import "sync"
+import "sync/atomic"
+import "time"
+
+// Session describes a connected session, see Server.Sessions().
+type Session struct {
+	ID          uint64 // Unique per server
+	Client      string // See ClientInfo.String()
+	Identity    string // The client authenticated as, if any
+	Destination string // As requested, host:port
+	Remote      string // Address connected to, i.e. the first upstream, if any
+	Since       time.Time
+	BytesUp     uint64 // Sent by the client so far
+	BytesDown   uint64 // Received by the client so far
+	Tags        map[string]string
+}
+
+// The connections a server is currently serving.
+type sessionSet struct {
+	sync.Mutex
+	socks  map[*sockConn]*sockConn // client -> remote, once connected
+	lastID uint64
+}
+
+func newSessionSet() *sessionSet {
+	return &sessionSet{socks: make(map[*sockConn]*sockConn)}
+}
+
+func (self *sessionSet) add(sock *sockConn) {
+	self.Lock()
+	defer self.Unlock()
+	self.socks[sock] = nil
+}
+
+func (self *sessionSet) connected(sock, rsock *sockConn) {
+	self.Lock()
+	defer self.Unlock()
+	if _, ok := self.socks[sock]; ok {
+		self.lastID++
+		sock.id, sock.since = self.lastID, time.Now()
+		self.socks[sock] = rsock
+	}
+}
+
+func (self *sessionSet) remove(sock *sockConn) {
+	self.Lock()
+	defer self.Unlock()
+	delete(self.socks, sock)
+}
+
+func (self *sessionSet) count() int {
+	self.Lock()
+	defer self.Unlock()
+	return len(self.socks)
+}
+
+// Returns the connected sessions, oldest first.
+func (self *sessionSet) list() []Session {
+	self.Lock()
+	defer self.Unlock()
+	rv := make([]Session, 0, len(self.socks))
+	for sock, rsock := range self.socks {
+		if rsock == nil {
+			continue
+		}
+		dest := sock.host
+		if len(dest) == 0 {
+			dest = sock.ip.String()
+		}
+		rv = append(rv, Session{
+			ID:          sock.id,
+			Client:      sock.info.String(),
+			Identity:    sock.info.Identity,
+			Destination: joinHostPort(dest, sock.port),
+			Remote:      rsock.conn.RemoteAddr().String(),
+			Since:       sock.since,
+			BytesUp:     atomic.LoadUint64(&sock.transferred),
+			BytesDown:   atomic.LoadUint64(&rsock.transferred),
+			Tags:        sock.opts.Tags,
+		})
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		return rv[i].ID < rv[j].ID
+	})
+	return rv
+}
+
+// Closes all connections, returning the number of sessions closed.
+func (self *sessionSet) closeAll() int {
+	self.Lock()
+	defer self.Unlock()
+	for sock, rsock := range self.socks {
+		sock.conn.Close()
+		if rsock != nil {
+			rsock.conn.Close()
+		}
+	}
+	return len(self.socks)
+}
+
+// vim: set noet ts=2 sw=2:
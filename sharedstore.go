@@ -0,0 +1,116 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "strconv"
+import "sync"
+import "time"
+
+// SharedStore holds state shared by the instances of a cluster, such as bans
+// and quotas, e.g. a RedisStore. Implementations must be safe for concurrent
+// use.
+//
+// Servers fall back to their local state while the store fails.
+type SharedStore interface {
+	// Adds delta to the counter key, returning the new value. New counters
+	// start at zero and expire after ttl.
+	Incr(key string, delta int64, ttl time.Duration) (int64, error)
+
+	// Sets key to value, expiring after ttl.
+	Set(key, value string, ttl time.Duration) error
+
+	// Returns the value of key, and whether it is set.
+	Get(key string) (string, bool, error)
+}
+
+type memoryEntry struct {
+	value   string
+	expires time.Time
+}
+
+type memoryStore struct {
+	sync.Mutex
+	entries map[string]*memoryEntry
+	swept   time.Time
+}
+
+// Creates a SharedStore keeping its state in memory, i.e. sharing it only
+// between the servers of a process, e.g. across reloads.
+func NewMemoryStore() SharedStore {
+	return &memoryStore{entries: make(map[string]*memoryEntry), swept: time.Now()}
+}
+
+// Returns the live entry of key, if any.
+// Must be called with the store locked.
+func (self *memoryStore) entry(key string, now time.Time) *memoryEntry {
+	if now.Sub(self.swept) > time.Minute {
+		for k, entry := range self.entries {
+			if now.After(entry.expires) {
+				delete(self.entries, k)
+			}
+		}
+		self.swept = now
+	}
+	entry, ok := self.entries[key]
+	if !ok || now.After(entry.expires) {
+		return nil
+	}
+	return entry
+}
+
+func (self *memoryStore) Incr(key string, delta int64, ttl time.Duration) (int64, error) {
+	now := time.Now()
+	self.Lock()
+	defer self.Unlock()
+	entry := self.entry(key, now)
+	if entry == nil {
+		entry = &memoryEntry{"0", now.Add(ttl)}
+		self.entries[key] = entry
+	}
+	value, err := strconv.ParseInt(entry.value, 10, 64)
+	if err != nil {
+		return 0, err
+	}
+	value += delta
+	entry.value = strconv.FormatInt(value, 10)
+	return value, nil
+}
+
+func (self *memoryStore) Set(key, value string, ttl time.Duration) error {
+	now := time.Now()
+	self.Lock()
+	defer self.Unlock()
+	self.entry(key, now)
+	self.entries[key] = &memoryEntry{value, now.Add(ttl)}
+	return nil
+}
+
+func (self *memoryStore) Get(key string) (string, bool, error) {
+	self.Lock()
+	defer self.Unlock()
+	if entry := self.entry(key, time.Now()); entry != nil {
+		return entry.value, true, nil
+	}
+	return "", false, nil
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,169 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "context"
+import "errors"
+import "os"
+import "os/signal"
+import "syscall"
+import "time"
+
+var (
+	ErrorListenerFailed = errors.New("Listener failed")
+	ErrorNoReload       = errors.New("Reloading not supported")
+)
+
+// ReloadFunc creates a replacement server, set up from scratch, e.g. from a
+// re-read configuration, along with the endpoints it should listen on.
+type ReloadFunc func() (Server, []Endpoint, error)
+
+// Reloader triggers the reloads RunWithReloader performs on SIGHUP from
+// elsewhere in a program, e.g. an admin API.
+type Reloader struct {
+	// Called after each reload, triggered by the Reloader or SIGHUP, with the
+	// new server, if any, and the error, if any, e.g. to switch state
+	// belonging to the new server over only once it listens. Called from the
+	// goroutine running RunWithReloader, before Reload returns.
+	OnReload func(srv Server, err error)
+
+	requests chan chan error
+}
+
+// Creates a new Reloader, for passing to RunWithReloader.
+func NewReloader() *Reloader {
+	return &Reloader{requests: make(chan chan error)}
+}
+
+// Reloads as if SIGHUP was received, waiting until the new server listens.
+// Returns the error of the ReloadFunc, or of starting the new server, if
+// any, or ctx.Err() if not running and reloading in time.
+func (self *Reloader) Reload(ctx context.Context) error {
+	done := make(chan error, 1)
+	select {
+	case self.requests <- done:
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+	select {
+	case err := <-done:
+		return err
+	case <-ctx.Done():
+		return ctx.Err()
+	}
+}
+
+// RunWithSignals runs srv on the endpoints, handling the usual daemon signals:
+//   - SIGINT and SIGTERM shut the server down, waiting up to drain for the
+//     connections being served to finish, closing the remaining ones then.
+//   - SIGHUP replaces the server by the one reload returns, if reload is not
+//     nil. Connections of the old server continue to be served.
+//
+// Returns nil once shut down by a signal, or an error if listening failed.
+func RunWithSignals(srv Server, endpoints []Endpoint, drain time.Duration, reload ReloadFunc) error {
+	return RunWithReloader(srv, endpoints, drain, reload, nil)
+}
+
+// RunWithReloader runs srv like RunWithSignals, additionally reloading when
+// triggered by reloader, if not nil.
+func RunWithReloader(srv Server, endpoints []Endpoint, drain time.Duration, reload ReloadFunc, reloader *Reloader) error {
+	logger := Logger(DefaultLogger)
+	if s, ok := srv.(*server); ok {
+		logger = s.Logger
+	}
+	manager := NewManager(logger)
+	states := make(chan ServerState, 4)
+	srv.NotifyState(states)
+	manager.Add("main", srv, endpoints...)
+	if err := manager.Start(); err != nil {
+		manager.Shutdown(context.Background())
+		return err
+	}
+
+	tryReload := func() (Server, error) {
+		if reload == nil {
+			return nil, ErrorNoReload
+		}
+		nsrv, nendpoints, err := reload()
+		if err != nil {
+			return nil, err
+		}
+		nstates := make(chan ServerState, 4)
+		nsrv.NotifyState(nstates)
+		if err := manager.Reload(context.Background(), "main", nsrv, nendpoints...); err != nil {
+			return nsrv, err
+		}
+		states = nstates
+		return nsrv, nil
+	}
+	doReload := func() error {
+		nsrv, err := tryReload()
+		if reloader != nil && reloader.OnReload != nil {
+			reloader.OnReload(nsrv, err)
+		}
+		return err
+	}
+
+	var requests chan chan error
+	if reloader != nil {
+		requests = reloader.requests
+	}
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, syscall.SIGINT, syscall.SIGTERM, syscall.SIGHUP)
+	defer signal.Stop(signals)
+	for {
+		select {
+		case state := <-states:
+			if state != StateFailed {
+				continue
+			}
+			manager.Shutdown(context.Background())
+			return ErrorListenerFailed
+
+		case done := <-requests:
+			logger.Print("Reloading")
+			err := doReload()
+			if err != nil {
+				logger.Printf("Reloading failed: %v", err)
+			}
+			done <- err
+
+		case sig := <-signals:
+			if sig != syscall.SIGHUP {
+				logger.Printf("Received %v, shutting down", sig)
+				ctx, cancel := context.WithTimeout(context.Background(), drain)
+				manager.Shutdown(ctx)
+				cancel()
+				return nil
+			}
+			if reload == nil {
+				continue
+			}
+			logger.Print("Received SIGHUP, reloading")
+			if err := doReload(); err != nil {
+				logger.Printf("Reloading failed: %v", err)
+			}
+		}
+	}
+}
+
+// vim: set noet ts=2 sw=2:
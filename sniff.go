@@ -0,0 +1,160 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "bytes"
+import "net"
+import "net/url"
+import "strings"
+import "sync/atomic"
+import "time"
+
+const (
+	sniffSize    = 4096
+	sniffTimeout = 2 * time.Second
+)
+
+// Reads the first bytes a client sends after connecting, adding to the ones
+// peeked already, until complete returns true for all of them, sniffSize
+// bytes were read, or the client did not send anything for timeout, e.g. as
+// the server speaks first.
+func (sock *sockConn) peek(timeout time.Duration, complete func(data []byte) bool) []byte {
+	if complete(sock.peeked) {
+		return sock.peeked
+	}
+	buf := make([]byte, sniffSize)
+	n := copy(buf, sock.peeked)
+	for n < len(buf) {
+		sock.conn.SetReadDeadline(time.Now().Add(timeout))
+		nr, err := sock.conn.Read(buf[n:])
+		n += nr
+		if err != nil || complete(buf[:n]) {
+			break
+		}
+	}
+	sock.peeked = buf[:n]
+	return sock.peeked
+}
+
+// Forwards the data peeked from the client to rsock, as if relayed.
+func (sock *sockConn) forwardPeeked(rsock *sockConn) {
+	data := sock.peeked
+	sock.peeked = nil
+	if len(data) == 0 {
+		return
+	}
+	atomic.AddUint64(&sock.transferred, uint64(len(data)))
+	atomic.AddUint64(&sock.srv.stats.relayed, uint64(len(data)))
+	if sock.mirror != nil {
+		sock.mirror.copy(data)
+	}
+	if sock.tls != nil {
+		sock.tls.observe(RelayUp, data)
+	}
+	rsock.writeAll(data)
+}
+
+// Returns the host an HTTP request is for, as given by an absolute request
+// URI or the Host header, once the request header is complete.
+func httpHost(data []byte) (host string, complete bool) {
+	end := bytes.Index(data, []byte("\r\n\r\n"))
+	if end < 0 {
+		return "", false
+	}
+	lines := strings.Split(string(data[:end]), "\r\n")
+	request := strings.Fields(lines[0])
+	if len(request) != 3 || !strings.HasPrefix(request[2], "HTTP/") {
+		return "", true
+	}
+	if u, err := url.Parse(request[1]); err == nil && len(u.Host) != 0 {
+		host = u.Host
+	}
+	for _, line := range lines[1:] {
+		if name, value, ok := strings.Cut(line, ":"); ok && len(host) == 0 && strings.EqualFold(name, "Host") {
+			host = strings.TrimSpace(value)
+		}
+	}
+	if h, _, err := splitHostPort(host); err == nil {
+		host = h
+	} else {
+		host = ""
+	}
+	return host, true
+}
+
+// Sniffs the Host of a plaintext HTTP request, logging it and checking it
+// against the domain rules of the Ruler, if any, closing the session if
+// denied. Hosts the rules defer on get checked by the IPs they resolve to, as
+// connect() does.
+func (sock *sockConn) sniffHTTP() {
+	var host string
+	sock.peek(sniffTimeout, func(data []byte) (complete bool) {
+		host, complete = httpHost(data)
+		return
+	})
+	if len(host) == 0 {
+		return
+	}
+	sock.Printf("HTTP Host: %v", host)
+	dr, ok := sock.srv.Ruler.(DomainRuler)
+	if !ok || host == sock.host || net.ParseIP(host) != nil {
+		return
+	}
+	switch dr.DomainAllowed(sock.info, host) {
+	case AllowConnection:
+		return
+	case DeferConnection:
+		if sock.sniffedIPsAllowed(host) {
+			return
+		}
+	}
+	reason := ReasonSniffedHost
+	sock.srv.stats.denials.add(reason)
+	err := &PolicyDeniedError{reason, joinHostPort(host, sock.port), ErrorNotAllowed}
+	sock.logAccess(EventDenied, host, nil, sock.port, err, reason)
+	panic(err)
+}
+
+// Returns whether the Ruler allows the IPs a sniffed host resolves to, per
+// the RulerMode. Hosts not resolving are not allowed.
+func (sock *sockConn) sniffedIPsAllowed(host string) bool {
+	rips, err := sock.srv.lookup(sock.info, host)
+	if err != nil || len(rips) == 0 {
+		sock.Printf("Not allowed: %v did not resolve", host)
+		return false
+	}
+	if sock.srv.rebind != nil && sock.srv.rebind.check(host, rips) != nil {
+		sock.Printf("Not allowed: %v resolved to internal IPs", host)
+		return false
+	}
+	allowed := 0
+	for _, rip := range rips {
+		if sock.srv.Ruler.ConnectionAllowed(sock.info, rip) == AllowConnection {
+			allowed++
+		} else {
+			sock.Printf("Not allowed: %v", rip)
+		}
+	}
+	return allowed != 0 && (sock.srv.rulerMode != RulerDenyAny || allowed == len(rips))
+}
+
+// vim: set noet ts=2 sw=2:
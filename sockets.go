@@ -0,0 +1,119 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "net"
+import "syscall"
+
+// Kinds of sockets passed to SocketHooks.
+type SocketKind int
+
+const (
+	SocketClient      SocketKind = iota // Accepted client connection
+	SocketDestination                   // Connection to a destination
+)
+
+func (self SocketKind) String() string {
+	switch self {
+	case SocketClient:
+		return "client"
+	case SocketDestination:
+		return "destination"
+	}
+	return "unknown"
+}
+
+// SocketHook gets access to the raw client and destination sockets, e.g. to
+// set socket options not covered otherwise.
+// Client sockets are passed once accepted, destination sockets before
+// connecting. Returning an error fails the session.
+type SocketHook func(kind SocketKind, conn syscall.RawConn) error
+
+// Applies the NoDelay and keepalive settings and the SocketHook, if any, to a
+// client connection.
+func (sock *sockConn) configureClient() {
+	if tc, ok := sock.conn.(*net.TCPConn); ok {
+		tc.SetNoDelay(!sock.srv.delay)
+		switch {
+		case sock.srv.keepAlive < 0:
+			tc.SetKeepAlive(false)
+		case sock.srv.keepAlive > 0:
+			tc.SetKeepAlive(true)
+			tc.SetKeepAlivePeriod(sock.srv.keepAlive)
+		}
+	}
+	if sock.srv.socketHook == nil {
+		return
+	}
+	sc, ok := sock.conn.(syscall.Conn)
+	if !ok {
+		return
+	}
+	raw, err := sc.SyscallConn()
+	if err == nil {
+		err = sock.srv.socketHook(SocketClient, raw)
+	}
+	if err != nil {
+		panic(err)
+	}
+}
+
+// Applies the socket buffer sizes of opts, if any.
+func (sock *sockConn) setBuffers(opts *SessionOptions) {
+	tc, ok := sock.conn.(*net.TCPConn)
+	if !ok {
+		return
+	}
+	if opts.RecvBuffer > 0 {
+		if err := tc.SetReadBuffer(opts.RecvBuffer); err != nil {
+			sock.Printf("Failed to set receive buffer: %v", err)
+		}
+	}
+	if opts.SendBuffer > 0 {
+		if err := tc.SetWriteBuffer(opts.SendBuffer); err != nil {
+			sock.Printf("Failed to set send buffer: %v", err)
+		}
+	}
+}
+
+// Returns the net.Dialer for destination connections, applying the socket
+// level SessionOptions and the SocketHook, if any.
+func (sock *sockConn) dialer(lip net.IP, opts *SessionOptions) *net.Dialer {
+	hook := sock.srv.socketHook
+	rv := &net.Dialer{
+		LocalAddr: &net.TCPAddr{IP: lip},
+		KeepAlive: sock.srv.keepAlive,
+		Control: func(network, address string, c syscall.RawConn) error {
+			if err := opts.control(network, address, c); err != nil {
+				return err
+			}
+			if hook != nil {
+				return hook(SocketDestination, c)
+			}
+			return nil
+		},
+	}
+	rv.SetMultipathTCP(sock.srv.mptcpDial)
+	return rv
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,459 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux && (amd64 || arm64 || riscv64 || loong64)
+
+package gosocksv5d
+
+import "encoding/binary"
+import "io"
+import "math"
+import "net"
+import "runtime"
+import "sync"
+import "syscall"
+import "time"
+import "unsafe"
+
+const (
+	sockmapEntries = 1 << 16
+
+	bpfMapCreate     = 0
+	bpfMapUpdateElem = 2
+	bpfMapDeleteElem = 3
+	bpfProgLoad      = 5
+	bpfProgAttach    = 8
+
+	bpfMapTypeSockhash = 18
+	bpfProgTypeSkSkb   = 14
+	bpfSkSkbVerdict    = 38 // Linux 5.13
+
+	bpfFuncGetSocketCookie = 46
+	bpfFuncSkRedirectHash  = 72
+
+	soCookie      = 57
+	siocInq       = 0x541b
+	siocOutq      = 0x5411
+	tcpInfoLength = 136 // Up to tcpi_bytes_received
+
+	tcpEstablished = 1
+	tcpCloseWait   = 8
+
+	sockmapDrainPoll = 50 * time.Millisecond
+	sockmapPairing   = time.Second
+)
+
+var sysBPF = map[string]uintptr{
+	"amd64":   321,
+	"arm64":   280,
+	"riscv64": 280,
+	"loong64": 280,
+}[runtime.GOARCH]
+
+type sockmapEngine struct {
+	sync.Mutex
+	once     sync.Once
+	mapFD    int
+	err      error
+	sessions map[net.Conn]*sockmapSession // By client, until both directions paired
+}
+
+// The directions of a session, paired.
+type sockmapSession struct {
+	ready    chan struct{} // Closed once paired
+	redirect bool          // Whether the directions paired so far may be redirected
+	mapped   bool          // Whether the sockets got mapped to each other
+	sockets  [2]*sockmapSocket
+}
+
+// A socket of a session, as mapped.
+type sockmapSocket struct {
+	conn     *net.TCPConn
+	cookie   uint64
+	clamp    int    // TCP_WINDOW_CLAMP, before holding
+	queued   uint64 // Received, but not read yet
+	received uint64 // tcpi_bytes_received
+	written  uint64 // Acknowledged or queued for sending
+}
+
+func bpf(cmd uintptr, attr unsafe.Pointer, size uintptr) (int, error) {
+	fd, _, errno := syscall.Syscall(sysBPF, cmd, uintptr(attr), size)
+	if errno != 0 {
+		return -1, errno
+	}
+	return int(fd), nil
+}
+
+// Encodes an eBPF instruction, on little endian systems.
+func bpfInsn(code, dst, src uint8, off int16, imm int32) []byte {
+	rv := []byte{code, dst | src<<4, 0, 0, 0, 0, 0, 0}
+	binary.LittleEndian.PutUint16(rv[2:], uint16(off))
+	binary.LittleEndian.PutUint32(rv[4:], uint32(imm))
+	return rv
+}
+
+// Creates the sockhash, mapping the cookies of sockets to the sockets their
+// data gets redirected to, and attaches the verdict program redirecting so.
+func (self *sockmapEngine) load() error {
+	if sysBPF == 0 {
+		return syscall.ENOSYS
+	}
+	mapAttr := struct {
+		mapType, keySize, valueSize, maxEntries, flags uint32
+	}{bpfMapTypeSockhash, 8, 4, sockmapEntries, 0}
+	mapFD, err := bpf(bpfMapCreate, unsafe.Pointer(&mapAttr), unsafe.Sizeof(mapAttr))
+	if err != nil {
+		return err
+	}
+
+	// Redirects to the socket mapped to the cookie of the receiving one,
+	// passing to user space if there is none (yet). Drops what carries no
+	// data, i.e. just the FIN, as the kernel takes it for a broken pipe once
+	// queued, but marks the socket done anyway.
+	var insns []byte
+	for _, insn := range [][]byte{
+		bpfInsn(0xbf, 6, 1, 0, 0),                      // r6 = r1 (skb)
+		bpfInsn(0x61, 2, 1, 0, 0),                      // r2 = skb->len
+		bpfInsn(0xb7, 0, 0, 0, 0),                      // r0 = SK_DROP
+		bpfInsn(0x15, 2, 0, 11, 0),                     // if r2 == 0 goto exit
+		bpfInsn(0x85, 0, 0, 0, bpfFuncGetSocketCookie), // r0 = cookie
+		bpfInsn(0x7b, 10, 0, -8, 0),                    // *(u64 *)(r10 - 8) = r0
+		bpfInsn(0xbf, 1, 6, 0, 0),                      // r1 = skb
+		bpfInsn(0x18, 2, 1, 0, int32(mapFD)),           // r2 = map
+		bpfInsn(0, 0, 0, 0, 0),
+		bpfInsn(0xbf, 3, 10, 0, 0),                    // r3 = r10
+		bpfInsn(0x07, 3, 0, 0, -8),                    // r3 += -8 (key)
+		bpfInsn(0xb7, 4, 0, 0, 0),                     // r4 = 0 (egress)
+		bpfInsn(0x85, 0, 0, 0, bpfFuncSkRedirectHash), // r0 = redirect
+		bpfInsn(0x55, 0, 0, 1, 0),                     // if r0 != SK_DROP goto exit
+		bpfInsn(0xb7, 0, 0, 0, 1),                     // r0 = SK_PASS
+		bpfInsn(0x95, 0, 0, 0, 0),                     // exit
+	} {
+		insns = append(insns, insn...)
+	}
+	license := []byte("MIT\x00")
+	progAttr := struct {
+		progType, insnCount uint32
+		insns, license      uint64
+		logLevel, logSize   uint32
+		logBuf              uint64
+		kernVersion, flags  uint32
+	}{
+		progType:  bpfProgTypeSkSkb,
+		insnCount: uint32(len(insns) / 8),
+		insns:     uint64(uintptr(unsafe.Pointer(&insns[0]))),
+		license:   uint64(uintptr(unsafe.Pointer(&license[0]))),
+	}
+	progFD, err := bpf(bpfProgLoad, unsafe.Pointer(&progAttr), unsafe.Sizeof(progAttr))
+	runtime.KeepAlive(insns)
+	runtime.KeepAlive(license)
+	if err != nil {
+		syscall.Close(mapFD)
+		return err
+	}
+	// The map holds on to the program, once attached
+	defer syscall.Close(progFD)
+	attachAttr := struct {
+		target, prog, attachType, flags uint32
+	}{uint32(mapFD), uint32(progFD), bpfSkSkbVerdict, 0}
+	if _, err := bpf(bpfProgAttach, unsafe.Pointer(&attachAttr), unsafe.Sizeof(attachAttr)); err != nil {
+		syscall.Close(mapFD)
+		return err
+	}
+	self.mapFD = mapFD
+	return nil
+}
+
+func sockmapIoctl(fd int, req uintptr) (uint64, error) {
+	var value int32
+	if _, _, errno := syscall.Syscall(syscall.SYS_IOCTL, uintptr(fd), req, uintptr(unsafe.Pointer(&value))); errno != 0 {
+		return 0, errno
+	}
+	return uint64(value), nil
+}
+
+type tcpInfo struct {
+	state    uint8
+	acked    uint64 // tcpi_bytes_acked
+	received uint64 // tcpi_bytes_received, including the FIN
+}
+
+func sockmapInfo(fd int) (tcpInfo, error) {
+	var info [tcpInfoLength]byte
+	length := uint32(len(info))
+	_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.IPPROTO_TCP, syscall.TCP_INFO,
+		uintptr(unsafe.Pointer(&info[0])), uintptr(unsafe.Pointer(&length)), 0)
+	if errno != 0 {
+		return tcpInfo{}, errno
+	}
+	if length < tcpInfoLength {
+		return tcpInfo{}, syscall.ENOPROTOOPT
+	}
+	return tcpInfo{info[0], binary.LittleEndian.Uint64(info[120:]), binary.LittleEndian.Uint64(info[128:])}, nil
+}
+
+// Returns the bytes written to a socket so far, i.e. acknowledged or still
+// queued, and whether it may still send.
+func sockmapWritten(fd int) (uint64, bool, error) {
+	info, err := sockmapInfo(fd)
+	if err != nil {
+		return 0, false, err
+	}
+	queued, err := sockmapIoctl(fd, siocOutq)
+	return info.acked + queued, info.state == tcpEstablished || info.state == tcpCloseWait, err
+}
+
+// Calls fn with the fd of conn.
+func sockmapControl(conn *net.TCPConn, fn func(fd int) error) error {
+	raw, err := conn.SyscallConn()
+	if err != nil {
+		return err
+	}
+	var ferr error
+	if err := raw.Control(func(fd uintptr) {
+		ferr = fn(int(fd))
+	}); err != nil {
+		return err
+	}
+	return ferr
+}
+
+// Holds back what the socket receives from the verdict program, i.e. until
+// its receive buffer fills, and records its state.
+func (self *sockmapSocket) hold() error {
+	return sockmapControl(self.conn, func(fd int) (err error) {
+		var length uint32 = 8
+		_, _, errno := syscall.Syscall6(syscall.SYS_GETSOCKOPT, uintptr(fd), syscall.SOL_SOCKET, soCookie,
+			uintptr(unsafe.Pointer(&self.cookie)), uintptr(unsafe.Pointer(&length)), 0)
+		if errno != 0 {
+			return errno
+		}
+		if self.clamp, err = syscall.GetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_WINDOW_CLAMP); err != nil {
+			return err
+		}
+		// The kernel caps the low water mark to half the receive buffer
+		if err = syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVLOWAT, math.MaxInt32); err != nil {
+			return err
+		}
+		if self.queued, err = sockmapIoctl(fd, siocInq); err != nil {
+			return err
+		}
+		info, err := sockmapInfo(fd)
+		if err != nil {
+			return err
+		}
+		self.received = info.received
+		self.written, _, err = sockmapWritten(fd)
+		return err
+	})
+}
+
+// Releases what the socket holds back, passing it to the verdict program,
+// along with anything queued before.
+func (self *sockmapSocket) release() {
+	sockmapControl(self.conn, func(fd int) error {
+		syscall.SetsockoptInt(fd, syscall.SOL_SOCKET, syscall.SO_RCVLOWAT, 1)
+		// Holding grew the receive buffer, clamping the window to the mark
+		return syscall.SetsockoptInt(fd, syscall.IPPROTO_TCP, syscall.TCP_WINDOW_CLAMP, self.clamp)
+	})
+}
+
+func (self *sockmapEngine) update(cookie uint64, conn *net.TCPConn) error {
+	return sockmapControl(conn, func(fd int) error {
+		value := uint32(fd)
+		attr := struct {
+			mapFD, _   uint32
+			key, value uint64
+			flags      uint64
+		}{mapFD: uint32(self.mapFD), key: uint64(uintptr(unsafe.Pointer(&cookie))), value: uint64(uintptr(unsafe.Pointer(&value)))}
+		_, err := bpf(bpfMapUpdateElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+		runtime.KeepAlive(&cookie)
+		runtime.KeepAlive(&value)
+		return err
+	})
+}
+
+func (self *sockmapEngine) delete(cookie uint64) {
+	attr := struct {
+		mapFD, _ uint32
+		key      uint64
+	}{mapFD: uint32(self.mapFD), key: uint64(uintptr(unsafe.Pointer(&cookie)))}
+	bpf(bpfMapDeleteElem, unsafe.Pointer(&attr), unsafe.Sizeof(attr))
+	runtime.KeepAlive(&cookie)
+}
+
+// Maps the sockets of a session to each other. Both hold back what they
+// receive meanwhile, so the verdict program redirects anything queued before
+// ahead of what follows, instead of passing some to user space while one
+// socket is mapped already, but its peer is not yet.
+func (self *sockmapEngine) setup(session *sockmapSession, a, b *net.TCPConn) error {
+	sockets := [2]*sockmapSocket{{conn: a}, {conn: b}}
+	for i, socket := range sockets {
+		if err := socket.hold(); err != nil {
+			for _, socket := range sockets[:i+1] {
+				socket.release()
+			}
+			return err
+		}
+	}
+	defer func() {
+		for _, socket := range sockets {
+			socket.release()
+		}
+	}()
+	if err := self.update(sockets[0].cookie, b); err != nil {
+		return err
+	}
+	if err := self.update(sockets[1].cookie, a); err != nil {
+		// Nothing got redirected yet, with b not mapped, and a held back
+		self.delete(sockets[0].cookie)
+		return err
+	}
+	session.mapped = true
+	session.sockets = sockets
+	return nil
+}
+
+// Pairs the directions of a session, mapping its sockets once both arrived
+// and may get redirected, before either direction reads.
+func (self *sockmapEngine) pair(src, dst net.Conn, dir RelayDirection, redirect bool) *sockmapSession {
+	key := src
+	if dir == RelayDown {
+		key = dst
+	}
+	self.Lock()
+	session, ok := self.sessions[key]
+	if !ok {
+		if self.sessions == nil {
+			self.sessions = make(map[net.Conn]*sockmapSession)
+		}
+		session = &sockmapSession{ready: make(chan struct{}), redirect: redirect}
+		self.sessions[key] = session
+		self.Unlock()
+		timer := time.NewTimer(sockmapPairing)
+		defer timer.Stop()
+		select {
+		case <-session.ready:
+		case <-timer.C:
+			// The other direction is relayed by another engine, or not at all
+			self.Lock()
+			if self.sessions[key] == session {
+				delete(self.sessions, key)
+				close(session.ready)
+			}
+			self.Unlock()
+			<-session.ready
+		}
+		return session
+	}
+	delete(self.sessions, key)
+	self.Unlock()
+	if redirect && session.redirect {
+		// Failing, e.g. as the map is full, leaves both to CopyEngine
+		self.setup(session, src.(*net.TCPConn), dst.(*net.TCPConn))
+	}
+	close(session.ready)
+	return session
+}
+
+func (self *sockmapEngine) Relay(dst, src RelayConn, dir RelayDirection) error {
+	self.once.Do(func() {
+		self.err = self.load()
+	})
+	if self.err != nil {
+		return CopyEngine.Relay(dst, src, dir)
+	}
+	// The sockets of a session get redirected as a pair, so both directions
+	// must go without the features applied by RelayConn.Read
+	rsrc, ok := src.Raw()
+	rdst, _ := dst.Raw()
+	tsrc, srcTCP := rsrc.(*net.TCPConn)
+	tdst, dstTCP := rdst.(*net.TCPConn)
+	session := self.pair(rsrc, rdst, dir, ok && srcTCP && dstTCP)
+	if !session.mapped {
+		return CopyEngine.Relay(dst, src, dir)
+	}
+	from, to := session.sockets[0], session.sockets[1]
+	if from.conn != tsrc {
+		from, to = to, from
+	}
+
+	// Relays what the verdict program passes to user space, i.e. once the
+	// destination is gone, until the source hits EOF. Not splicing, as that
+	// would skip data passed so.
+	tsrc.SetReadDeadline(time.Time{})
+	tdst.SetWriteDeadline(time.Time{})
+	buf := make([]byte, bufSize)
+	var err error
+	for {
+		var nr int
+		nr, err = tsrc.Read(buf)
+		if nr > 0 {
+			if _, werr := tdst.Write(buf[:nr]); werr != nil {
+				err = werr
+				break
+			}
+		}
+		if err != nil {
+			break
+		}
+	}
+	eof := err == io.EOF
+	if eof {
+		err = nil
+	}
+	var end uint64
+	if sockmapControl(tsrc, func(fd int) error {
+		info, err := sockmapInfo(fd)
+		end = info.received
+		return err
+	}) != nil || end < from.received {
+		return err
+	}
+	relayed := from.queued + end - from.received
+	if eof && end > from.received {
+		relayed-- // The FIN, unless received before mapping
+	}
+	src.Relayed(int64(relayed))
+	if err == nil {
+		// Redirected data may still be on its way to the destination, which
+		// must not see the end of this direction before
+		self.drain(tdst, to.written+relayed)
+	}
+	return err
+}
+
+// Waits until conn got written the bytes given, or cannot send anymore.
+func (self *sockmapEngine) drain(conn *net.TCPConn, bytes uint64) {
+	for {
+		var written uint64
+		var sending bool
+		if sockmapControl(conn, func(fd int) (err error) {
+			written, sending, err = sockmapWritten(fd)
+			return
+		}) != nil || written >= bytes || !sending {
+			return
+		}
+		time.Sleep(sockmapDrainPoll)
+	}
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,134 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux && (amd64 || arm64 || riscv64 || loong64)
+
+package gosocksv5d
+
+import "bytes"
+import "crypto/rand"
+import "io"
+import "net"
+import "sync/atomic"
+import "testing"
+
+// A side of a session, counting the reads Relay did not bypass.
+type testRelayConn struct {
+	conn    *net.TCPConn
+	reads   int64
+	relayed int64
+}
+
+func (self *testRelayConn) Read(b []byte) (int, error) {
+	atomic.AddInt64(&self.reads, 1)
+	return self.conn.Read(b)
+}
+
+func (self *testRelayConn) Write(b []byte) (int, error) {
+	return self.conn.Write(b)
+}
+
+func (self *testRelayConn) Raw() (net.Conn, bool) {
+	return self.conn, true
+}
+
+func (self *testRelayConn) Relayed(n int64) {
+	atomic.AddInt64(&self.relayed, n)
+}
+
+// Returns both ends of a loopback connection.
+func tcpPair(t *testing.T) (*net.TCPConn, *net.TCPConn) {
+	l, err := net.ListenTCP("tcp", &net.TCPAddr{IP: net.IPv4(127, 0, 0, 1)})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	dialed, err := net.DialTCP("tcp", nil, l.Addr().(*net.TCPAddr))
+	if err != nil {
+		t.Fatal(err)
+	}
+	accepted, err := l.AcceptTCP()
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() {
+		dialed.Close()
+		accepted.Close()
+	})
+	return dialed, accepted
+}
+
+func TestSockmapEngine(t *testing.T) {
+	engine := &sockmapEngine{}
+	if engine.once.Do(func() { engine.err = engine.load() }); engine.err != nil {
+		t.Skipf("Cannot set up a sockmap, %v", engine.err)
+	}
+	client, server := tcpPair(t)
+	remote, dest := tcpPair(t)
+	up := &testRelayConn{conn: server}
+	down := &testRelayConn{conn: remote}
+
+	// Queued before relaying, with the client waiting for it
+	banner := []byte("SSH-2.0-test\r\n")
+	if _, err := dest.Write(banner); err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		io.Copy(dest, dest)
+		dest.CloseWrite()
+	}()
+	errs := make(chan error, 2)
+	go func() {
+		errs <- engine.Relay(down, up, RelayUp)
+		remote.CloseWrite()
+	}()
+	go func() {
+		errs <- engine.Relay(up, down, RelayDown)
+		server.CloseWrite()
+	}()
+
+	received := make([]byte, len(banner))
+	if _, err := io.ReadFull(client, received); err != nil || !bytes.Equal(received, banner) {
+		t.Fatalf("Got %q, %v, want the banner", received, err)
+	}
+	sent := make([]byte, 16<<20)
+	rand.Read(sent)
+	go func() {
+		client.Write(sent)
+		client.CloseWrite()
+	}()
+	if received, err := io.ReadAll(client); err != nil || !bytes.Equal(received, sent) {
+		t.Fatalf("Got %d bytes back, %v, want the %d sent, in order", len(received), err, len(sent))
+	}
+	for i := 0; i < 2; i++ {
+		if err := <-errs; err != nil {
+			t.Fatal(err)
+		}
+	}
+	if up.reads != 0 || down.reads != 0 {
+		t.Errorf("Relayed by copying, %d and %d reads", up.reads, down.reads)
+	}
+	if up.relayed != int64(len(sent)) || down.relayed != int64(len(banner)+len(sent)) {
+		t.Errorf("Relayed %d up and %d down, want %d and %d", up.relayed, down.relayed, len(sent), len(banner)+len(sent))
+	}
+}
+
+// vim: set noet ts=2 sw=2:
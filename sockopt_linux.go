@@ -0,0 +1,60 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+//go:build linux
+
+package gosocksv5d
+
+import "syscall"
+
+// Applies the socket level SessionOptions to an outgoing socket.
+func applySocketOptions(fd uintptr, opts *SessionOptions) error {
+	if opts.Mark != 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_MARK, opts.Mark); err != nil {
+			return err
+		}
+	}
+	if len(opts.Device) != 0 {
+		if err := syscall.BindToDevice(int(fd), opts.Device); err != nil {
+			return err
+		}
+	}
+	return applyBufferOptions(fd, opts)
+}
+
+// Applies the socket buffer sizes of opts, if any, before connecting, or to
+// a listening socket, whose sizes accepted sockets inherit, so that TCP can
+// negotiate a window scale fitting them.
+func applyBufferOptions(fd uintptr, opts *SessionOptions) error {
+	if opts.RecvBuffer > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_RCVBUF, opts.RecvBuffer); err != nil {
+			return err
+		}
+	}
+	if opts.SendBuffer > 0 {
+		if err := syscall.SetsockoptInt(int(fd), syscall.SOL_SOCKET, syscall.SO_SNDBUF, opts.SendBuffer); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,119 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "fmt"
+
+// SOCKS protocol version, as sent in greetings, requests and replies.
+const Version = 0x5
+
+// Auth methods of RFC 1928, see AuthMethod for private ones.
+const (
+	MethodNoAuth       = 0x0
+	MethodGSSAPI       = 0x1
+	MethodUserPass     = 0x2
+	MethodNoAcceptable = 0xff
+)
+
+// Command of a request.
+type Command byte
+
+const (
+	CmdConnect Command = 0x1
+	CmdBind    Command = 0x2
+	CmdAssoc   Command = 0x3 // UDP ASSOCIATE
+)
+
+func (self Command) String() string {
+	switch self {
+	case CmdConnect:
+		return "CONNECT"
+	case CmdBind:
+		return "BIND"
+	case CmdAssoc:
+		return "UDP ASSOCIATE"
+	}
+	return fmt.Sprintf("Command(%#x)", byte(self))
+}
+
+// Type of the address of a request or reply.
+type AddrType byte
+
+const (
+	AddrIPv4   AddrType = 0x1
+	AddrDomain AddrType = 0x3
+	AddrIPv6   AddrType = 0x4
+)
+
+func (self AddrType) String() string {
+	switch self {
+	case AddrIPv4:
+		return "IPv4"
+	case AddrDomain:
+		return "domain"
+	case AddrIPv6:
+		return "IPv6"
+	}
+	return fmt.Sprintf("AddrType(%#x)", byte(self))
+}
+
+// Reply code of a reply to a request.
+type ReplyCode byte
+
+const (
+	ReplySuccess         ReplyCode = 0x0
+	ReplyFailure         ReplyCode = 0x1
+	ReplyNotAllowed      ReplyCode = 0x2
+	ReplyNetUnreachable  ReplyCode = 0x3
+	ReplyHostUnreachable ReplyCode = 0x4
+	ReplyRefused         ReplyCode = 0x5
+	ReplyTTL             ReplyCode = 0x6
+	ReplyNotSupported    ReplyCode = 0x7
+	ReplyNotAddressable  ReplyCode = 0x8
+)
+
+// Returns the meaning of the reply code, as worded by RFC 1928.
+func (self ReplyCode) String() string {
+	switch self {
+	case ReplySuccess:
+		return "succeeded"
+	case ReplyFailure:
+		return "general SOCKS server failure"
+	case ReplyNotAllowed:
+		return "connection not allowed by ruleset"
+	case ReplyNetUnreachable:
+		return "network unreachable"
+	case ReplyHostUnreachable:
+		return "host unreachable"
+	case ReplyRefused:
+		return "connection refused"
+	case ReplyTTL:
+		return "TTL expired"
+	case ReplyNotSupported:
+		return "command not supported"
+	case ReplyNotAddressable:
+		return "address type not supported"
+	}
+	return fmt.Sprintf("ReplyCode(%#x)", byte(self))
+}
+
+// vim: set noet ts=2 sw=2:
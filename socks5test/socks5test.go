@@ -0,0 +1,316 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+// Package socks5test provides utilities for testing SOCKS v5 servers, such
+// as gosocksv5d.Server instances with custom Rulers or auth methods, by
+// running scripted client conversations against them and checking the
+// replies.
+//
+// The Conformance suite takes the address of an echo server the server under
+// test allows connecting to, to check that CONNECT relays data both ways, or
+// an empty one to skip that check.
+//
+//	srv := gosocksv5d.NewServer()
+//	addr, err := socks5test.Serve(srv)
+//	...
+//	echo := "127.0.0.1:7" // Or "" without an echo server
+//	socks5test.RunT(t, socks5test.Dialer(addr), socks5test.Conformance(echo)...)
+package socks5test
+
+import "bytes"
+import "encoding/binary"
+import "errors"
+import "fmt"
+import "io"
+import "net"
+import "strconv"
+import "testing"
+import "time"
+import "github.com/nmaier/gosocksv5d"
+
+// Time each step may take at most.
+var StepTimeout = 5 * time.Second
+
+// SOCKS v5 auth methods, replies and commands, for convenience.
+const (
+	MethodNoAuth       = gosocksv5d.MethodNoAuth
+	MethodGSSAPI       = gosocksv5d.MethodGSSAPI
+	MethodUserPass     = gosocksv5d.MethodUserPass
+	MethodNoAcceptable = gosocksv5d.MethodNoAcceptable
+
+	ReplySuccess         = gosocksv5d.ReplySuccess
+	ReplyFailure         = gosocksv5d.ReplyFailure
+	ReplyNotAllowed      = gosocksv5d.ReplyNotAllowed
+	ReplyNetUnreachable  = gosocksv5d.ReplyNetUnreachable
+	ReplyHostUnreachable = gosocksv5d.ReplyHostUnreachable
+	ReplyRefused         = gosocksv5d.ReplyRefused
+	ReplyTTL             = gosocksv5d.ReplyTTL
+	ReplyNotSupported    = gosocksv5d.ReplyNotSupported
+	ReplyNotAddressable  = gosocksv5d.ReplyNotAddressable
+
+	CmdConnect = gosocksv5d.CmdConnect
+	CmdBind    = gosocksv5d.CmdBind
+	CmdAssoc   = gosocksv5d.CmdAssoc
+)
+
+// Step of a Script, sending data to the server or checking what it sends.
+type Step interface {
+	Run(conn net.Conn) error
+	String() string
+}
+
+// Script of a client conversation.
+type Script struct {
+	Name  string
+	Steps []Step
+}
+
+// Connects to the server under test, e.g. via TCP, or in memory.
+type DialFunc func() (net.Conn, error)
+
+// Returns a DialFunc connecting to addr via TCP.
+func Dialer(addr string) DialFunc {
+	return func() (net.Conn, error) {
+		return net.DialTimeout("tcp", addr, StepTimeout)
+	}
+}
+
+// Runs the script on a new connection, returning the first failing step's
+// error, if any.
+func Run(dial DialFunc, script Script) error {
+	conn, err := dial()
+	if err != nil {
+		return err
+	}
+	defer conn.Close()
+	for i, step := range script.Steps {
+		conn.SetDeadline(time.Now().Add(StepTimeout))
+		if err := step.Run(conn); err != nil {
+			return fmt.Errorf("%s: step %d (%v): %w", script.Name, i+1, step, err)
+		}
+	}
+	return nil
+}
+
+// Runs each script as a sub-test of t.
+func RunT(t *testing.T, dial DialFunc, scripts ...Script) {
+	t.Helper()
+	for _, script := range scripts {
+		script := script
+		t.Run(script.Name, func(t *testing.T) {
+			if err := Run(dial, script); err != nil {
+				t.Fatal(err)
+			}
+		})
+	}
+}
+
+// Starts serving srv on a free loopback port, returning its address once
+// listening.
+func Serve(srv gosocksv5d.Server) (string, error) {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		return "", err
+	}
+	port := l.Addr().(*net.TCPAddr).Port
+	l.Close()
+
+	states := make(chan gosocksv5d.ServerState, 4)
+	srv.NotifyState(states)
+	failed := make(chan error, 1)
+	go func() {
+		failed <- srv.ListenAndServe(net.IPv4(127, 0, 0, 1), port)
+	}()
+	select {
+	case <-states:
+	case err := <-failed:
+		return "", err
+	}
+	return net.JoinHostPort("127.0.0.1", strconv.Itoa(port)), nil
+}
+
+type sendStep struct {
+	name string
+	data []byte
+}
+
+func (self *sendStep) Run(conn net.Conn) error {
+	_, err := conn.Write(self.data)
+	return err
+}
+
+func (self *sendStep) String() string {
+	return self.name
+}
+
+// Sends raw data.
+func Send(data ...byte) Step {
+	return &sendStep{fmt.Sprintf("send %x", data), data}
+}
+
+// Sends a greeting offering the methods.
+func Greeting(methods ...byte) Step {
+	return &sendStep{fmt.Sprintf("greeting %x", methods), append([]byte{gosocksv5d.Version, byte(len(methods))}, methods...)}
+}
+
+// Sends a request, for a host name or IP.
+func Request(cmd gosocksv5d.Command, host string, port int) Step {
+	data := []byte{gosocksv5d.Version, byte(cmd), 0}
+	if ip := net.ParseIP(host); ip == nil {
+		data = append(append(data, byte(gosocksv5d.AddrDomain), byte(len(host))), host...)
+	} else if ip4 := ip.To4(); ip4 != nil {
+		data = append(append(data, byte(gosocksv5d.AddrIPv4)), ip4...)
+	} else {
+		data = append(append(data, byte(gosocksv5d.AddrIPv6)), ip.To16()...)
+	}
+	data = binary.BigEndian.AppendUint16(data, uint16(port))
+	return &sendStep{fmt.Sprintf("request %v %s", cmd, net.JoinHostPort(host, strconv.Itoa(port))), data}
+}
+
+// Sends a CONNECT request.
+func Connect(host string, port int) Step {
+	return Request(CmdConnect, host, port)
+}
+
+type expectStep struct {
+	name string
+	data []byte
+}
+
+func (self *expectStep) Run(conn net.Conn) error {
+	got := make([]byte, len(self.data))
+	if _, err := io.ReadFull(conn, got); err != nil {
+		return err
+	}
+	if !bytes.Equal(got, self.data) {
+		return fmt.Errorf("got %x", got)
+	}
+	return nil
+}
+
+func (self *expectStep) String() string {
+	return self.name
+}
+
+// Expects raw data.
+func Expect(data ...byte) Step {
+	return &expectStep{fmt.Sprintf("expect %x", data), data}
+}
+
+// Expects the server to select method.
+func ExpectMethod(method byte) Step {
+	return &expectStep{fmt.Sprintf("expect method %x", method), []byte{gosocksv5d.Version, method}}
+}
+
+type replyStep gosocksv5d.ReplyCode
+
+func (self replyStep) Run(conn net.Conn) error {
+	head := make([]byte, 4)
+	if _, err := io.ReadFull(conn, head); err != nil {
+		return err
+	}
+	if head[0] != gosocksv5d.Version {
+		return fmt.Errorf("invalid version %d", head[0])
+	}
+	if code := gosocksv5d.ReplyCode(head[1]); code != gosocksv5d.ReplyCode(self) {
+		return fmt.Errorf("got reply %v", code)
+	}
+	var size int
+	switch gosocksv5d.AddrType(head[3]) {
+	case gosocksv5d.AddrIPv4:
+		size = net.IPv4len
+	case gosocksv5d.AddrIPv6:
+		size = net.IPv6len
+	case gosocksv5d.AddrDomain:
+		n := make([]byte, 1)
+		if _, err := io.ReadFull(conn, n); err != nil {
+			return err
+		}
+		size = int(n[0])
+	default:
+		return fmt.Errorf("invalid address type %d", head[3])
+	}
+	_, err := io.ReadFull(conn, make([]byte, size+2))
+	return err
+}
+
+func (self replyStep) String() string {
+	return fmt.Sprintf("expect reply %v", gosocksv5d.ReplyCode(self))
+}
+
+// Expects a reply to a request, with any bound address.
+func ExpectReply(code gosocksv5d.ReplyCode) Step {
+	return replyStep(code)
+}
+
+type closedStep struct{}
+
+func (closedStep) Run(conn net.Conn) error {
+	n, err := conn.Read(make([]byte, 1))
+	if n == 0 && errors.Is(err, io.EOF) {
+		return nil
+	}
+	if err != nil {
+		var ne net.Error
+		if errors.As(err, &ne) && ne.Timeout() {
+			return errors.New("still open")
+		}
+		return nil // e.g. reset
+	}
+	return errors.New("got data")
+}
+
+func (closedStep) String() string {
+	return "expect closed"
+}
+
+// Expects the server to close the connection, without sending further data.
+func ExpectClosed() Step {
+	return closedStep{}
+}
+
+// Expects to receive exactly what was sent before, e.g. via an echo server.
+func Echo(data []byte) []Step {
+	return []Step{Send(data...), Expect(data...)}
+}
+
+// Returns a basic conformance suite for servers selecting the no auth
+// method. If echo is not empty, it should be the address of an echo server
+// the server under test allows connecting to.
+func Conformance(echo string) []Script {
+	scripts := []Script{
+		{"bad version", []Step{Send(4, 1, 0), ExpectClosed()}},
+		{"no acceptable method", []Step{Greeting(0x7f), ExpectMethod(MethodNoAcceptable), ExpectClosed()}},
+		{"bind not supported", []Step{Greeting(MethodNoAuth), ExpectMethod(MethodNoAuth),
+			Request(CmdBind, "192.0.2.1", 80), ExpectReply(ReplyNotSupported), ExpectClosed()}},
+		{"bad address type", []Step{Greeting(MethodNoAuth), ExpectMethod(MethodNoAuth),
+			Send(gosocksv5d.Version, byte(CmdConnect), 0, 9), ExpectReply(ReplyNotAddressable), ExpectClosed()}},
+	}
+	if len(echo) != 0 {
+		host, sport, _ := net.SplitHostPort(echo)
+		port, _ := strconv.Atoi(sport)
+		steps := []Step{Greeting(MethodNoAuth), ExpectMethod(MethodNoAuth), Connect(host, port), ExpectReply(ReplySuccess)}
+		scripts = append(scripts, Script{"connect", append(steps, Echo([]byte("hello"))...)})
+	}
+	return scripts
+}
+
+// vim: set noet ts=2 sw=2:
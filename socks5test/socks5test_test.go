@@ -0,0 +1,99 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package socks5test
+
+import "context"
+import "io"
+import "net"
+import "testing"
+import "github.com/nmaier/gosocksv5d"
+
+type allowRuler struct{}
+
+func (allowRuler) ConnectionAllowed(client *gosocksv5d.ClientInfo, ip net.IP) gosocksv5d.RulerResult {
+	return gosocksv5d.AllowConnection
+}
+
+type denyRuler struct{}
+
+func (denyRuler) ConnectionAllowed(client *gosocksv5d.ClientInfo, ip net.IP) gosocksv5d.RulerResult {
+	return gosocksv5d.DenyConnection
+}
+
+// Starts an echo server on a free loopback port, returning its address.
+func serveEcho(t *testing.T) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { l.Close() })
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				io.Copy(conn, conn)
+				conn.Close()
+			}()
+		}
+	}()
+	return l.Addr().String()
+}
+
+// Starts srv, shutting it down once the test is done.
+func serve(t *testing.T, srv gosocksv5d.Server) DialFunc {
+	addr, err := Serve(srv)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { srv.Shutdown(context.Background()) })
+	return Dialer(addr)
+}
+
+func TestConformance(t *testing.T) {
+	srv := gosocksv5d.NewServer()
+	srv.SetRuler(allowRuler{})
+	RunT(t, serve(t, srv), Conformance(serveEcho(t))...)
+}
+
+func TestDenied(t *testing.T) {
+	srv := gosocksv5d.NewServer()
+	srv.SetRuler(denyRuler{})
+	RunT(t, serve(t, srv), Script{"denied", []Step{Greeting(MethodNoAuth), ExpectMethod(MethodNoAuth),
+		Connect("127.0.0.1", 9), ExpectReply(ReplyNotAllowed), ExpectClosed()}})
+}
+
+func TestAuthRequired(t *testing.T) {
+	srv := gosocksv5d.NewServer()
+	srv.SetRuler(allowRuler{})
+	srv.SetAuthMethod(0x80, gosocksv5d.AuthMethodFunc(func(client *gosocksv5d.ClientInfo, conn net.Conn) (net.Conn, string, error) {
+		return conn, "user", nil
+	}))
+	RunT(t, serve(t, srv),
+		Script{"no auth", []Step{Greeting(MethodNoAuth), ExpectMethod(MethodNoAcceptable), ExpectClosed()}},
+		Script{"private method", []Step{Greeting(MethodNoAuth, 0x80), ExpectMethod(0x80),
+			Request(CmdBind, "192.0.2.1", 80), ExpectReply(ReplyNotSupported), ExpectClosed()}})
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,209 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "database/sql"
+import "fmt"
+import "strings"
+import "sync"
+import "sync/atomic"
+import "time"
+
+const (
+	defaultAuditTable    = "sessions"
+	defaultAuditBatch    = 100
+	defaultAuditInterval = 5 * time.Second
+)
+
+// SQLAudit configures a SQLAuditLogger.
+type SQLAudit struct {
+	Table     string        // Table to insert into, "sessions" if empty
+	BatchSize int           // Records inserted per transaction, 100 if zero
+	Interval  time.Duration // Time records wait for a batch to fill, 5 seconds if zero
+	Numbered  bool          // Use numbered placeholders ($1), e.g. for PostgreSQL, instead of ?
+}
+
+// SQLAuditLogger is an AccessLogger inserting a row per completed session
+// (EventClosed) into a database, e.g. for compliance queries:
+//
+//	SELECT client, identity, host, port, bytes_up, bytes_down FROM sessions
+//	WHERE started >= '2013-10-01'
+//
+// The table gets created if it does not exist yet.
+// Records are queued and inserted in batches by a background goroutine;
+// records not fitting into the queue, or failing to insert, are dropped.
+// Close the logger to insert pending records.
+type SQLAuditLogger struct {
+	sync.RWMutex
+	db      *sql.DB
+	insert  string
+	batch   int
+	wait    time.Duration
+	queue   chan *AccessRecord
+	done    chan struct{}
+	closed  bool
+	dropped uint64
+}
+
+// Creates a new SQLAuditLogger, inserting into db.
+func NewSQLAuditLogger(db *sql.DB, config SQLAudit) (*SQLAuditLogger, error) {
+	table := config.Table
+	if len(table) == 0 {
+		table = defaultAuditTable
+	}
+	_, err := db.Exec(fmt.Sprintf(`CREATE TABLE IF NOT EXISTS %s (
+		started TIMESTAMP NOT NULL,
+		ended TIMESTAMP NOT NULL,
+		client VARCHAR(64) NOT NULL,
+		client_port INTEGER NOT NULL,
+		identity VARCHAR(255) NOT NULL,
+		host VARCHAR(255) NOT NULL,
+		dest VARCHAR(64) NOT NULL,
+		port INTEGER NOT NULL,
+		bytes_up BIGINT NOT NULL,
+		bytes_down BIGINT NOT NULL
+	)`, table))
+	if err != nil {
+		return nil, err
+	}
+
+	columns := []string{"started", "ended", "client", "client_port", "identity", "host", "dest", "port", "bytes_up", "bytes_down"}
+	placeholders := make([]string, len(columns))
+	for i := range placeholders {
+		if config.Numbered {
+			placeholders[i] = fmt.Sprintf("$%d", i+1)
+		} else {
+			placeholders[i] = "?"
+		}
+	}
+	rv := &SQLAuditLogger{
+		db:     db,
+		insert: fmt.Sprintf("INSERT INTO %s (%s) VALUES (%s)", table, strings.Join(columns, ", "), strings.Join(placeholders, ", ")),
+		batch:  config.BatchSize,
+		wait:   config.Interval,
+		done:   make(chan struct{}),
+	}
+	if rv.batch <= 0 {
+		rv.batch = defaultAuditBatch
+	}
+	if rv.wait <= 0 {
+		rv.wait = defaultAuditInterval
+	}
+	rv.queue = make(chan *AccessRecord, rv.batch*4)
+	go rv.run()
+	return rv, nil
+}
+
+func (self *SQLAuditLogger) LogAccess(record *AccessRecord) {
+	if record.Event != EventClosed {
+		return
+	}
+	self.RLock()
+	defer self.RUnlock()
+	if self.closed {
+		atomic.AddUint64(&self.dropped, 1)
+		return
+	}
+	select {
+	case self.queue <- record:
+	default:
+		atomic.AddUint64(&self.dropped, 1)
+	}
+}
+
+// Returns the number of records dropped, due to a full queue or failing
+// inserts.
+func (self *SQLAuditLogger) Dropped() uint64 {
+	return atomic.LoadUint64(&self.dropped)
+}
+
+// Inserts pending records and stops the logger. The database is left open.
+func (self *SQLAuditLogger) Close() error {
+	self.Lock()
+	if !self.closed {
+		self.closed = true
+		close(self.queue)
+	}
+	self.Unlock()
+	<-self.done
+	return nil
+}
+
+func (self *SQLAuditLogger) run() {
+	defer close(self.done)
+	ticker := time.NewTicker(self.wait)
+	defer ticker.Stop()
+	pending := make([]*AccessRecord, 0, self.batch)
+	for {
+		select {
+		case record, ok := <-self.queue:
+			if !ok {
+				self.flush(pending)
+				return
+			}
+			if pending = append(pending, record); len(pending) >= self.batch {
+				self.flush(pending)
+				pending = pending[:0]
+			}
+		case <-ticker.C:
+			self.flush(pending)
+			pending = pending[:0]
+		}
+	}
+}
+
+func (self *SQLAuditLogger) flush(records []*AccessRecord) {
+	if len(records) == 0 {
+		return
+	}
+	if err := self.insertAll(records); err != nil {
+		atomic.AddUint64(&self.dropped, uint64(len(records)))
+	}
+}
+
+func (self *SQLAuditLogger) insertAll(records []*AccessRecord) error {
+	tx, err := self.db.Begin()
+	if err != nil {
+		return err
+	}
+	stmt, err := tx.Prepare(self.insert)
+	if err != nil {
+		tx.Rollback()
+		return err
+	}
+	defer stmt.Close()
+	for _, record := range records {
+		dest := ""
+		if record.Dest != nil {
+			dest = record.Dest.String()
+		}
+		_, err := stmt.Exec(record.Start.UTC(), record.Time.UTC(), record.Client.IP.String(), record.Client.Port,
+			record.Client.Identity, record.Host, dest, record.Port, int64(record.BytesUp), int64(record.BytesDown))
+		if err != nil {
+			tx.Rollback()
+			return err
+		}
+	}
+	return tx.Commit()
+}
+
+// vim: set noet ts=2 sw=2:
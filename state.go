@@ -0,0 +1,77 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+// ServerState describes whether a server is accepting connections.
+type ServerState int
+
+const (
+	StateIdle      ServerState = iota // Not listening yet
+	StateListening                    // Accepting connections
+	StatePaused                       // Not accepting connections, see: Server.Stop()
+	StateFailed                       // All listeners failed
+	StateClosed                       // Shut down for good, see: Server.Shutdown()
+)
+
+func (self ServerState) String() string {
+	switch self {
+	case StateIdle:
+		return "idle"
+	case StateListening:
+		return "listening"
+	case StatePaused:
+		return "paused"
+	case StateFailed:
+		return "failed"
+	case StateClosed:
+		return "closed"
+	}
+	return "unknown"
+}
+
+// Must be called with the server locked.
+func (self *server) setState(state ServerState) {
+	if self.state == state {
+		return
+	}
+	self.state = state
+	for _, c := range self.notify {
+		select {
+		case c <- state:
+		default:
+		}
+	}
+}
+
+func (self *server) State() ServerState {
+	self.Lock()
+	defer self.Unlock()
+	return self.state
+}
+
+func (self *server) NotifyState(c chan<- ServerState) {
+	self.Lock()
+	defer self.Unlock()
+	self.notify = append(self.notify, c)
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,148 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "sync"
+import "time"
+
+// Stats is a snapshot of the counters of a server.
+type Stats struct {
+	Accepted     uint64  // Connections accepted
+	AcceptErrors uint64  // Errors while accepting
+	QueueFull    uint64  // Times the accept queue was full
+	Dropped      uint64  // Connections dropped due to the accept queue being full
+	QueueDepth   int64   // Accepted connections waiting to be served
+	Rejected     uint64  // Connections rejected due to the handshake limit
+	Banned       uint64  // Connections rejected due to the client being banned
+	Bans         uint64  // Clients banned
+	Reaped       uint64  // Sessions closed as half-open, or due to a dead peer
+	Mismatches   uint64  // Sessions not speaking the protocol expected for the port
+	Divergences  uint64  // Requests the dry-run Ruler would have decided differently
+	Capped       uint64  // Sessions closed due to SessionOptions.MaxBytes
+	Throttled    uint64  // Requests failed due to Limits.DestinationRate
+	DialWaits    uint64  // Requests failed waiting to dial, see Limits.DestinationDials
+	Relayed      uint64  // Bytes relayed, both directions combined
+	AcceptRate   float64 // Accepts per second, averaged over the last 10 seconds
+
+	// Policy denials by reason, e.g. ReasonDefaultLocal.
+	Denials map[string]uint64
+
+	SessionDuration  Histogram // Seconds relayed per session
+	BytesUp          Histogram // Bytes sent by clients per session
+	BytesDown        Histogram // Bytes received by clients per session
+	HandshakeLatency Histogram // Seconds from accepting to connecting a session
+
+	Resolver ResolverStats
+
+	// Sessions and bytes by metric tags, see Server.SetMetricTags().
+	Tagged []TaggedTraffic
+
+	// Circuits of the CircuitBreaker, if any.
+	Circuits CircuitStats
+
+	// Usage of the MemoryBudget, if any.
+	Memory MemoryStats
+
+	// Matches of the rules of the Ruler, if a RuleCounter.
+	Rules []RuleHits
+}
+
+type serverStats struct {
+	accepted     uint64
+	acceptErrors uint64
+	queueFull    uint64
+	dropped      uint64
+	queueDepth   int64
+	rejected     uint64
+	banned       uint64
+	bans         uint64
+	reaped       uint64
+	mismatches   uint64
+	divergences  uint64
+	capped       uint64
+	throttled    uint64
+	dialWaits    uint64
+	relayed      uint64
+	acceptRate   rateCounter
+	denials      denialCounter
+
+	sessionDuration  *histogram
+	bytesUp          *histogram
+	bytesDown        *histogram
+	handshakeLatency *histogram
+	resolver         *resolverStats
+	traffic          *trafficStats
+}
+
+func newServerStats() serverStats {
+	return serverStats{
+		sessionDuration:  newHistogram(durationBounds),
+		bytesUp:          newHistogram(byteBounds),
+		bytesDown:        newHistogram(byteBounds),
+		handshakeLatency: newHistogram(latencyBounds),
+		resolver:         newResolverStats(),
+		traffic:          &trafficStats{},
+	}
+}
+
+const rateBuckets = 10
+
+// Counts events per second, over the last rateBuckets seconds.
+type rateCounter struct {
+	sync.Mutex
+	buckets [rateBuckets]uint64
+	last    int64
+}
+
+func (self *rateCounter) advance(now int64) {
+	if now-self.last >= rateBuckets {
+		self.buckets = [rateBuckets]uint64{}
+	} else {
+		for t := self.last + 1; t <= now; t++ {
+			self.buckets[t%rateBuckets] = 0
+		}
+	}
+	if now > self.last {
+		self.last = now
+	}
+}
+
+func (self *rateCounter) add() {
+	now := time.Now().Unix()
+	self.Lock()
+	defer self.Unlock()
+	self.advance(now)
+	self.buckets[now%rateBuckets]++
+}
+
+func (self *rateCounter) rate() float64 {
+	self.Lock()
+	defer self.Unlock()
+	self.advance(time.Now().Unix())
+	var sum uint64
+	for _, count := range self.buckets {
+		sum += count
+	}
+	return float64(sum) / rateBuckets
+}
+
+// vim: set noet ts=2 sw=2:
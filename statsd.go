@@ -0,0 +1,256 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "bytes"
+import "fmt"
+import "net"
+import "sort"
+import "strings"
+import "sync"
+import "time"
+
+const (
+	statsdDatagram = 1432
+	statsdInterval = 10 * time.Second
+)
+
+// StatsdSink emits the counters of a Server via UDP in statsd format, with
+// DogStatsD tags if any, for aggregation by e.g. Datadog or Telegraf.
+//
+// Counters are sent as the increments since the previous report, the accept
+// queue depth and rate as gauges. Histograms are sent as the number of
+// observations since the previous report, plus the median, p95 and p99 as
+// gauges, durations in milliseconds.
+type StatsdSink struct {
+	sync.Mutex
+	conn   net.Conn
+	prefix string
+	tags   string
+	prev   map[string]uint64
+	buf    bytes.Buffer
+	closed chan struct{}
+	once   sync.Once
+}
+
+// Creates a new StatsdSink, sending to the statsd server at addr (host:port).
+// Metric names get prefixed with prefix, e.g. "socks.", and carry tags, e.g.
+// "env:prod", if any.
+func DialStatsd(addr, prefix string, tags ...string) (*StatsdSink, error) {
+	conn, err := net.Dial("udp", addr)
+	if err != nil {
+		return nil, err
+	}
+	rv := &StatsdSink{
+		conn:   conn,
+		prefix: prefix,
+		prev:   make(map[string]uint64),
+		closed: make(chan struct{}),
+	}
+	if len(tags) != 0 {
+		rv.tags = "|#" + strings.Join(tags, ",")
+	}
+	return rv, nil
+}
+
+// Reports srv every interval (10 seconds if not positive), until the sink is
+// closed.
+func (self *StatsdSink) Run(srv Server, interval time.Duration) {
+	if interval <= 0 {
+		interval = statsdInterval
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-ticker.C:
+			self.Report(srv.Stats())
+		case <-self.closed:
+			return
+		}
+	}
+}
+
+// Sends a snapshot of server counters.
+func (self *StatsdSink) Report(stats Stats) error {
+	self.Lock()
+	defer self.Unlock()
+	self.buf.Reset()
+
+	self.counter("accepted", stats.Accepted)
+	self.counter("accept_errors", stats.AcceptErrors)
+	self.counter("queue_full", stats.QueueFull)
+	self.counter("dropped", stats.Dropped)
+	self.counter("rejected", stats.Rejected)
+	self.counter("banned", stats.Banned)
+	self.counter("bans", stats.Bans)
+	self.counter("reaped", stats.Reaped)
+	self.counter("protocol_mismatches", stats.Mismatches)
+	self.counter("dry_run_divergences", stats.Divergences)
+	self.counter("capped", stats.Capped)
+	self.counter("destination_throttled", stats.Throttled)
+	self.counter("dial_waits", stats.DialWaits)
+	self.counter("relayed", stats.Relayed)
+	self.gauge("queue_depth", float64(stats.QueueDepth))
+	self.gauge("accept_rate", stats.AcceptRate)
+
+	reasons := make([]string, 0, len(stats.Denials))
+	for reason := range stats.Denials {
+		reasons = append(reasons, reason)
+	}
+	sort.Strings(reasons)
+	for _, reason := range reasons {
+		self.counter("denials."+reason, stats.Denials[reason])
+	}
+
+	self.histogram("session_duration", stats.SessionDuration, 1000)
+	self.histogram("handshake_latency", stats.HandshakeLatency, 1000)
+	self.histogram("bytes_up", stats.BytesUp, 1)
+	self.histogram("bytes_down", stats.BytesDown, 1)
+
+	self.counter("resolver.queries", stats.Resolver.Queries)
+	self.counter("resolver.failures", stats.Resolver.Failures)
+	self.counter("resolver.nxdomain", stats.Resolver.NXDomain)
+	self.counter("resolver.timeouts", stats.Resolver.Timeouts)
+	self.counter("resolver.cache_hits", stats.Resolver.CacheHits)
+	self.counter("resolver.cache_misses", stats.Resolver.CacheMisses)
+	self.histogram("resolver.latency", stats.Resolver.Latency, 1000)
+
+	for _, tagged := range stats.Tagged {
+		tags := make([]string, 0, len(tagged.Tags))
+		for k, v := range tagged.Tags {
+			tags = append(tags, k+":"+v)
+		}
+		sort.Strings(tags)
+		suffix := strings.Join(tags, ",")
+		self.counterTagged("tagged.sessions", suffix, tagged.Sessions)
+		self.counterTagged("tagged.bytes_up", suffix, tagged.BytesUp)
+		self.counterTagged("tagged.bytes_down", suffix, tagged.BytesDown)
+	}
+
+	self.counter("circuits.trips", stats.Circuits.Trips)
+	self.counter("circuits.fast_fails", stats.Circuits.FastFails)
+	self.gauge("circuits.open", float64(len(stats.Circuits.Open)))
+	self.gauge("memory.used", float64(stats.Memory.Used))
+	self.counter("memory.shed", stats.Memory.Shed)
+	self.counter("memory.reaped", stats.Memory.Reaped)
+
+	return self.flush()
+}
+
+// Sends the freshness of threat feeds, as the seconds since the last update
+// and the number of entries, by feed name.
+func (self *StatsdSink) ReportFeeds(feeds []FeedStats) error {
+	self.Lock()
+	defer self.Unlock()
+	self.buf.Reset()
+
+	now := time.Now()
+	for _, feed := range feeds {
+		if !feed.Updated.IsZero() {
+			self.gauge("feeds."+feed.Name+".age", now.Sub(feed.Updated).Seconds())
+		}
+		self.gauge("feeds."+feed.Name+".entries", float64(feed.Entries))
+		self.counter("feeds."+feed.Name+".failures", feed.Failures)
+	}
+
+	return self.flush()
+}
+
+// Stops Run() and closes the underlying connection.
+func (self *StatsdSink) Close() (err error) {
+	self.once.Do(func() {
+		close(self.closed)
+		err = self.conn.Close()
+	})
+	return
+}
+
+func (self *StatsdSink) counter(name string, value uint64) {
+	self.counterTagged(name, "", value)
+}
+
+// Sends a counter carrying tags, e.g. "policy:backup", besides the ones of the
+// sink.
+func (self *StatsdSink) counterTagged(name, tags string, value uint64) {
+	key := name + "|" + tags
+	prev := self.prev[key]
+	self.prev[key] = value
+	if value < prev {
+		// Counters got reset, e.g. by a reload
+		prev = 0
+	}
+	if value == prev {
+		return
+	}
+	self.metricTagged(name, fmt.Sprintf("%d|c", value-prev), tags)
+}
+
+func (self *StatsdSink) gauge(name string, value float64) {
+	self.metric(name, fmt.Sprintf("%g|g", value))
+}
+
+func (self *StatsdSink) histogram(name string, hist Histogram, scale float64) {
+	self.counter(name+".count", hist.Count)
+	if hist.Count == 0 {
+		return
+	}
+	self.gauge(name+".median", hist.Quantile(0.5)*scale)
+	self.gauge(name+".p95", hist.Quantile(0.95)*scale)
+	self.gauge(name+".p99", hist.Quantile(0.99)*scale)
+}
+
+// Appends a metric line, sending the pending ones first if the datagram
+// would grow too large.
+func (self *StatsdSink) metric(name, value string) {
+	self.metricTagged(name, value, "")
+}
+
+// Appends a metric line carrying tags, besides the ones of the sink.
+func (self *StatsdSink) metricTagged(name, value, tags string) {
+	line := self.prefix + name + ":" + value + self.tags
+	switch {
+	case len(tags) == 0:
+	case len(self.tags) == 0:
+		line += "|#" + tags
+	default:
+		line += "," + tags
+	}
+	if self.buf.Len() != 0 && self.buf.Len()+1+len(line) > statsdDatagram {
+		self.flush()
+	}
+	if self.buf.Len() != 0 {
+		self.buf.WriteByte('\n')
+	}
+	self.buf.WriteString(line)
+}
+
+func (self *StatsdSink) flush() error {
+	if self.buf.Len() == 0 {
+		return nil
+	}
+	_, err := self.conn.Write(self.buf.Bytes())
+	self.buf.Reset()
+	return err
+}
+
+// vim: set noet ts=2 sw=2:
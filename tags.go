@@ -0,0 +1,130 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "sort"
+import "strings"
+import "sync"
+
+// Distinct tag combinations counted per server, see Server.SetMetricTags().
+const taggedEntries = 1000
+
+// Value of the metric tags of sessions exceeding taggedEntries.
+const taggedOther = "other"
+
+// TaggedTraffic counts the sessions with a combination of metric tags, see
+// Server.SetMetricTags().
+type TaggedTraffic struct {
+	Tags      map[string]string
+	Sessions  uint64
+	BytesUp   uint64
+	BytesDown uint64
+}
+
+// Returns a copy of a with the tags of b added, taking precedence, or a itself
+// if b is empty.
+func mergeTags(a, b map[string]string) map[string]string {
+	if len(b) == 0 {
+		return a
+	}
+	rv := make(map[string]string, len(a)+len(b))
+	for k, v := range a {
+		rv[k] = v
+	}
+	for k, v := range b {
+		rv[k] = v
+	}
+	return rv
+}
+
+// Formats tags as "k=v k2=v2", ordered by key.
+func formatTags(tags map[string]string) string {
+	pairs := make([]string, 0, len(tags))
+	for k, v := range tags {
+		pairs = append(pairs, k+"="+v)
+	}
+	sort.Strings(pairs)
+	return strings.Join(pairs, " ")
+}
+
+// Counts sessions by the values of the metric tag keys.
+type taggedStats struct {
+	sync.Mutex
+	keys    []string
+	entries map[string]*TaggedTraffic
+}
+
+func newTaggedStats(keys []string) *taggedStats {
+	return &taggedStats{keys: keys, entries: make(map[string]*TaggedTraffic)}
+}
+
+// Records a finished session with tags. Sessions without any of the keys are
+// not counted.
+func (self *taggedStats) add(tags map[string]string, up, down uint64) {
+	selected := make(map[string]string, len(self.keys))
+	for _, key := range self.keys {
+		if value, ok := tags[key]; ok {
+			selected[key] = value
+		}
+	}
+	if len(selected) == 0 {
+		return
+	}
+	id := formatTags(selected)
+	self.Lock()
+	defer self.Unlock()
+	entry, ok := self.entries[id]
+	if !ok {
+		if len(self.entries) >= taggedEntries {
+			for key := range selected {
+				selected[key] = taggedOther
+			}
+			id = formatTags(selected)
+			entry = self.entries[id]
+		}
+		if entry == nil {
+			entry = &TaggedTraffic{Tags: selected}
+			self.entries[id] = entry
+		}
+	}
+	entry.Sessions++
+	entry.BytesUp += up
+	entry.BytesDown += down
+}
+
+// Returns the counts, ordered by tags.
+func (self *taggedStats) snapshot() []TaggedTraffic {
+	self.Lock()
+	defer self.Unlock()
+	ids := make([]string, 0, len(self.entries))
+	for id := range self.entries {
+		ids = append(ids, id)
+	}
+	sort.Strings(ids)
+	rv := make([]TaggedTraffic, len(ids))
+	for i, id := range ids {
+		rv[i] = *self.entries[id]
+	}
+	return rv
+}
+
+// vim: set noet ts=2 sw=2:
@@ -0,0 +1,302 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "crypto/md5"
+import "crypto/tls"
+import "crypto/x509"
+import "encoding/binary"
+import "encoding/hex"
+import "strconv"
+import "strings"
+import "sync"
+import "sync/atomic"
+
+const (
+	tlsRecordHandshake = 22
+
+	tlsClientHello = 1
+	tlsServerHello = 2
+	tlsCertificate = 11
+
+	tlsExtServerName        = 0
+	tlsExtSupportedGroups   = 10
+	tlsExtPointFormats      = 11
+	tlsExtSupportedVersions = 43
+
+	// Bytes observed per direction at most; server certificate chains may
+	// take a few records.
+	tlsObserveClient = 16 << 10
+	tlsObserveServer = 64 << 10
+)
+
+// TLSInfo holds what was observed of the TLS handshake of a session, see
+// SessionOptions.ObserveTLS.
+type TLSInfo struct {
+	ServerName string // Sent by the client (SNI), if any
+	JA3        string // Fingerprint of the ClientHello, as MD5 hex digest
+	JA3S       string // Fingerprint of the ServerHello, likewise
+	Version    uint16 // Negotiated, e.g. tls.VersionTLS13
+	Cipher     uint16 // Negotiated cipher suite
+
+	// Subject of the server certificate; TLS 1.3 encrypts certificates, so
+	// this is only available for older versions.
+	Subject string
+}
+
+func (self *TLSInfo) String() string {
+	rv := []string{"version=" + tls.VersionName(self.Version), "cipher=" + tls.CipherSuiteName(self.Cipher)}
+	if len(self.ServerName) != 0 {
+		rv = append(rv, "sni="+self.ServerName)
+	}
+	rv = append(rv, "ja3="+self.JA3, "ja3s="+self.JA3S)
+	if len(self.Subject) != 0 {
+		rv = append(rv, "subject="+strconv.Quote(self.Subject))
+	}
+	return strings.Join(rv, " ")
+}
+
+// Passively observes the TLS handshake of a session, from the bytes relayed
+// in both directions, until the handshake messages of interest were seen or
+// the session turns out not to speak TLS.
+type tlsObserver struct {
+	sync.Mutex
+	info     TLSInfo
+	hello    bool           // Got the ClientHello
+	buf      [2][]byte      // Records observed, by RelayDirection
+	done     [2]atomic.Bool // Observing ended, by RelayDirection
+	messages [2][]byte      // Handshake messages reassembled, by RelayDirection
+}
+
+func newTLSObserver() *tlsObserver {
+	return &tlsObserver{}
+}
+
+// Observes data relayed in dir.
+func (self *tlsObserver) observe(dir RelayDirection, data []byte) {
+	if self.done[dir].Load() {
+		return
+	}
+	self.Lock()
+	defer self.Unlock()
+	limit := tlsObserveClient
+	if dir == RelayDown {
+		limit = tlsObserveServer
+	}
+	buf := append(self.buf[dir], data[:min(len(data), limit-len(self.buf[dir]))]...)
+	// Reassemble handshake messages from complete records
+	for len(buf) >= 5 {
+		length := int(binary.BigEndian.Uint16(buf[3:5]))
+		if buf[0] != tlsRecordHandshake || buf[1] != 0x3 {
+			self.done[dir].Store(true)
+			break
+		}
+		if len(buf) < 5+length {
+			break
+		}
+		self.messages[dir] = append(self.messages[dir], buf[5:5+length]...)
+		buf = buf[5+length:]
+	}
+	self.buf[dir] = buf
+	if self.parse(dir) || len(self.buf[dir])+len(self.messages[dir]) >= limit {
+		self.done[dir].Store(true)
+	}
+	if self.done[dir].Load() {
+		self.buf[dir], self.messages[dir] = nil, nil
+	}
+}
+
+// Parses the complete handshake messages of dir, returning whether
+// everything of interest was seen.
+func (self *tlsObserver) parse(dir RelayDirection) bool {
+	data := self.messages[dir]
+	for len(data) >= 4 {
+		length := int(data[1])<<16 | int(data[2])<<8 | int(data[3])
+		if len(data) < 4+length {
+			break
+		}
+		kind, body := data[0], data[4:4+length]
+		data = data[4+length:]
+		switch {
+		case dir == RelayUp && kind == tlsClientHello:
+			self.parseClientHello(body)
+			return true
+		case dir == RelayDown && kind == tlsServerHello:
+			self.parseServerHello(body)
+			if self.info.Version >= tls.VersionTLS13 {
+				return true
+			}
+		case dir == RelayDown && kind == tlsCertificate:
+			self.parseCertificate(body)
+			return true
+		default:
+			return true
+		}
+	}
+	self.messages[dir] = data
+	return false
+}
+
+// Returns whether v is a GREASE value (RFC 8701), not part of fingerprints.
+func isGREASE(v uint16) bool {
+	return v&0x0f0f == 0x0a0a && v>>8 == v&0xff
+}
+
+// Reads a vector of length prefixed by size bytes off data.
+func tlsVector(data []byte, size int) (vector, rest []byte, ok bool) {
+	if len(data) < size {
+		return nil, nil, false
+	}
+	length := 0
+	for _, b := range data[:size] {
+		length = length<<8 | int(b)
+	}
+	if len(data) < size+length {
+		return nil, nil, false
+	}
+	return data[size : size+length], data[size+length:], true
+}
+
+// Returns the 16 bit values of data, joined by dashes, skipping GREASE.
+func ja3List(data []byte) string {
+	var rv []string
+	for ; len(data) >= 2; data = data[2:] {
+		if v := binary.BigEndian.Uint16(data); !isGREASE(v) {
+			rv = append(rv, strconv.Itoa(int(v)))
+		}
+	}
+	return strings.Join(rv, "-")
+}
+
+func ja3Digest(fields ...string) string {
+	sum := md5.Sum([]byte(strings.Join(fields, ",")))
+	return hex.EncodeToString(sum[:])
+}
+
+func (self *tlsObserver) parseClientHello(body []byte) {
+	if len(body) < 34 {
+		return
+	}
+	version := binary.BigEndian.Uint16(body)
+	_, rest, ok := tlsVector(body[34:], 1) // Session ID
+	if !ok {
+		return
+	}
+	ciphers, rest, ok := tlsVector(rest, 2)
+	if !ok {
+		return
+	}
+	if _, rest, ok = tlsVector(rest, 1); !ok { // Compression methods
+		return
+	}
+	extensions, _, _ := tlsVector(rest, 2)
+	var groups, formats string
+	var seen []string
+	for len(extensions) >= 4 {
+		kind := binary.BigEndian.Uint16(extensions)
+		var data []byte
+		if data, extensions, ok = tlsVector(extensions[2:], 2); !ok {
+			break
+		}
+		if !isGREASE(kind) {
+			seen = append(seen, strconv.Itoa(int(kind)))
+		}
+		switch kind {
+		case tlsExtServerName:
+			// List of entries of a type (0: host name) and a name
+			if list, _, ok := tlsVector(data, 2); ok && len(list) > 0 && list[0] == 0 {
+				if name, _, ok := tlsVector(list[1:], 2); ok {
+					self.info.ServerName = string(name)
+				}
+			}
+		case tlsExtSupportedGroups:
+			list, _, _ := tlsVector(data, 2)
+			groups = ja3List(list)
+		case tlsExtPointFormats:
+			list, _, _ := tlsVector(data, 1)
+			var points []string
+			for _, b := range list {
+				points = append(points, strconv.Itoa(int(b)))
+			}
+			formats = strings.Join(points, "-")
+		}
+	}
+	self.hello = true
+	self.info.JA3 = ja3Digest(strconv.Itoa(int(version)), ja3List(ciphers), strings.Join(seen, "-"), groups, formats)
+}
+
+func (self *tlsObserver) parseServerHello(body []byte) {
+	if len(body) < 34 {
+		return
+	}
+	version := binary.BigEndian.Uint16(body)
+	_, rest, ok := tlsVector(body[34:], 1) // Session ID
+	if !ok || len(rest) < 3 {
+		return
+	}
+	cipher := binary.BigEndian.Uint16(rest)
+	extensions, _, _ := tlsVector(rest[3:], 2)
+	var seen []string
+	self.info.Version = version
+	for len(extensions) >= 4 {
+		kind := binary.BigEndian.Uint16(extensions)
+		var data []byte
+		if data, extensions, ok = tlsVector(extensions[2:], 2); !ok {
+			break
+		}
+		seen = append(seen, strconv.Itoa(int(kind)))
+		if kind == tlsExtSupportedVersions && len(data) == 2 {
+			self.info.Version = binary.BigEndian.Uint16(data)
+		}
+	}
+	self.info.Cipher = cipher
+	self.info.JA3S = ja3Digest(strconv.Itoa(int(version)), strconv.Itoa(int(cipher)), strings.Join(seen, "-"))
+}
+
+func (self *tlsObserver) parseCertificate(body []byte) {
+	chain, _, ok := tlsVector(body, 3)
+	if !ok {
+		return
+	}
+	if der, _, ok := tlsVector(chain, 3); ok {
+		if cert, err := x509.ParseCertificate(der); err == nil {
+			self.info.Subject = cert.Subject.String()
+		}
+	}
+}
+
+// Returns what was observed, or nil if no ClientHello was seen, i.e. the
+// session did not speak TLS or was not observed.
+func (self *tlsObserver) snapshot() *TLSInfo {
+	if self == nil {
+		return nil
+	}
+	self.Lock()
+	defer self.Unlock()
+	if !self.hello {
+		return nil
+	}
+	info := self.info
+	return &info
+}
+
+// vim: set noet ts=2 sw=2:
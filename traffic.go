@@ -0,0 +1,129 @@
+// The MIT License (MIT)
+// Copyright © 2013 Nils Maier <https://tn123.org>
+//
+// Permission is hereby granted, free of charge, to any person obtaining a copy
+// of this software and associated documentation files (the “Software”), to deal
+// in the Software without restriction, including without limitation the rights
+// to use, copy, modify, merge, publish, distribute, sublicense, and/or sell
+// copies of the Software, and to permit persons to whom the Software is
+// furnished to do so, subject to the following conditions:
+//
+// The above copyright notice and this permission notice shall be included in
+// all copies or substantial portions of the Software.
+//
+// THE SOFTWARE IS PROVIDED “AS IS”, WITHOUT WARRANTY OF ANY KIND, EXPRESS OR
+// IMPLIED, INCLUDING BUT NOT LIMITED TO THE WARRANTIES OF MERCHANTABILITY,
+// FITNESS FOR A PARTICULAR PURPOSE AND NONINFRINGEMENT. IN NO EVENT SHALL THE
+// AUTHORS OR COPYRIGHT HOLDERS BE LIABLE FOR ANY CLAIM, DAMAGES OR OTHER
+// LIABILITY, WHETHER IN AN ACTION OF CONTRACT, TORT OR OTHERWISE, ARISING FROM,
+// OUT OF OR IN CONNECTION WITH THE SOFTWARE OR THE USE OR OTHER DEALINGS IN
+// THE SOFTWARE.
+
+package gosocksv5d
+
+import "sort"
+import "sync"
+import "time"
+
+const (
+	trafficBucket  = time.Minute
+	trafficBuckets = 60   // Retained, i.e. an hour
+	trafficEntries = 4096 // Destinations per bucket, before aggregating as "other"
+	trafficOther   = "other"
+)
+
+// Traffic relayed to and from a destination.
+type DestinationTraffic struct {
+	Destination string // Requested domain, or IP if requested by IP
+	Sessions    uint64
+	BytesUp     uint64 // Sent by clients
+	BytesDown   uint64 // Received by clients
+}
+
+// Total bytes relayed.
+func (self *DestinationTraffic) Bytes() uint64 {
+	return self.BytesUp + self.BytesDown
+}
+
+type trafficBucketData struct {
+	start int64 // Unix time of the bucket start
+	dests map[string]*DestinationTraffic
+}
+
+// Aggregates relayed bytes by destination, in one minute buckets.
+type trafficStats struct {
+	sync.Mutex
+	buckets [trafficBuckets]trafficBucketData
+}
+
+// Records a finished session.
+func (self *trafficStats) add(dest string, up, down uint64) {
+	now := time.Now().Truncate(trafficBucket).Unix()
+	self.Lock()
+	defer self.Unlock()
+	bucket := &self.buckets[(now/int64(trafficBucket/time.Second))%trafficBuckets]
+	if bucket.start != now || bucket.dests == nil {
+		bucket.start, bucket.dests = now, make(map[string]*DestinationTraffic)
+	}
+	entry, ok := bucket.dests[dest]
+	if !ok {
+		if len(bucket.dests) >= trafficEntries {
+			dest = trafficOther
+			entry = bucket.dests[dest]
+		}
+		if entry == nil {
+			entry = &DestinationTraffic{Destination: dest}
+			bucket.dests[dest] = entry
+		}
+	}
+	entry.Sessions++
+	entry.BytesUp += up
+	entry.BytesDown += down
+}
+
+// Returns the destination as requested, without port.
+func (sock *sockConn) destination() string {
+	if len(sock.host) != 0 {
+		return sock.host
+	}
+	return sock.ip.String()
+}
+
+func (self *trafficStats) top(n int, window time.Duration) []DestinationTraffic {
+	since := time.Now().Add(-window).Truncate(trafficBucket).Unix()
+	totals := make(map[string]*DestinationTraffic)
+	self.Lock()
+	for _, bucket := range self.buckets {
+		if bucket.start < since {
+			continue
+		}
+		for dest, entry := range bucket.dests {
+			total, ok := totals[dest]
+			if !ok {
+				total = &DestinationTraffic{Destination: dest}
+				totals[dest] = total
+			}
+			total.Sessions += entry.Sessions
+			total.BytesUp += entry.BytesUp
+			total.BytesDown += entry.BytesDown
+		}
+	}
+	self.Unlock()
+
+	rv := make([]DestinationTraffic, 0, len(totals))
+	for _, total := range totals {
+		rv = append(rv, *total)
+	}
+	sort.Slice(rv, func(i, j int) bool {
+		if rv[i].Bytes() != rv[j].Bytes() {
+			return rv[i].Bytes() > rv[j].Bytes()
+		}
+		return rv[i].Destination < rv[j].Destination
+	})
+	if n > 0 && len(rv) > n {
+		rv = rv[:n]
+	}
+	return rv
+}
+
+// vim: set noet ts=2 sw=2: